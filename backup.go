@@ -0,0 +1,568 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/packet"
+	// OpenPGP falls back on RIPEMD-160 for keys that state no hash preferences
+	_ "golang.org/x/crypto/ripemd160"
+)
+
+// backupsPrefix is where database backups are stored in the bucket
+const backupsPrefix = "database_backups/"
+
+// Ways a database backup is encrypted
+const (
+	// EncryptionAge encrypts to age recipients with the age binary
+	EncryptionAge = "age"
+	// EncryptionOpenPGP encrypts to OpenPGP public keys
+	EncryptionOpenPGP = "openpgp"
+	// EncryptionKey encrypts with a passphrase, as an OpenPGP message gpg can decrypt
+	EncryptionKey = "key"
+)
+
+// BackupsConfig describes how database backups are stored
+type BackupsConfig struct {
+	Encryption EncryptionConfig `json:"encryption"`
+}
+
+// EncryptionConfig describes how database dumps are encrypted before they are
+// uploaded, and how they are decrypted when they are fetched. Only one of age
+// recipients, OpenPGP public keys and a key may be set.
+type EncryptionConfig struct {
+	// AgeRecipients are the age or SSH public keys backups are encrypted to
+	AgeRecipients []string `json:"age_recipients"`
+	// AgeIdentities are the files of the age or SSH private keys backups are
+	// decrypted with
+	AgeIdentities []string `json:"age_identities"`
+	// AgeBinary is the path of the age binary, age on the PATH by default
+	AgeBinary string `json:"age_binary"`
+	// PGPPublicKeys are files of the OpenPGP public keys backups are encrypted to
+	PGPPublicKeys []string `json:"pgp_public_keys"`
+	// PGPSecretKeys are files of the OpenPGP secret keys backups are decrypted with
+	PGPSecretKeys []string `json:"pgp_secret_keys"`
+	// Key, KeyEnv, KeyFile and KeyCommand set a passphrase backups are encrypted
+	// with, read like the password of a database
+	Key        string `json:"key"`
+	KeyEnv     string `json:"key_env"`
+	KeyFile    string `json:"key_file"`
+	KeyCommand string `json:"key_command"`
+}
+
+// BackupKey identifies something that can decrypt a backup
+type BackupKey struct {
+	// Type is age, openpgp or key
+	Type string `json:"type"`
+	// ID is the age recipient, the fingerprint of the OpenPGP key, or where the
+	// passphrase was read from
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// BackupManifest describes a database backup as it is stored in the bucket
+type BackupManifest struct {
+	BackupName string    `json:"backup_name"`
+	Created    time.Time `json:"created"`
+	// File is the name of the stored dump under the prefix of the backup
+	File   string `json:"file"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+	// DumpSHA256 is the checksum of the dump before it was encrypted
+	DumpSHA256 string `json:"dump_sha256"`
+	// Encryption is age, openpgp or key, and empty when the dump is stored as it is
+	Encryption string      `json:"encryption,omitempty"`
+	Keys       []BackupKey `json:"keys,omitempty"`
+}
+
+func backupManifestKey(backupName string) string {
+	return backupsPrefix + backupName + "/manifest.json"
+}
+
+// format returns how backups are encrypted, or an empty string if they are not
+func (e EncryptionConfig) format() (string, error) {
+	var formats []string
+	if len(e.AgeRecipients) > 0 {
+		formats = append(formats, EncryptionAge)
+	}
+	if len(e.PGPPublicKeys) > 0 {
+		formats = append(formats, EncryptionOpenPGP)
+	}
+	if e.hasKey() {
+		formats = append(formats, EncryptionKey)
+	}
+	if len(formats) > 1 {
+		return "", fmt.Errorf("backups can only be encrypted one way, but %s are set", strings.Join(formats, " and "))
+	}
+	if len(formats) == 0 {
+		return "", nil
+	}
+
+	return formats[0], nil
+}
+
+func (e EncryptionConfig) hasKey() bool {
+	return e.Key != "" || e.KeyEnv != "" || e.KeyFile != "" || e.KeyCommand != ""
+}
+
+func (e EncryptionConfig) key() (string, error) {
+	if !e.hasKey() {
+		return "", errors.New("no key is set to decrypt the backup with")
+	}
+
+	return readSecret("key", e.Key, e.KeyEnv, e.KeyFile, e.KeyCommand)
+}
+
+// keySource describes where the passphrase is read from without revealing it
+func (e EncryptionConfig) keySource() string {
+	switch {
+	case e.KeyEnv != "":
+		return "env:" + e.KeyEnv
+	case e.KeyFile != "":
+		return "file:" + e.KeyFile
+	case e.KeyCommand != "":
+		return "command"
+	}
+
+	return "config"
+}
+
+func (e EncryptionConfig) ageBinary() string {
+	if e.AgeBinary == "" {
+		return "age"
+	}
+
+	return e.AgeBinary
+}
+
+// encryptedName returns the name a dump is stored under once it is encrypted
+func encryptedName(name string, format string) string {
+	switch format {
+	case EncryptionAge:
+		return name + ".age"
+	case EncryptionOpenPGP, EncryptionKey:
+		return name + ".gpg"
+	}
+
+	return name
+}
+
+// readKeyRing reads OpenPGP keys from armored or binary key files
+func readKeyRing(files []string) (openpgp.EntityList, error) {
+	var keyring openpgp.EntityList
+	for _, name := range files {
+		file, err := os.Open(expandHome(name))
+		if err != nil {
+			return nil, err
+		}
+		entities, err := openpgp.ReadArmoredKeyRing(file)
+		if err != nil {
+			_, err = file.Seek(0, io.SeekStart)
+			if err == nil {
+				entities, err = openpgp.ReadKeyRing(file)
+			}
+		}
+		file.Close()
+		if err != nil {
+			return nil, fmt.Errorf("reading the OpenPGP keys in %s: %v", name, err)
+		}
+		keyring = append(keyring, entities...)
+	}
+
+	return keyring, nil
+}
+
+// pgpBackupKey identifies an OpenPGP key by its fingerprint and first user ID
+func pgpBackupKey(entity *openpgp.Entity) BackupKey {
+	var names []string
+	for name := range entity.Identities {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	key := BackupKey{Type: EncryptionOpenPGP, ID: fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)}
+	if len(names) > 0 {
+		key.Name = names[0]
+	}
+
+	return key
+}
+
+// encryptBackup encrypts a dump next to itself and returns the encrypted file and
+// the keys that can decrypt it. The dump is returned as it is when backups are not
+// encrypted.
+func encryptBackup(encryption EncryptionConfig, dump string) (string, []BackupKey, error) {
+	format, err := encryption.format()
+	if err != nil || format == "" {
+		return dump, nil, err
+	}
+	encrypted := encryptedName(dump, format)
+
+	if format == EncryptionAge {
+		args := []string{"--encrypt", "--output", encrypted}
+		var keys []BackupKey
+		for _, recipient := range encryption.AgeRecipients {
+			args = append(args, "--recipient", recipient)
+			keys = append(keys, BackupKey{Type: EncryptionAge, ID: recipient})
+		}
+		cmd := exec.Command(encryption.ageBinary(), append(args, dump)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		err = cmd.Run()
+		if err != nil {
+			os.Remove(encrypted)
+			return "", nil, fmt.Errorf("encrypting %s with age: %v", dump, err)
+		}
+
+		return encrypted, keys, nil
+	}
+
+	source, err := os.Open(dump)
+	if err != nil {
+		return "", nil, err
+	}
+	defer source.Close()
+	destination, err := os.OpenFile(encrypted, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return "", nil, err
+	}
+	defer destination.Close()
+
+	hints := &openpgp.FileHints{IsBinary: true, FileName: filepath.Base(dump)}
+	packetConfig := &packet.Config{DefaultCipher: packet.CipherAES256, DefaultCompressionAlgo: packet.CompressionZLIB}
+	var keys []BackupKey
+	var plaintext io.WriteCloser
+	if format == EncryptionKey {
+		passphrase, err := encryption.key()
+		if err != nil {
+			return "", nil, err
+		}
+		keys = append(keys, BackupKey{Type: EncryptionKey, ID: encryption.keySource()})
+		plaintext, err = openpgp.SymmetricallyEncrypt(destination, []byte(passphrase), hints, packetConfig)
+		if err != nil {
+			return "", nil, err
+		}
+	} else {
+		keyring, err := readKeyRing(encryption.PGPPublicKeys)
+		if err != nil {
+			return "", nil, err
+		}
+		for _, entity := range keyring {
+			keys = append(keys, pgpBackupKey(entity))
+		}
+		plaintext, err = openpgp.Encrypt(destination, keyring, nil, hints, packetConfig)
+		if err != nil {
+			return "", nil, err
+		}
+	}
+
+	_, err = io.Copy(plaintext, source)
+	if err == nil {
+		err = plaintext.Close()
+	}
+	if err == nil {
+		err = destination.Sync()
+	}
+	if err != nil {
+		os.Remove(encrypted)
+		return "", nil, fmt.Errorf("encrypting %s: %v", dump, err)
+	}
+
+	return encrypted, keys, nil
+}
+
+// decryptBackup decrypts a backup that was encrypted the given way into a file only
+// the current user can read
+func decryptBackup(encryption EncryptionConfig, format string, encrypted string, dump string) error {
+	if format == EncryptionAge {
+		if len(encryption.AgeIdentities) == 0 {
+			return errors.New("age_identities must be set to decrypt the backup")
+		}
+		args := []string{"--decrypt", "--output", dump}
+		for _, identity := range encryption.AgeIdentities {
+			args = append(args, "--identity", expandHome(identity))
+		}
+		cmd := exec.Command(encryption.ageBinary(), append(args, encrypted)...)
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+
+		err := cmd.Run()
+		if err != nil {
+			os.Remove(dump)
+			return fmt.Errorf("decrypting %s with age: %v", encrypted, err)
+		}
+
+		return os.Chmod(dump, 0600)
+	}
+	if format != EncryptionOpenPGP && format != EncryptionKey {
+		return fmt.Errorf("unknown backup encryption %q", format)
+	}
+
+	var keyring openpgp.EntityList
+	if format == EncryptionOpenPGP {
+		if len(encryption.PGPSecretKeys) == 0 {
+			return errors.New("pgp_secret_keys must be set to decrypt the backup")
+		}
+		var err error
+		keyring, err = readKeyRing(encryption.PGPSecretKeys)
+		if err != nil {
+			return err
+		}
+	}
+	// ReadMessage prompts again for as long as the passphrase is wrong
+	prompted := false
+	prompt := func(keys []openpgp.Key, symmetric bool) ([]byte, error) {
+		if !symmetric {
+			return nil, errors.New("no usable secret key, or it is protected by a passphrase")
+		}
+		if prompted {
+			return nil, errors.New("the key does not decrypt the backup")
+		}
+		prompted = true
+		passphrase, err := encryption.key()
+		return []byte(passphrase), err
+	}
+
+	source, err := os.Open(encrypted)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	message, err := openpgp.ReadMessage(source, keyring, prompt, nil)
+	if err != nil {
+		return fmt.Errorf("decrypting %s: %v", encrypted, err)
+	}
+
+	destination, err := os.OpenFile(dump, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(destination, message.UnverifiedBody)
+	if closeErr := destination.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dump)
+		return fmt.Errorf("decrypting %s: %v", encrypted, err)
+	}
+
+	return nil
+}
+
+// prepareBackup encrypts the dump of a run when backups are encrypted and describes
+// what is about to be stored in a manifest, a copy of which is kept in the run
+// directory. It returns the file to upload along with the manifest.
+func prepareBackup(config Config, run *Run) (string, *BackupManifest, error) {
+	format, err := config.Backups.Encryption.format()
+	if err != nil {
+		return "", nil, err
+	}
+	dump := run.Path(stagingDumpFile)
+	dumpChecksum, err := hashFile(dump)
+	if err != nil {
+		return "", nil, err
+	}
+
+	stored, keys, err := encryptBackup(config.Backups.Encryption, dump)
+	if err != nil {
+		return "", nil, err
+	}
+
+	checksum := dumpChecksum
+	if stored != dump {
+		checksum, err = hashFile(stored)
+		if err != nil {
+			return "", nil, err
+		}
+		logger.Info("Encrypted Database Backup",
+			zap.String("file", stored),
+			zap.String("encryption", format),
+			zap.Int("keys", len(keys)),
+		)
+	}
+	stat, err := os.Stat(stored)
+	if err != nil {
+		return "", nil, err
+	}
+
+	manifest := &BackupManifest{
+		BackupName: run.Name,
+		Created:    time.Now().UTC(),
+		File:       filepath.Base(stored),
+		Size:       stat.Size(),
+		SHA256:     checksum,
+		DumpSHA256: dumpChecksum,
+		Encryption: format,
+		Keys:       keys,
+	}
+	body, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return "", nil, err
+	}
+	err = ioutil.WriteFile(run.Path(backupManifestFile), body, 0600)
+	if err != nil {
+		return "", nil, err
+	}
+
+	return stored, manifest, nil
+}
+
+// writeBackupManifest stores the manifest of a backup next to its dump
+func writeBackupManifest(config *S3Config, manifest *BackupManifest) error {
+	body, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	_, err = config.S3Service.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(config.Bucket),
+		Key:         aws.String(backupManifestKey(manifest.BackupName)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+
+	return err
+}
+
+// loadBackupManifest reads the manifest of a backup. Backups made before manifests
+// were written are plain dumps.
+func loadBackupManifest(config *S3Config, backupName string) (*BackupManifest, error) {
+	object, err := config.S3Service.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(backupManifestKey(backupName)),
+	})
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == s3.ErrCodeNoSuchKey {
+		return &BackupManifest{BackupName: backupName, File: stagingDumpFile}, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("could not load the backup manifest for %s: %v", backupName, err)
+	}
+	defer object.Body.Close()
+
+	manifest := &BackupManifest{}
+	err = json.NewDecoder(object.Body).Decode(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the backup manifest for %s: %v", backupName, err)
+	}
+	if manifest.File == "" || path.Base(manifest.File) != manifest.File {
+		return nil, fmt.Errorf("the backup manifest for %s names an invalid file %q", backupName, manifest.File)
+	}
+
+	return manifest, nil
+}
+
+// FetchBackup downloads the database dump of a backup, decrypts it if it was
+// encrypted and verifies it against its manifest
+func FetchBackup(config Config, backupName string, output string) error {
+	if backupName == "" || path.Base(backupName) != backupName {
+		return fmt.Errorf("invalid backup name %q", backupName)
+	}
+	err := loadAwsConfigFile()
+	if err != nil {
+		return err
+	}
+
+	s3config, err := newS3Config(config, backupsPrefix+backupName+"/")
+	if err != nil {
+		return err
+	}
+
+	return fetchBackup(s3config, config.Backups.Encryption, backupName, output)
+}
+
+func fetchBackup(config *S3Config, encryption EncryptionConfig, backupName string, output string) error {
+	manifest, err := loadBackupManifest(config, backupName)
+	if err != nil {
+		return err
+	}
+
+	// Downloaded next to the output, so that the dump can be renamed into place
+	directory, err := ioutil.TempDir(filepath.Dir(output), ".jet-fetch-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(directory)
+
+	key := config.BucketPrefix + manifest.File
+	head, err := config.S3Service.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return fmt.Errorf("fetching %s: %v", key, err)
+	}
+	remote := &FileStat{
+		Name:    manifest.File,
+		Path:    key,
+		Size:    aws.Int64Value(head.ContentLength),
+		ModTime: aws.TimeValue(head.LastModified),
+		ETag:    aws.StringValue(head.ETag),
+	}
+	attempts, err := defaultRetryPolicy.Do(func() error {
+		return download(config, directory, remote)
+	}, isTransientS3Error)
+	if err != nil {
+		return fmt.Errorf("downloading %s after %d attempt(s): %v", key, attempts, err)
+	}
+
+	stored := filepath.Join(directory, manifest.File)
+	if manifest.SHA256 != "" {
+		checksum, err := hashFile(stored)
+		if err != nil {
+			return err
+		}
+		if checksum != manifest.SHA256 {
+			return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", key, manifest.SHA256, checksum)
+		}
+	}
+
+	dump := stored
+	if manifest.Encryption != "" {
+		dump = filepath.Join(directory, stagingDumpFile)
+		err = decryptBackup(encryption, manifest.Encryption, stored, dump)
+		if err != nil {
+			return err
+		}
+	}
+	checksum, err := hashFile(dump)
+	if err != nil {
+		return err
+	}
+	if manifest.DumpSHA256 != "" && checksum != manifest.DumpSHA256 {
+		return fmt.Errorf("checksum mismatch for the decrypted dump of %s: expected %s, got %s", backupName, manifest.DumpSHA256, checksum)
+	}
+
+	err = os.Chmod(dump, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(dump, output)
+	if err != nil {
+		return err
+	}
+	logger.Info("Fetched Database Backup",
+		zap.String("backup", backupName),
+		zap.String("file", output),
+		zap.String("encryption", manifest.Encryption),
+		zap.String("sha256", checksum),
+	)
+
+	return nil
+}
@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/openpgp"
+	"golang.org/x/crypto/openpgp/armor"
+)
+
+func TestEncryptionFormat(t *testing.T) {
+	for expected, encryption := range map[string]EncryptionConfig{
+		"":                {},
+		EncryptionAge:     {AgeRecipients: []string{"age1example"}},
+		EncryptionOpenPGP: {PGPPublicKeys: []string{"ops.asc"}},
+		EncryptionKey:     {KeyEnv: "JET_BACKUP_KEY"},
+	} {
+		format, err := encryption.format()
+		if err != nil || format != expected {
+			t.Errorf("expected %+v to be encrypted with %q, got %q: %v", encryption, expected, format, err)
+		}
+	}
+
+	_, err := EncryptionConfig{AgeRecipients: []string{"age1example"}, Key: "secret"}.format()
+	if err == nil {
+		t.Error("expected backups encrypted two ways to be rejected")
+	}
+}
+
+func TestEncryptBackupWithKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetbackup")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	contents := []byte("INSERT INTO wp_users VALUES (1, 'admin', 'admin@example.com');")
+	dump := filepath.Join(dir, "staging_dump.sql")
+	ioutil.WriteFile(dump, contents, 0600)
+	os.Setenv("JET_TEST_BACKUP_KEY", "correct horse battery staple")
+	defer os.Unsetenv("JET_TEST_BACKUP_KEY")
+	encryption := EncryptionConfig{KeyEnv: "JET_TEST_BACKUP_KEY"}
+
+	encrypted, keys, err := encryptBackup(encryption, dump)
+	if err != nil {
+		t.Fatal("unable to encrypt the backup: ", err.Error())
+	}
+	if encrypted != dump+".gpg" {
+		t.Errorf("expected the backup to be encrypted to %s.gpg, got %s", dump, encrypted)
+	}
+	if len(keys) != 1 || keys[0].Type != EncryptionKey || keys[0].ID != "env:JET_TEST_BACKUP_KEY" {
+		t.Errorf("expected the key to be recorded by where it is read from, got %+v", keys)
+	}
+	stored, _ := ioutil.ReadFile(encrypted)
+	if bytes.Contains(stored, []byte("admin@example.com")) {
+		t.Error("expected the stored backup to be encrypted")
+	}
+
+	decrypted := filepath.Join(dir, "decrypted.sql")
+	err = decryptBackup(encryption, EncryptionKey, encrypted, decrypted)
+	if err != nil {
+		t.Fatal("unable to decrypt the backup: ", err.Error())
+	}
+	fetched, _ := ioutil.ReadFile(decrypted)
+	if !bytes.Equal(fetched, contents) {
+		t.Error("expected the decrypted backup to match the dump")
+	}
+
+	err = decryptBackup(EncryptionConfig{Key: "wrong"}, EncryptionKey, encrypted, decrypted)
+	if err == nil {
+		t.Error("expected the wrong key not to decrypt the backup")
+	}
+}
+
+func TestEncryptBackupWithOpenPGP(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetbackup")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	entity, err := openpgp.NewEntity("Ops", "", "ops@example.com", nil)
+	if err != nil {
+		t.Fatal("unable to generate a key: ", err.Error())
+	}
+	var public, secret bytes.Buffer
+	writer, _ := armor.Encode(&public, openpgp.PublicKeyType, nil)
+	entity.Serialize(writer)
+	writer.Close()
+	entity.SerializePrivate(&secret, nil)
+	ioutil.WriteFile(filepath.Join(dir, "ops.asc"), public.Bytes(), 0644)
+	ioutil.WriteFile(filepath.Join(dir, "ops.key"), secret.Bytes(), 0600)
+
+	contents := []byte("INSERT INTO wp_users VALUES (1, 'admin', 'admin@example.com');")
+	dump := filepath.Join(dir, "staging_dump.sql")
+	ioutil.WriteFile(dump, contents, 0600)
+
+	encrypted, keys, err := encryptBackup(EncryptionConfig{PGPPublicKeys: []string{filepath.Join(dir, "ops.asc")}}, dump)
+	if err != nil {
+		t.Fatal("unable to encrypt the backup: ", err.Error())
+	}
+	fingerprint := fmt.Sprintf("%X", entity.PrimaryKey.Fingerprint)
+	if len(keys) != 1 || keys[0].Type != EncryptionOpenPGP || keys[0].ID != fingerprint || keys[0].Name != "Ops <ops@example.com>" {
+		t.Errorf("expected the key to be recorded by its fingerprint, got %+v", keys)
+	}
+
+	decrypted := filepath.Join(dir, "decrypted.sql")
+	err = decryptBackup(EncryptionConfig{}, EncryptionOpenPGP, encrypted, decrypted)
+	if err == nil {
+		t.Error("expected the backup not to decrypt without a secret key")
+	}
+	err = decryptBackup(EncryptionConfig{PGPSecretKeys: []string{filepath.Join(dir, "ops.key")}}, EncryptionOpenPGP, encrypted, decrypted)
+	if err != nil {
+		t.Fatal("unable to decrypt the backup: ", err.Error())
+	}
+	fetched, _ := ioutil.ReadFile(decrypted)
+	if !bytes.Equal(fetched, contents) {
+		t.Error("expected the decrypted backup to match the dump")
+	}
+}
+
+func TestFetchBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetbackup")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	config := &Config{Backups: BackupsConfig{Encryption: EncryptionConfig{Key: "correct horse battery staple"}}}
+	run := testRun(t, config, "2018-05-1_12-0-0")
+	defer os.RemoveAll(config.Runs.Directory)
+	contents := []byte("INSERT INTO wp_users VALUES (1, 'admin', 'admin@example.com');")
+	ioutil.WriteFile(run.Path(stagingDumpFile), contents, 0600)
+
+	stored, manifest, err := prepareBackup(*config, run)
+	if err != nil {
+		t.Fatal("unable to prepare the backup: ", err.Error())
+	}
+	if manifest.File != stagingDumpFile+".gpg" || manifest.Encryption != EncryptionKey || len(manifest.Keys) != 1 {
+		t.Errorf("expected the manifest to record how the backup was encrypted, got %+v", manifest)
+	}
+	if _, err := os.Stat(run.Path(backupManifestFile)); err != nil {
+		t.Error("expected a copy of the manifest in the run directory")
+	}
+
+	encrypted, _ := ioutil.ReadFile(stored)
+	body, _ := json.Marshal(manifest)
+	prefix := backupsPrefix + run.Name + "/"
+	service := &fakeS3{objects: map[string][]byte{
+		backupManifestKey(run.Name): body,
+		prefix + manifest.File:      encrypted,
+	}}
+	s3config := &S3Config{S3Service: service, Bucket: "bucket", BucketPrefix: prefix}
+
+	output := filepath.Join(dir, "fetched.sql")
+	err = fetchBackup(s3config, config.Backups.Encryption, run.Name, output)
+	if err != nil {
+		t.Fatal("unable to fetch the backup: ", err.Error())
+	}
+	fetched, _ := ioutil.ReadFile(output)
+	if !bytes.Equal(fetched, contents) {
+		t.Error("expected the fetched backup to match the dump")
+	}
+	if stat, err := os.Stat(output); err != nil || stat.Mode().Perm() != 0600 {
+		t.Error("expected the fetched backup to be private")
+	}
+
+	service.objects[prefix+manifest.File] = append(encrypted, 0)
+	err = fetchBackup(s3config, config.Backups.Encryption, run.Name, filepath.Join(dir, "tampered.sql"))
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// redacted replaces secrets in log output
+const redacted = "[REDACTED]"
+
+var (
+	secretsMu sync.Mutex
+	// secrets are redacted from everything that is logged
+	secrets []string
+	// commandSecrets caches what secret commands printed, so each runs once
+	commandSecrets = make(map[string]string)
+)
+
+// registerSecret redacts a value from log output from now on
+func registerSecret(secret string) {
+	if secret == "" {
+		return
+	}
+
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, s := range secrets {
+		if s == secret {
+			return
+		}
+	}
+	secrets = append(secrets, secret)
+}
+
+// redactSecrets replaces every registered secret in a string
+func redactSecrets(s string) string {
+	secretsMu.Lock()
+	defer secretsMu.Unlock()
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, redacted, -1)
+	}
+
+	return s
+}
+
+// databasePassword returns the password of the user of a database, which is taken
+// from the config, an environment variable, a file or the output of a command, and
+// redacts it from log output
+func databasePassword(database Database) (string, error) {
+	return readSecret("password", database.Password, database.PasswordEnv, database.PasswordFile, database.PasswordCommand)
+}
+
+// readSecret returns the secret set with one of the option, option_env, option_file
+// and option_command settings, and redacts it from log output
+func readSecret(option string, value string, env string, file string, command string) (string, error) {
+	sources := 0
+	for _, source := range []string{value, env, file, command} {
+		if source != "" {
+			sources++
+		}
+	}
+	if sources > 1 {
+		return "", fmt.Errorf("only one of %[1]s, %[1]s_env, %[1]s_file and %[1]s_command may be set", option)
+	}
+
+	var secret string
+	switch {
+	case env != "":
+		variable, ok := os.LookupEnv(env)
+		if !ok {
+			return "", fmt.Errorf("the %s environment variable %s is not set", option, env)
+		}
+		secret = variable
+	case file != "":
+		contents, err := ioutil.ReadFile(expandHome(file))
+		if err != nil {
+			return "", fmt.Errorf("reading the %s file: %v", option, err)
+		}
+		secret = strings.TrimRight(string(contents), "\r\n")
+	case command != "":
+		var err error
+		secret, err = runSecretCommand(option, command)
+		if err != nil {
+			return "", err
+		}
+	default:
+		secret = value
+	}
+	registerSecret(secret)
+
+	return secret, nil
+}
+
+func runSecretCommand(option string, command string) (string, error) {
+	secretsMu.Lock()
+	secret, ok := commandSecrets[command]
+	secretsMu.Unlock()
+	if ok {
+		return secret, nil
+	}
+
+	cmd := exec.Command("sh", "-c", command)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return "", fmt.Errorf("running the %s command: %v", option, err)
+	}
+	secret = strings.TrimRight(string(output), "\r\n")
+
+	secretsMu.Lock()
+	commandSecrets[command] = secret
+	secretsMu.Unlock()
+
+	return secret, nil
+}
+
+// quoteOption quotes a value of a MySQL option file
+func quoteOption(value string) string {
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(value) + `"`
+}
+
+// redactingCore removes registered secrets from log entries before they are written
+type redactingCore struct {
+	zapcore.Core
+}
+
+// redactCore wraps a core so that nothing it writes contains a registered secret
+func redactCore(core zapcore.Core) zapcore.Core {
+	return redactingCore{core}
+}
+
+func (c redactingCore) With(fields []zapcore.Field) zapcore.Core {
+	return redactingCore{c.Core.With(redactFields(fields))}
+}
+
+func (c redactingCore) Check(entry zapcore.Entry, checked *zapcore.CheckedEntry) *zapcore.CheckedEntry {
+	if c.Enabled(entry.Level) {
+		return checked.AddCore(entry, c)
+	}
+
+	return checked
+}
+
+func (c redactingCore) Write(entry zapcore.Entry, fields []zapcore.Field) error {
+	entry.Message = redactSecrets(entry.Message)
+
+	return c.Core.Write(entry, redactFields(fields))
+}
+
+func redactFields(fields []zapcore.Field) []zapcore.Field {
+	redactedFields := make([]zapcore.Field, len(fields))
+	for i, field := range fields {
+		switch field.Type {
+		case zapcore.StringType:
+			field.String = redactSecrets(field.String)
+		case zapcore.ErrorType:
+			if err, ok := field.Interface.(error); ok {
+				field = zap.String(field.Key, redactSecrets(err.Error()))
+			}
+		case zapcore.StringerType:
+			if stringer, ok := field.Interface.(fmt.Stringer); ok {
+				field = zap.String(field.Key, redactSecrets(stringer.String()))
+			}
+		}
+		redactedFields[i] = field
+	}
+
+	return redactedFields
+}
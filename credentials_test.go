@@ -0,0 +1,71 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"go.uber.org/zap/zaptest/observer"
+)
+
+func TestDatabasePassword(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetcredentials")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	os.Setenv("JET_TEST_PASSWORD", "from-env")
+	defer os.Unsetenv("JET_TEST_PASSWORD")
+	passwordFile := filepath.Join(dir, "password")
+	ioutil.WriteFile(passwordFile, []byte("from-file\n"), 0600)
+
+	for _, test := range []struct {
+		database Database
+		expected string
+	}{
+		{Database{Password: "from-config"}, "from-config"},
+		{Database{PasswordEnv: "JET_TEST_PASSWORD"}, "from-env"},
+		{Database{PasswordFile: passwordFile}, "from-file"},
+		{Database{PasswordCommand: "echo from-command"}, "from-command"},
+	} {
+		password, err := databasePassword(test.database)
+		if err != nil || password != test.expected {
+			t.Errorf("expected %s, got %q: %v", test.expected, password, err)
+		}
+	}
+
+	_, err = databasePassword(Database{Password: "one", PasswordEnv: "JET_TEST_PASSWORD"})
+	if err == nil {
+		t.Error("expected two password sources to be rejected")
+	}
+	_, err = databasePassword(Database{PasswordEnv: "JET_TEST_UNSET_PASSWORD"})
+	if err == nil {
+		t.Error("expected an unset password variable to be rejected")
+	}
+}
+
+func TestRedactSecrets(t *testing.T) {
+	core, logs := observer.New(zapcore.InfoLevel)
+	log := zap.New(redactCore(core))
+
+	registerSecret("hunter2-secret")
+	log.With(zap.String("dsn", "site:hunter2-secret@db")).Info("Connecting with hunter2-secret",
+		zap.Error(errors.New("access denied for hunter2-secret")),
+	)
+
+	entry := logs.All()[0]
+	if strings.Contains(entry.Message, "hunter2-secret") {
+		t.Error("expected the secret to be redacted from the message")
+	}
+	for key, value := range entry.ContextMap() {
+		if strings.Contains(value.(string), "hunter2-secret") || !strings.Contains(value.(string), redacted) {
+			t.Errorf("expected the secret to be redacted from %s, got %v", key, value)
+		}
+	}
+}
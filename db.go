@@ -2,26 +2,26 @@ package main
 
 import (
 	"errors"
-	"fmt"
-	"io"
 	"os"
-	"os/exec"
 )
 
-// DumpDatabase produces a database dump of staging environment
-func DumpDatabase(config Config) error {
-	cmd := exec.Command(config.BinaryPaths.MySQLDump,
-		"--defaults-file=mysql.cnf",
+// DumpDatabase produces a database dump of staging environment in the run directory
+func DumpDatabase(config Config, run *Run) error {
+	cmd, remove, err := mysqlCommand(config.BinaryPaths.MySQLDump, config.Environments.Staging.Database,
 		"--no-create-db",
 		"--skip-lock-tables",
-		"--result-file=staging_dump.sql",
+		"--result-file="+run.Path(stagingDumpFile),
 		config.Environments.Staging.Database.Name,
 	)
+	if err != nil {
+		return err
+	}
+	defer remove()
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		return err
 	}
@@ -30,8 +30,8 @@ func DumpDatabase(config Config) error {
 }
 
 // DumpPersistentTables produces a database dump of persistent
-// tables in the production environment
-func DumpPersistentTables(config Config) error {
+// tables in the production environment in the run directory
+func DumpPersistentTables(config Config, run *Run) error {
 	persistentTables := config.Environments.Production.Database.PersistentTables
 	if len(persistentTables) == 0 {
 		return errors.New("could not find persistent tables in config")
@@ -41,19 +41,22 @@ func DumpPersistentTables(config Config) error {
 	}
 
 	args := append([]string{
-		"--defaults-file=mysql.cnf",
 		"--no-create-db",
 		"--skip-lock-tables",
-		"--result-file=persistent_tables_dump.sql",
+		"--result-file=" + run.Path(persistentTablesDumpFile),
 		config.Environments.Production.Database.Name,
 	}, persistentTables...)
 
-	cmd := exec.Command(config.BinaryPaths.MySQLDump, args...)
+	cmd, remove, err := mysqlCommand(config.BinaryPaths.MySQLDump, config.Environments.Production.Database, args...)
+	if err != nil {
+		return err
+	}
+	defer remove()
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		return err
 	}
@@ -61,32 +64,38 @@ func DumpPersistentTables(config Config) error {
 	return nil
 }
 
-// RestoreFromBackup restores the MySQL dump on production
-func RestoreFromBackup(config Config, backupName string) error {
-	err := createDatabase(config, backupName)
+// RestoreFromBackup restores the MySQL dump of the run on production
+func RestoreFromBackup(config Config, run *Run) error {
+	backupName := run.Name
+
+	// A missing dump would otherwise restore an empty database
+	file, err := os.Open(run.Path(stagingDumpFile))
 	if err != nil {
 		return err
 	}
+	defer file.Close()
 
-	err = grantPrivilagesForHost(config, backupName)
+	err = createDatabase(config, backupName)
 	if err != nil {
 		return err
 	}
 
-	cmd := exec.Command(config.BinaryPaths.MySQL,
-		"--defaults-file=mysql.cnf",
-		fmt.Sprintf("--host=%s", config.Environments.Production.Database.Host),
-		fmt.Sprintf("--port=%d", config.Environments.Production.Database.Port),
-		config.Environments.Production.Database.Name+"_"+backupName,
+	// The application user renames the URLs of the restored database before it goes live
+	err = GrantBackupDatabase(config, backupDatabaseName(config, backupName))
+	if err != nil {
+		return err
+	}
+
+	cmd, remove, err := mysqlCommand(config.BinaryPaths.MySQL, config.Environments.Production.Database,
+		backupDatabaseName(config, backupName),
 	)
+	if err != nil {
+		return err
+	}
+	defer remove()
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	stdin, _ := cmd.StdinPipe()
-	go func() {
-		defer stdin.Close()
-		file, _ := os.Open("staging_dump.sql")
-		io.Copy(stdin, file)
-	}()
+	cmd.Stdin = file
 
 	err = cmd.Run()
 	if err != nil {
@@ -96,24 +105,28 @@ func RestoreFromBackup(config Config, backupName string) error {
 	return nil
 }
 
-// RestorePersistentTables restores the persistent tables to the MySQL backup
-func RestorePersistentTables(config Config, backupName string) error {
-	cmd := exec.Command(config.BinaryPaths.MySQL,
-		"--defaults-file=mysql.cnf",
-		fmt.Sprintf("--host=%s", config.Environments.Production.Database.Host),
-		fmt.Sprintf("--port=%d", config.Environments.Production.Database.Port),
-		config.Environments.Production.Database.Name+"_"+backupName,
+// RestorePersistentTables restores the persistent tables of the run to the MySQL backup
+func RestorePersistentTables(config Config, run *Run) error {
+	backupName := run.Name
+
+	file, err := os.Open(run.Path(persistentTablesDumpFile))
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	cmd, remove, err := mysqlCommand(config.BinaryPaths.MySQL, config.Environments.Production.Database,
+		backupDatabaseName(config, backupName),
 	)
+	if err != nil {
+		return err
+	}
+	defer remove()
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
-	stdin, _ := cmd.StdinPipe()
-	go func() {
-		defer stdin.Close()
-		file, _ := os.Open("persistent_tables_dump.sql")
-		io.Copy(stdin, file)
-	}()
-
-	err := cmd.Run()
+	cmd.Stdin = file
+
+	err = cmd.Run()
 	if err != nil {
 		return err
 	}
@@ -121,43 +134,25 @@ func RestorePersistentTables(config Config, backupName string) error {
 	return nil
 }
 
+// backupDatabaseName returns the name of the production database a backup is restored to
+func backupDatabaseName(config Config, backupName string) string {
+	return config.Environments.Production.Database.Name + "_" + backupName
+}
+
 func createDatabase(config Config, backupName string) error {
-	cmd := exec.Command(config.BinaryPaths.MySQLAdmin,
-		"--defaults-file=mysql.cnf",
-		fmt.Sprintf("--host=%s", config.Environments.Production.Database.Host),
-		fmt.Sprintf("--port=%d", config.Environments.Production.Database.Port),
+	cmd, remove, err := mysqlCommand(config.BinaryPaths.MySQLAdmin, config.Environments.Production.Database,
 		"create",
-		config.Environments.Production.Database.Name+"_"+backupName,
+		backupDatabaseName(config, backupName),
 	)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	err := cmd.Run()
 	if err != nil {
 		return err
 	}
-
-	return nil
-}
-
-func grantPrivilagesForHost(config Config, backupName string) error {
-	args := []string{
-		"--defaults-file=mysql.cnf",
-		fmt.Sprintf("--host=%s", config.Environments.Production.Database.Host),
-		fmt.Sprintf("--port=%d", config.Environments.Production.Database.Port),
-		"--execute",
-		fmt.Sprintf("GRANT SELECT, INSERT ON `%s`.* TO '%s'@'%%';",
-			config.Environments.Production.Database.Name+"_"+backupName,
-			config.Environments.Production.Database.Username,
-		),
-	}
-	cmd := exec.Command(config.BinaryPaths.MySQL, args...)
+	defer remove()
 	cmd.Stdin = os.Stdin
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	err := cmd.Run()
+	err = cmd.Run()
 	if err != nil {
 		return err
 	}
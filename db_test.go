@@ -35,14 +35,17 @@ func TestDumpDatabase(t *testing.T) {
 		},
 	}
 
-	err := DumpDatabase(*config)
+	run := testRun(t, config, GenerateBackupString())
+	defer os.RemoveAll(config.Runs.Directory)
+
+	err := DumpDatabase(*config, run)
 	if err != nil {
 		t.Error("there was a problem dumping the database: " + err.Error())
 	}
 
-	err = os.Remove("staging_dump.sql")
+	_, err = os.Stat(run.Path(stagingDumpFile))
 	if err != nil {
-		t.Error("could not destroy the test sql dump file")
+		t.Error("expected the dump in the run directory: ", err.Error())
 	}
 }
 
@@ -81,14 +84,17 @@ func TestDumpPersistentTables(t *testing.T) {
 		},
 	}
 
-	err := DumpPersistentTables(*config)
+	run := testRun(t, config, GenerateBackupString())
+	defer os.RemoveAll(config.Runs.Directory)
+
+	err := DumpPersistentTables(*config, run)
 	if err != nil {
 		t.Error("there was a problem dumping the persistent tables: ", err.Error())
 	}
 
-	err = os.Remove("persistent_tables_dump.sql")
+	_, err = os.Stat(run.Path(persistentTablesDumpFile))
 	if err != nil {
-		t.Error("could not destroy the test sql dump file")
+		t.Error("expected the dump in the run directory: ", err.Error())
 	}
 }
 
@@ -128,9 +134,10 @@ func TestRestoreFromBackup(t *testing.T) {
 		},
 	}
 
-	backupName := GenerateBackupString()
+	run := testRun(t, config, GenerateBackupString(), stagingDumpFile)
+	defer os.RemoveAll(config.Runs.Directory)
 
-	err := RestoreFromBackup(*config, backupName)
+	err := RestoreFromBackup(*config, run)
 	if err != nil {
 		t.Error("there was an issue restoring the sql backup: ", err.Error())
 	}
@@ -172,14 +179,15 @@ func TestRestorePersistentTables(t *testing.T) {
 		},
 	}
 
-	backupName := GenerateBackupString()
+	run := testRun(t, config, GenerateBackupString(), stagingDumpFile, persistentTablesDumpFile)
+	defer os.RemoveAll(config.Runs.Directory)
 
-	err := RestoreFromBackup(*config, backupName)
+	err := RestoreFromBackup(*config, run)
 	if err != nil {
 		t.Error("there was an issue restoring the sql backup: ", err.Error())
 	}
 
-	err = RestorePersistentTables(*config, backupName)
+	err = RestorePersistentTables(*config, run)
 	if err != nil {
 		t.Error("there was an issue restoring the sql backup: ", err.Error())
 	}
@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// dotenvKeyPattern matches the key of an assignment, after an optional export prefix
+var dotenvKeyPattern = regexp.MustCompile(`^(\s*(?:export\s+)?)([A-Za-z_][A-Za-z0-9_.]*)(\s*=\s*)`)
+
+// Dotenv is a parsed .env file. Only the values that are set change when it is
+// written back; comments, blank lines, ordering, quoting and export prefixes are
+// kept as they were.
+type Dotenv struct {
+	entries []*dotenvEntry
+}
+
+// dotenvEntry is an assignment, or any other line kept as it is
+type dotenvEntry struct {
+	raw string
+
+	key   string
+	value string
+	// head is everything up to the value, tail the whitespace and comment after it
+	head  string
+	quote byte
+	tail  string
+	dirty bool
+}
+
+// ParseDotenv parses the contents of a .env file
+func ParseDotenv(contents string) *Dotenv {
+	lines := strings.Split(contents, "\n")
+	env := &Dotenv{}
+
+	for i := 0; i < len(lines); i++ {
+		entry := &dotenvEntry{raw: lines[i]}
+		env.entries = append(env.entries, entry)
+
+		match := dotenvKeyPattern.FindStringSubmatch(lines[i])
+		if match == nil {
+			continue
+		}
+		entry.key = match[2]
+		entry.head = match[1] + match[2] + match[3]
+		rest := lines[i][len(entry.head):]
+
+		if rest == "" || (rest[0] != '"' && rest[0] != '\'') {
+			entry.value, entry.tail = splitDotenvComment(rest)
+			continue
+		}
+
+		// A quoted value runs to its closing quote, which may be on a later line
+		entry.quote = rest[0]
+		end := closingQuote(rest, entry.quote)
+		for end < 0 && i+1 < len(lines) {
+			i++
+			entry.raw += "\n" + lines[i]
+			rest += "\n" + lines[i]
+			end = closingQuote(rest, entry.quote)
+		}
+		if end < 0 {
+			// Unterminated, so it is kept as it is and cannot be set
+			entry.key = ""
+			continue
+		}
+		entry.value = unquoteDotenv(rest[1:end], entry.quote)
+		entry.tail = rest[end+1:]
+	}
+
+	return env
+}
+
+// splitDotenvComment splits an unquoted value from the whitespace and comment after it
+func splitDotenvComment(rest string) (string, string) {
+	end := len(rest)
+	for i := 1; i < len(rest); i++ {
+		if rest[i] == '#' && (rest[i-1] == ' ' || rest[i-1] == '\t') {
+			end = i
+			break
+		}
+	}
+	value := strings.TrimRight(rest[:end], " \t\r")
+
+	return value, rest[len(value):]
+}
+
+// closingQuote returns the index of the quote closing the value at the start of s
+func closingQuote(s string, quote byte) int {
+	for i := 1; i < len(s); i++ {
+		if quote == '"' && s[i] == '\\' {
+			i++
+			continue
+		}
+		if s[i] == quote {
+			return i
+		}
+	}
+
+	return -1
+}
+
+func unquoteDotenv(value string, quote byte) string {
+	if quote != '"' {
+		return value
+	}
+
+	return strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\n`, "\n", `\r`, "\r", `\t`, "\t").Replace(value)
+}
+
+func quoteDotenv(value string, quote byte) string {
+	switch quote {
+	case '\'':
+		if !strings.ContainsRune(value, '\'') {
+			return "'" + value + "'"
+		}
+	case 0:
+		if !strings.ContainsAny(value, " \t\r\n#\"'\\") {
+			return value
+		}
+	}
+
+	return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`).Replace(value) + `"`
+}
+
+// Get returns the value of a key. When a key is assigned more than once the last
+// assignment wins, as it does when the file is loaded.
+func (d *Dotenv) Get(key string) (string, bool) {
+	for i := len(d.entries) - 1; i >= 0; i-- {
+		if d.entries[i].key == key {
+			return d.entries[i].value, true
+		}
+	}
+
+	return "", false
+}
+
+// Set changes the value of every assignment of a key, keeping how it is quoted,
+// and returns an error when the key is not assigned
+func (d *Dotenv) Set(key string, value string) error {
+	found := false
+	for _, entry := range d.entries {
+		if entry.key == key {
+			entry.value = value
+			entry.dirty = true
+			found = true
+		}
+	}
+	if !found {
+		return fmt.Errorf("%s is not set in the .env file", key)
+	}
+
+	return nil
+}
+
+// String returns the contents of the .env file
+func (d *Dotenv) String() string {
+	lines := make([]string, len(d.entries))
+	for i, entry := range d.entries {
+		if entry.dirty {
+			lines[i] = entry.head + quoteDotenv(entry.value, entry.quote) + entry.tail
+		} else {
+			lines[i] = entry.raw
+		}
+	}
+
+	return strings.Join(lines, "\n")
+}
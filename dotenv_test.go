@@ -0,0 +1,64 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestDotenv(t *testing.T) {
+	env := ParseDotenv(`# DB_NAME=commented
+#DB_NAME=commented
+TEST_DB_NAME=test_site
+export DB_NAME="site" # the live database
+DB_PASSWORD='pa=ss#word'
+DB_HOST=localhost # comment
+GREETING="multi
+line"
+`)
+
+	value, _ := env.Get("DB_PASSWORD")
+	if value != "pa=ss#word" {
+		t.Error("expected the quoted value to be kept whole, got ", value)
+	}
+	value, _ = env.Get("DB_HOST")
+	if value != "localhost" {
+		t.Error("expected the comment not to be part of the value, got ", value)
+	}
+	value, _ = env.Get("GREETING")
+	if value != "multi\nline" {
+		t.Errorf("expected the multiline value to be read, got %q", value)
+	}
+
+	err := env.Set("DB_NAME", "site_2018-05-1_12-0-0")
+	if err != nil {
+		t.Fatal("unable to set DB_NAME: ", err.Error())
+	}
+	env.Set("DB_HOST", "db #1")
+
+	expected := `# DB_NAME=commented
+#DB_NAME=commented
+TEST_DB_NAME=test_site
+export DB_NAME="site_2018-05-1_12-0-0" # the live database
+DB_PASSWORD='pa=ss#word'
+DB_HOST="db #1" # comment
+GREETING="multi
+line"
+`
+	if env.String() != expected {
+		t.Errorf("expected only the set values to change, got\n%s", env.String())
+	}
+
+	err = env.Set("DB_USER", "site")
+	if err == nil {
+		t.Error("expected setting a missing key to fail")
+	}
+}
+
+func TestRewriteEnvKeepsLineEndings(t *testing.T) {
+	switched, err := rewriteEnv("DB_NAME=site\r\nDB_HOST=localhost\r\n", "DB_NAME", "site_backup")
+	if err != nil {
+		t.Fatal("unable to switch the database: ", err.Error())
+	}
+	if switched != "DB_NAME=site_backup\r\nDB_HOST=localhost\r\n" {
+		t.Errorf("expected the line endings to be kept, got %q", switched)
+	}
+}
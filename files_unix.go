@@ -0,0 +1,51 @@
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"os"
+	"syscall"
+
+	"go.uber.org/zap"
+)
+
+// chownLike gives a file the owner and group of like, when they differ. Failing to
+// is only a warning, jet rarely runs as root.
+func chownLike(name string, like os.FileInfo) error {
+	owner, ok := like.Sys().(*syscall.Stat_t)
+	if !ok {
+		return nil
+	}
+	stat, err := os.Stat(name)
+	if err != nil {
+		return err
+	}
+	if current, ok := stat.Sys().(*syscall.Stat_t); ok && current.Uid == owner.Uid && current.Gid == owner.Gid {
+		return nil
+	}
+
+	// Only root may give a file away, and the copy is still usable without its owner
+	err = os.Chown(name, int(owner.Uid), int(owner.Gid))
+	if err != nil {
+		logger.Warn("Could not copy the owner of the file it replaces",
+			zap.String("file", name),
+			zap.Uint32("uid", owner.Uid),
+			zap.Uint32("gid", owner.Gid),
+			zap.Error(err),
+		)
+	}
+
+	return nil
+}
+
+// syncDirectory flushes the entries of a directory, such as a rename, to disk
+func syncDirectory(name string) error {
+	directory, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer directory.Close()
+
+	return directory.Sync()
+}
@@ -0,0 +1,18 @@
+//go:build windows
+// +build windows
+
+package main
+
+import (
+	"os"
+)
+
+// chownLike does nothing, Windows files have no Unix owner
+func chownLike(name string, like os.FileInfo) error {
+	return nil
+}
+
+// syncDirectory does nothing, Windows cannot sync a directory
+func syncDirectory(name string) error {
+	return nil
+}
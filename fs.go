@@ -3,13 +3,10 @@ package main
 import (
 	"encoding/json"
 	"errors"
-	"fmt"
-	"io/ioutil"
+	"io"
 	"log"
 	"os"
-	"os/exec"
 	"path"
-	"strings"
 )
 
 // GetWorkingDirectory returns the current working directory
@@ -23,6 +20,11 @@ func GetWorkingDirectory() string {
 	return wd
 }
 
+// jetDirectory returns the directory jet keeps its local state in
+func jetDirectory() string {
+	return path.Join(GetWorkingDirectory(), ".jet")
+}
+
 // LoadConfigFile loads the config file and returns the JSON
 func LoadConfigFile() (Config, error) {
 	var config Config
@@ -38,68 +40,54 @@ func LoadConfigFile() (Config, error) {
 	return config, nil
 }
 
-// TransferFile moves a file from one place to another using scp
-func TransferFile(localFile string, config Config) error {
-	var transferString string
-	if config.Environments.Production.Host == "" {
-		transferString = config.Environments.Production.RootDirectory
-	} else {
-		transferString = fmt.Sprintf("%s@%s:%s",
-			config.Environments.Production.User,
-			config.Environments.Production.Host,
-			config.Environments.Production.RootDirectory)
-	}
-	args := []string{
-		"-Cp",
-		localFile,
-		transferString,
+// sendToNode copies a file to a node over SFTP, or locally when it has no host,
+// creating the directories it goes in
+func sendToNode(environment Environment, localFile string, remoteFile string) error {
+	if environment.Host == "" {
+		err := os.MkdirAll(path.Dir(remoteFile), 0700)
+		if err != nil {
+			return err
+		}
+		return copyFile(localFile, remoteFile)
 	}
 
-	cmd := exec.Command(config.BinaryPaths.SCP, args...)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	return transferFile(environment, localFile, remoteFile)
+}
 
-	err := cmd.Run()
+// copyFile copies a file, keeping its permissions and modification time
+func copyFile(source string, destination string) error {
+	in, err := os.Open(source)
 	if err != nil {
 		return err
 	}
-
-	return nil
-}
-
-// UpdateEnvFile updates the .env file to point to the new database
-func UpdateEnvFile(backupName string) error {
-	if backupName == "" {
-		return errors.New("backupName string cannot be blank")
+	defer in.Close()
+	stat, err := in.Stat()
+	if err != nil {
+		return err
 	}
 
-	filePermissions, err := os.Stat(path.Join(GetWorkingDirectory(), ".env"))
+	temp := destination + ".tmp"
+	out, err := os.OpenFile(temp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, stat.Mode().Perm())
 	if err != nil {
-		return errors.New("cannot read file permissions for .env file")
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
 	}
-
-	envFile, err := ioutil.ReadFile(path.Join(GetWorkingDirectory(), ".env"))
 	if err != nil {
+		out.Close()
+		os.Remove(temp)
 		return err
 	}
-
-	lines := strings.Split(string(envFile), "\n")
-
-	for i := 0; i < len(lines); i++ {
-		if strings.Contains(lines[i], "DB_NAME") {
-			findString := strings.Split(lines[i], "=")[1]
-			updatedLine := strings.Replace(lines[i], findString, backupName, 1)
-			lines[i] = updatedLine
-		}
+	err = out.Close()
+	if err != nil {
+		return err
 	}
-
-	updatedFile := strings.Join(lines, "\n")
-
-	err = ioutil.WriteFile(path.Join(GetWorkingDirectory(), ".env"), []byte(updatedFile), filePermissions.Mode())
+	err = os.Chtimes(temp, stat.ModTime(), stat.ModTime())
 	if err != nil {
 		return err
 	}
 
-	return nil
+	return os.Rename(temp, destination)
 }
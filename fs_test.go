@@ -4,8 +4,8 @@ import (
 	"fmt"
 	"io/ioutil"
 	"os"
-	"os/user"
 	"path"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -37,43 +37,7 @@ func TestLoadConfigFile(t *testing.T) {
 	}
 }
 
-func TestTransferFile(t *testing.T) {
-	usr, err := user.Current()
-	if err != nil {
-		t.Error("unable to obtain the current user: " + err.Error())
-	}
-	config := &Config{
-		BinaryPaths: struct {
-			SSH        string `json:"ssh"`
-			MySQLAdmin string `json:"mysql_admin"`
-			MySQLDump  string `json:"mysql_dump"`
-			MySQL      string `json:"mysql"`
-			SCP        string `json:"scp"`
-			PHP        string `json:"php"`
-			WP         string `json:"wp"`
-		}{
-			SCP: "/usr/bin/scp",
-		},
-		Environments: struct {
-			Staging      Environment `json:"staging"`
-			Production   Environment `json:"production"`
-			LoadBalancer Environment `json:"load_balancer"`
-		}{
-			Production: Environment{
-				User:          "",
-				Host:          "",
-				RootDirectory: usr.HomeDir,
-			},
-		},
-	}
-
-	err = TransferFile("testdata/dummy.pdf", *config)
-	if err != nil {
-		t.Error("there was a problem trying to use scp: ", err.Error())
-	}
-}
-
-func TestUpdateEnvFile(t *testing.T) {
+func TestSwitchDatabase(t *testing.T) {
 	sampleEnv := []byte(`DB_NAME=test_database_00-00-0000
 DB_USER=test_user
 DB_PASSWORD=test_password
@@ -89,9 +53,11 @@ DB_PREFIX=testprefix_`)
 		t.Error("unable to write sample .env file: ", err.Error())
 	}
 
+	var config Config
+	config.Environments.Production.Database.Name = "test"
 	backupName := GenerateBackupString()
 
-	err = UpdateEnvFile(backupName)
+	err = SwitchDatabase(config, backupName)
 	if err != nil {
 		t.Error("unable to update env file: ", err.Error())
 	}
@@ -101,19 +67,19 @@ DB_PREFIX=testprefix_`)
 		t.Error("unable to open file sample .env file for comparison")
 	}
 
-	lines := strings.Split(string(envFile), "\n")
-
-	for i := 0; i < len(lines); i++ {
-		if strings.Contains(lines[i], "DB_NAME") {
-			compareString := strings.Split(lines[i], "=")[1]
-			if !strings.Contains(lines[i], compareString) {
-				t.Error("DB_NAME was not successfully replaced")
-			}
-		}
+	if !strings.HasPrefix(string(envFile), "DB_NAME=test_"+backupName+"\n") {
+		t.Error("DB_NAME was not successfully replaced")
 	}
 
 	err = os.Remove(".env")
 	if err != nil {
 		t.Error("could not destroy the test .env file")
 	}
+	previous, _ := filepath.Glob(".env.jet-previous-*")
+	if len(previous) != 1 {
+		t.Error("expected a copy of the previous .env file to be kept")
+	}
+	for _, file := range previous {
+		os.Remove(file)
+	}
 }
@@ -0,0 +1,288 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultPrivileges are what WordPress needs to serve a site
+var defaultPrivileges = []string{"SELECT", "INSERT", "UPDATE", "DELETE"}
+
+// ddlPrivileges are what WordPress and plugins need to upgrade their tables
+var ddlPrivileges = []string{"CREATE", "ALTER", "INDEX", "DROP", "CREATE TEMPORARY TABLES", "LOCK TABLES"}
+
+// schemaPrivileges are the privileges that may be granted on a backup database.
+// Anything that reaches beyond the database, such as FILE or GRANT OPTION, is refused.
+var schemaPrivileges = map[string]bool{
+	"SELECT": true, "INSERT": true, "UPDATE": true, "DELETE": true,
+	"CREATE": true, "ALTER": true, "INDEX": true, "DROP": true, "REFERENCES": true,
+	"CREATE TEMPORARY TABLES": true, "LOCK TABLES": true, "EXECUTE": true,
+	"CREATE VIEW": true, "SHOW VIEW": true, "CREATE ROUTINE": true, "ALTER ROUTINE": true,
+	"EVENT": true, "TRIGGER": true,
+}
+
+// GrantsConfig describes what the application user may do with a backup database
+type GrantsConfig struct {
+	// Privileges replace the default SELECT, INSERT, UPDATE and DELETE
+	Privileges []string `json:"privileges"`
+	// DDL adds the privileges needed to upgrade WordPress and plugins
+	DDL bool `json:"ddl"`
+	// Host is the host the application user connects from, any host by default
+	Host string `json:"host"`
+}
+
+// grantPrivileges returns the privileges and host of the grants of an environment
+func grantPrivileges(database Database) ([]string, string, error) {
+	privileges := database.Grants.Privileges
+	if len(privileges) == 0 {
+		privileges = defaultPrivileges
+	}
+	if database.Grants.DDL {
+		privileges = append(append([]string{}, privileges...), ddlPrivileges...)
+	}
+
+	seen := make(map[string]bool)
+	var granted []string
+	for _, privilege := range privileges {
+		privilege = strings.Join(strings.Fields(strings.ToUpper(privilege)), " ")
+		if !schemaPrivileges[privilege] {
+			return nil, "", fmt.Errorf("%q cannot be granted on a backup database", privilege)
+		}
+		if !seen[privilege] {
+			seen[privilege] = true
+			granted = append(granted, privilege)
+		}
+	}
+
+	host := database.Grants.Host
+	if host == "" {
+		host = "%"
+	}
+
+	return granted, host, nil
+}
+
+// quoteString quotes a MySQL string literal
+func quoteString(value string) string {
+	return "'" + strings.NewReplacer(`\`, `\\`, `'`, `''`).Replace(value) + "'"
+}
+
+// grantPattern escapes the wildcards of a database name, so that a grant on
+// site_backup does not also match siteXbackup
+func grantPattern(database string) string {
+	return strings.NewReplacer(`\`, `\\`, `_`, `\_`, `%`, `\%`).Replace(database)
+}
+
+// GrantBackupDatabase grants the application user the configured privileges on a
+// backup database and checks that it can use them
+func GrantBackupDatabase(config Config, database string) error {
+	production := config.Environments.Production.Database
+	privileges, host, err := grantPrivileges(production)
+	if err != nil {
+		return err
+	}
+
+	err = queryRows(config, production, fmt.Sprintf("GRANT %s ON %s.* TO %s@%s",
+		strings.Join(privileges, ", "),
+		quoteIdentifier(grantPattern(database)),
+		quoteString(production.Username),
+		quoteString(host),
+	), func(string) {})
+	if err != nil {
+		return err
+	}
+	logger.Info("Granted Privileges on Backup Database",
+		zap.String("database", database),
+		zap.String("user", production.Username),
+		zap.String("host", host),
+		zap.Strings("privileges", privileges),
+	)
+
+	return verifyPrivileges(config, database, privileges)
+}
+
+// verifyPrivileges connects to a database as the application user, the way the site
+// will, and checks that it holds every privilege
+func verifyPrivileges(config Config, database string, privileges []string) error {
+	production := config.Environments.Production.Database
+	query := fmt.Sprintf("SELECT PRIVILEGE_TYPE FROM information_schema.SCHEMA_PRIVILEGES WHERE %s LIKE TABLE_SCHEMA "+
+		"UNION SELECT PRIVILEGE_TYPE FROM information_schema.USER_PRIVILEGES",
+		quoteString(database),
+	)
+
+	// Not as the admin user, the point is to check what the site can do. A
+	// defaults_file would be included last and may well name the admin user.
+	app := production
+	app.DefaultsFile = ""
+	defaultsFile, remove, err := mysqlDefaultsFile(app)
+	if err != nil {
+		return err
+	}
+	defer remove()
+
+	cmd := exec.Command(config.BinaryPaths.MySQL,
+		defaultsFile,
+		"--batch",
+		"--skip-column-names",
+		"--execute", query,
+		database,
+	)
+	cmd.Stderr = os.Stderr
+	output, err := cmd.Output()
+	if err != nil {
+		return fmt.Errorf("could not connect to %s as %s: %v", database, production.Username, err)
+	}
+
+	held := make(map[string]bool)
+	for _, privilege := range strings.Split(string(output), "\n") {
+		held[strings.TrimSpace(privilege)] = true
+	}
+	var missing []string
+	for _, privilege := range privileges {
+		if !held[privilege] {
+			missing = append(missing, privilege)
+		}
+	}
+	if len(missing) > 0 {
+		return fmt.Errorf("%s is missing %s on %s", production.Username, strings.Join(missing, ", "), database)
+	}
+
+	return nil
+}
+
+// RevokeBackupDatabase revokes the grants of the application user on a backup
+// database, once nothing uses it anymore
+func RevokeBackupDatabase(config Config, database string) error {
+	production := config.Environments.Production.Database
+	_, host, err := grantPrivileges(production)
+	if err != nil {
+		return err
+	}
+
+	// REVOKE fails when there is nothing to revoke
+	granted := false
+	err = queryRows(config, production, fmt.Sprintf("SELECT 1 FROM mysql.db WHERE Db = %s AND User = %s AND Host = %s",
+		quoteString(grantPattern(database)),
+		quoteString(production.Username),
+		quoteString(host),
+	), func(string) { granted = true })
+	if err != nil || !granted {
+		return err
+	}
+
+	err = queryRows(config, production, fmt.Sprintf("REVOKE ALL PRIVILEGES ON %s.* FROM %s@%s",
+		quoteIdentifier(grantPattern(database)),
+		quoteString(production.Username),
+		quoteString(host),
+	), func(string) {})
+	if err != nil {
+		return err
+	}
+	logger.Info("Revoked Privileges on Backup Database",
+		zap.String("database", database),
+		zap.String("user", production.Username),
+		zap.String("host", host),
+	)
+
+	return nil
+}
+
+// RevokeUnusedBackupDatabase revokes the grants on the database of a backup, before
+// it is pruned, and refuses to while production uses it
+func RevokeUnusedBackupDatabase(config Config, backupName string) error {
+	if backupName == "" {
+		return errors.New("backupName string cannot be blank")
+	}
+	database := backupDatabaseName(config, backupName)
+
+	live, err := liveDatabases(config)
+	if err != nil {
+		return err
+	}
+	for _, name := range live {
+		if name == database {
+			return fmt.Errorf("%s is used by production", database)
+		}
+	}
+
+	return RevokeBackupDatabase(config, database)
+}
+
+// backupNameLayout parses the names GenerateBackupString makes
+const backupNameLayout = "2006-01-2_15-4-5"
+
+// expiredBackupDatabases returns the backup databases, named with prefix, that are
+// older than the keep most recent ones. Databases in use are neither returned nor
+// counted, and neither are databases whose names no backup would have.
+func expiredBackupDatabases(prefix string, databases []string, keep int, inUse []string) []string {
+	used := make(map[string]bool)
+	for _, database := range inUse {
+		used[database] = true
+	}
+
+	created := make(map[string]time.Time)
+	var backups []string
+	for _, database := range databases {
+		if used[database] || !strings.HasPrefix(database, prefix) {
+			continue
+		}
+		t, err := time.Parse(backupNameLayout, strings.TrimPrefix(database, prefix))
+		if err != nil {
+			continue
+		}
+		if _, ok := created[database]; !ok {
+			created[database] = t
+			backups = append(backups, database)
+		}
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return created[backups[i]].After(created[backups[j]])
+	})
+
+	if len(backups) <= keep {
+		return nil
+	}
+	return backups[keep:]
+}
+
+// revokeExpired revokes the grants on the backup databases that have left the
+// retention window, keeping them on the keep most recent ones of the runs config,
+// which production may still be rolled back to. A failure is only logged, since the
+// switch itself has succeeded.
+func revokeExpired(config Config, inUse ...string) {
+	production := config.Environments.Production.Database
+	_, host, err := grantPrivileges(production)
+	if err != nil {
+		logger.Warn("Could not revoke the privileges on old backup databases", zap.Error(err))
+		return
+	}
+
+	// The mysql client escapes backslashes, and the names are stored as patterns
+	unescape := strings.NewReplacer(`\\_`, "_", `\\%`, "%", `\\\\`, `\`)
+	var granted []string
+	err = queryRows(config, production, fmt.Sprintf("SELECT Db FROM mysql.db WHERE User = %s AND Host = %s",
+		quoteString(production.Username),
+		quoteString(host),
+	), func(row string) { granted = append(granted, unescape.Replace(row)) })
+	if err != nil {
+		logger.Warn("Could not revoke the privileges on old backup databases", zap.Error(err))
+		return
+	}
+
+	for _, database := range expiredBackupDatabases(production.Name+"_", granted, config.Runs.keep(), inUse) {
+		err := RevokeBackupDatabase(config, database)
+		if err != nil {
+			logger.Warn("Could not revoke the privileges on an old backup database",
+				zap.String("database", database),
+				zap.Error(err),
+			)
+		}
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestGrantPrivileges(t *testing.T) {
+	privileges, host, err := grantPrivileges(Database{})
+	if err != nil || !reflect.DeepEqual(privileges, defaultPrivileges) || host != "%" {
+		t.Errorf("expected the WordPress privileges for any host by default, got %v for %s", privileges, host)
+	}
+
+	privileges, host, err = grantPrivileges(Database{Grants: GrantsConfig{
+		Privileges: []string{"select", "insert", "create  temporary tables"},
+		DDL:        true,
+		Host:       "10.0.0.%",
+	}})
+	expected := []string{"SELECT", "INSERT", "CREATE TEMPORARY TABLES", "CREATE", "ALTER", "INDEX", "DROP", "LOCK TABLES"}
+	if err != nil || !reflect.DeepEqual(privileges, expected) || host != "10.0.0.%" {
+		t.Errorf("expected the configured privileges with DDL, got %v for %s", privileges, host)
+	}
+
+	for _, privilege := range []string{"ALL", "GRANT OPTION", "FILE", "SELECT; DROP DATABASE site"} {
+		_, _, err = grantPrivileges(Database{Grants: GrantsConfig{Privileges: []string{privilege}}})
+		if err == nil {
+			t.Errorf("expected %q to be refused", privilege)
+		}
+	}
+}
+
+func TestGrantPattern(t *testing.T) {
+	if grantPattern("site_2018-05-1_12-0-0") != `site\_2018-05-1\_12-0-0` {
+		t.Error("expected the wildcards in the database name to be escaped")
+	}
+	if quoteString(`it's \`) != `'it''s \\'` {
+		t.Error("expected quotes and backslashes to be escaped")
+	}
+}
+
+func TestExpiredBackupDatabases(t *testing.T) {
+	databases := []string{
+		"site_2018-05-1_9-0-0",
+		"site_2018-05-12_12-0-0",
+		"site_2018-05-2_12-0-0",
+		"site_2018-05-3_12-0-0",
+		"site_backup",
+		"other_2018-01-1_12-0-0",
+	}
+
+	// The live database is neither revoked nor counted, and the newest two are kept
+	expired := expiredBackupDatabases("site_", databases, 2, []string{"site_2018-05-12_12-0-0"})
+	if !reflect.DeepEqual(expired, []string{"site_2018-05-1_9-0-0"}) {
+		t.Errorf("expected only the oldest backup to be revoked, got %v", expired)
+	}
+	if expired := expiredBackupDatabases("site_", databases, 5, nil); len(expired) != 0 {
+		t.Errorf("expected every backup to be kept, got %v", expired)
+	}
+}
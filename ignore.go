@@ -0,0 +1,246 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"regexp"
+	"strings"
+)
+
+// IgnoreFileName is the name of the file in the uploads directory listing extra
+// gitignore-style patterns that should not be synced
+const IgnoreFileName = ".jetignore"
+
+// ignoreRule is a single gitignore-style pattern
+type ignoreRule struct {
+	pattern string
+	source  string
+	negate  bool
+	dirOnly bool
+	re      *regexp.Regexp
+}
+
+// String describes the rule and where it was defined
+func (r *ignoreRule) String() string {
+	return fmt.Sprintf("%s (%s)", r.pattern, r.source)
+}
+
+// IgnoreMatcher decides which files are left out of a sync. Rules follow gitignore
+// semantics: the last matching rule wins, a leading "!" re-includes a path, a
+// trailing "/" only matches directories and a pattern containing "/" is anchored to
+// the root of the synced directory.
+type IgnoreMatcher struct {
+	rules []*ignoreRule
+}
+
+// NewIgnoreMatcher builds a matcher from the exclude patterns in the config, the
+// ignore file if it exists, and finally the include patterns in the config so that
+// they can re-include files an earlier pattern matched
+func NewIgnoreMatcher(exclude []string, ignoreFile string, include []string) (*IgnoreMatcher, error) {
+	m := &IgnoreMatcher{}
+	builtIn := []string{IgnoreFileName, "*" + partialSuffix + "*"}
+	patterns := append(builtIn, exclude...)
+	for i, pattern := range patterns {
+		source := "config exclude"
+		if i < len(builtIn) {
+			source = "built-in"
+		}
+		err := m.add(pattern, source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if ignoreFile != "" {
+		err := m.loadFile(ignoreFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	for _, pattern := range include {
+		err := m.add("!"+strings.TrimPrefix(pattern, "!"), "config include")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// newPatternMatcher builds a matcher from a plain list of patterns without the
+// built-in exclusions, for deciding which files a processing step applies to
+func newPatternMatcher(patterns []string, source string) (*IgnoreMatcher, error) {
+	m := &IgnoreMatcher{}
+	for _, pattern := range patterns {
+		err := m.add(pattern, source)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return m, nil
+}
+
+// loadFile adds every pattern from an ignore file. A missing file is not an error.
+func (m *IgnoreMatcher) loadFile(filePath string) error {
+	file, err := os.Open(filePath)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	line := 0
+	for scanner.Scan() {
+		line++
+		err := m.add(scanner.Text(), fmt.Sprintf("%s:%d", IgnoreFileName, line))
+		if err != nil {
+			return err
+		}
+	}
+
+	return scanner.Err()
+}
+
+func (m *IgnoreMatcher) add(pattern string, source string) error {
+	pattern = strings.TrimRight(pattern, " \t\r")
+	if pattern == "" || strings.HasPrefix(pattern, "#") {
+		return nil
+	}
+
+	rule := &ignoreRule{pattern: pattern, source: source}
+	if strings.HasPrefix(pattern, "!") {
+		rule.negate = true
+		pattern = pattern[1:]
+	}
+	pattern = strings.TrimPrefix(pattern, `\`)
+	if strings.HasSuffix(pattern, "/") {
+		rule.dirOnly = true
+		pattern = strings.TrimSuffix(pattern, "/")
+	}
+
+	anchored := strings.Contains(pattern, "/")
+	pattern = strings.TrimPrefix(pattern, "/")
+
+	expr := globToRegexp(pattern)
+	if anchored {
+		expr = "^" + expr + "$"
+	} else {
+		expr = "^(?:.*/)?" + expr + "$"
+	}
+	re, err := regexp.Compile(expr)
+	if err != nil {
+		return fmt.Errorf("invalid pattern %s: %v", rule, err)
+	}
+	rule.re = re
+
+	m.rules = append(m.rules, rule)
+
+	return nil
+}
+
+// Excluded reports whether the slash separated path relative to the synced directory
+// is excluded, along with the rule that excluded it. A file inside an excluded
+// directory is always excluded, just like git.
+func (m *IgnoreMatcher) Excluded(name string) (bool, *ignoreRule) {
+	if m == nil {
+		return false, nil
+	}
+
+	parts := strings.Split(strings.Trim(name, "/"), "/")
+	for i := 1; i < len(parts); i++ {
+		if rule := m.match(strings.Join(parts[:i], "/"), true); rule != nil && !rule.negate {
+			return true, rule
+		}
+	}
+
+	rule := m.match(strings.Join(parts, "/"), false)
+	if rule != nil && !rule.negate {
+		return true, rule
+	}
+
+	return false, nil
+}
+
+func (m *IgnoreMatcher) match(name string, isDir bool) *ignoreRule {
+	var found *ignoreRule
+	for _, rule := range m.rules {
+		if rule.dirOnly && !isDir {
+			continue
+		}
+		if rule.re.MatchString(name) {
+			found = rule
+		}
+	}
+
+	return found
+}
+
+// excludeFiles marks every file the matcher excludes so that later stages skip it
+func excludeFiles(in chan *FileStat, matcher *IgnoreMatcher) chan *FileStat {
+	if matcher == nil {
+		return in
+	}
+	out := make(chan *FileStat, cap(in))
+
+	go func() {
+		defer close(out)
+
+		for file := range in {
+			if file.Err == nil {
+				if excluded, rule := matcher.Excluded(file.Name); excluded {
+					file.ExcludedBy = rule.String()
+				}
+			}
+			out <- file
+		}
+	}()
+
+	return out
+}
+
+func globToRegexp(pattern string) string {
+	var expr strings.Builder
+	for i := 0; i < len(pattern); i++ {
+		c := pattern[i]
+		switch {
+		case strings.HasPrefix(pattern[i:], "**/"):
+			expr.WriteString("(?:.*/)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "/**") && i+3 == len(pattern):
+			expr.WriteString("(?:/.*)?")
+			i += 2
+		case strings.HasPrefix(pattern[i:], "**"):
+			expr.WriteString(".*")
+			i++
+		case c == '*':
+			expr.WriteString("[^/]*")
+		case c == '?':
+			expr.WriteString("[^/]")
+		case c == '[':
+			end := strings.IndexByte(pattern[i:], ']')
+			if end < 0 {
+				expr.WriteString(`\[`)
+				continue
+			}
+			class := pattern[i+1 : i+end]
+			if strings.HasPrefix(class, "!") {
+				class = "^" + class[1:]
+			}
+			expr.WriteString("[" + class + "]")
+			i += end
+		case c == '\\' && i+1 < len(pattern):
+			i++
+			expr.WriteString(regexp.QuoteMeta(string(pattern[i])))
+		default:
+			expr.WriteString(regexp.QuoteMeta(string(c)))
+		}
+	}
+
+	return expr.String()
+}
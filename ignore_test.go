@@ -0,0 +1,66 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestIgnoreMatcher(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetignore")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	ignoreFile := path.Join(dir, IgnoreFileName)
+	err = ioutil.WriteFile(ignoreFile, []byte("# plugin junk\ncache/\n/backups/*.zip\n"), 0644)
+	if err != nil {
+		t.Fatal("unable to write the ignore file: ", err.Error())
+	}
+
+	matcher, err := NewIgnoreMatcher(
+		[]string{".DS_Store", "wc-logs/**", "*.log"},
+		ignoreFile,
+		[]string{"keep.log"},
+	)
+	if err != nil {
+		t.Fatal("unable to build the matcher: ", err.Error())
+	}
+
+	cases := map[string]bool{
+		".jetignore":                   true,
+		".DS_Store":                    true,
+		"2018/05/.DS_Store":            true,
+		"2018/05/photo.jpg":            false,
+		"cache/page.html":              true,
+		"2018/cache/page.html":         true,
+		"cache.jpg":                    false,
+		"backups/site.zip":             true,
+		"2018/backups/site.zip":        false,
+		"wc-logs/fatal-errors.log":     true,
+		"wc-logs/nested/debug.txt":     true,
+		"debug.log":                    true,
+		"keep.log":                     false,
+		"2018/05/photo.jpg.log.backup": false,
+	}
+	for name, expected := range cases {
+		excluded, rule := matcher.Excluded(name)
+		if excluded != expected {
+			t.Errorf("expected %s excluded=%v, got %v (rule %v)", name, expected, excluded, rule)
+		}
+	}
+
+	_, rule := matcher.Excluded("cache/page.html")
+	if rule == nil || rule.String() != "cache/ (.jetignore:2)" {
+		t.Errorf("expected the exclusion to be explained by its source, got %v", rule)
+	}
+}
+
+func TestIgnoreMatcherInvalidPattern(t *testing.T) {
+	_, err := NewIgnoreMatcher([]string{"[z-a]"}, "", nil)
+	if err == nil {
+		t.Error("an invalid pattern should return an error")
+	}
+}
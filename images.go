@@ -0,0 +1,484 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"fmt"
+	"image"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// defaultImageQuality is the JPEG quality ceiling when the config does not set one
+const defaultImageQuality = 82
+
+// standardLuminanceTable is the JPEG Annex K luminance quantization table that
+// encoders scale to reach a given quality
+var standardLuminanceTable = [64]int{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+// ImagesConfig describes how images are processed before they are uploaded
+type ImagesConfig struct {
+	// Patterns lists gitignore-style patterns of the images to process
+	Patterns []string `json:"patterns"`
+	// Quality is the highest JPEG quality processed images are encoded at
+	Quality int `json:"quality"`
+	// WebP also uploads a WebP copy of every processed image next to it
+	WebP bool `json:"webp"`
+	// WebPQuality is the quality WebP copies are encoded at
+	WebPQuality int `json:"webp_quality"`
+	// CWebP is the path to the cwebp binary used to encode WebP copies
+	CWebP string `json:"cwebp"`
+}
+
+// ImageProcessor strips metadata from images, re-encodes them and generates WebP
+// copies. The results are cached so that unchanged images are not processed again,
+// and the original files are never modified.
+type ImageProcessor struct {
+	matcher     *IgnoreMatcher
+	quality     int
+	webp        bool
+	webpQuality int
+	cwebp       string
+	cache       string
+}
+
+// NewImageProcessor returns nil when no image patterns are configured
+func NewImageProcessor(config ImagesConfig, cacheDirectory string) (*ImageProcessor, error) {
+	if len(config.Patterns) == 0 {
+		return nil, nil
+	}
+
+	matcher, err := newPatternMatcher(config.Patterns, "image patterns")
+	if err != nil {
+		return nil, err
+	}
+
+	p := &ImageProcessor{
+		matcher:     matcher,
+		quality:     config.Quality,
+		webp:        config.WebP,
+		webpQuality: config.WebPQuality,
+		cwebp:       config.CWebP,
+		cache:       cacheDirectory,
+	}
+	if p.quality < 1 || p.quality > 100 {
+		p.quality = defaultImageQuality
+	}
+	if p.webpQuality < 1 || p.webpQuality > 100 {
+		p.webpQuality = p.quality
+	}
+	if p.webp && p.cwebp == "" {
+		p.cwebp = "/usr/bin/cwebp"
+	}
+
+	return p, os.MkdirAll(cacheDirectory, 0755)
+}
+
+// processImages replaces every matching image with its processed copy and adds its
+// WebP sibling. An image that cannot be processed fails, rather than being uploaded
+// with its metadata intact.
+func (p *ImageProcessor) processImages(in chan *FileStat) chan *FileStat {
+	if p == nil {
+		return in
+	}
+	out := make(chan *FileStat, cap(in))
+
+	go func() {
+		defer close(out)
+
+		var wg sync.WaitGroup
+		for i := 0; i < runtime.NumCPU(); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for file := range in {
+					if file.Err != nil || file.ExcludedBy != "" {
+						out <- file
+						continue
+					}
+					if matched, _ := p.matcher.Excluded(file.Name); !matched {
+						out <- file
+						continue
+					}
+
+					processed, err := p.process(file)
+					if err != nil {
+						out <- &FileStat{Err: fmt.Errorf("processing image %s: %v", file.Name, err)}
+						continue
+					}
+					for _, f := range processed {
+						out <- f
+					}
+				}
+			}()
+		}
+		wg.Wait()
+	}()
+
+	return out
+}
+
+// process returns the processed image and its WebP sibling, from the cache when the
+// original has not changed since it was last processed. A dry run only reads the
+// cache, and reports an image that is not in it as it is.
+func (p *ImageProcessor) process(file *FileStat) ([]*FileStat, error) {
+	key := sha256.Sum256([]byte(fmt.Sprintf("%s|%d|%d|%d|%d", file.Path, file.Size,
+		file.ModTime.UnixNano(), p.quality, p.webpQuality)))
+	base := filepath.Join(p.cache, hex.EncodeToString(key[:]))
+
+	processedPath := base + filepath.Ext(file.Name)
+	if _, err := os.Stat(processedPath); os.IsNotExist(err) {
+		if dryRun {
+			return p.planWebP([]*FileStat{file}, file), nil
+		}
+		err = p.reencode(file.Path, processedPath)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	processed, err := cachedFileStat(file, file.Name, processedPath)
+	if err != nil {
+		return nil, err
+	}
+	if processed == nil {
+		// Not an image we know how to process, so it is uploaded as it is
+		return []*FileStat{file}, nil
+	}
+	files := []*FileStat{processed}
+
+	if p.webp {
+		webpPath := base + ".webp"
+		if _, err := os.Stat(webpPath); os.IsNotExist(err) {
+			if dryRun {
+				return p.planWebP(files, file), nil
+			}
+			err = p.encodeWebP(processedPath, webpPath)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		sibling, err := cachedFileStat(file, file.Name+".webp", webpPath)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, sibling)
+	}
+
+	return files, nil
+}
+
+// planWebP adds a stand in for the WebP sibling of an image that a dry run has not
+// processed, so that the sibling is planned for upload
+func (p *ImageProcessor) planWebP(files []*FileStat, original *FileStat) []*FileStat {
+	if !p.webp {
+		return files
+	}
+
+	return append(files, &FileStat{Name: original.Name + ".webp", Path: original.Path, Size: original.Size, ModTime: original.ModTime})
+}
+
+func cachedFileStat(original *FileStat, name string, cachePath string) (*FileStat, error) {
+	stat, err := os.Stat(cachePath)
+	if err != nil {
+		return nil, err
+	}
+	if stat.Size() == 0 {
+		return nil, nil
+	}
+
+	return &FileStat{
+		Name:    name,
+		Path:    cachePath,
+		Size:    stat.Size(),
+		ModTime: original.ModTime,
+	}, nil
+}
+
+// reencode writes a metadata free copy of a JPEG or PNG. Anything else is recorded
+// in the cache as an empty file so that it is only sniffed once.
+func (p *ImageProcessor) reencode(source string, destination string) error {
+	data, err := ioutil.ReadFile(source)
+	if err != nil {
+		return err
+	}
+
+	var encoded bytes.Buffer
+	switch http.DetectContentType(data) {
+	case "image/jpeg":
+		img, err := jpeg.Decode(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		// The orientation is stored in the EXIF data that is about to be dropped
+		img = orient(img, exifOrientation(data))
+
+		quality := p.quality
+		if original := jpegQuality(data); original > 0 && original < quality {
+			quality = original
+		}
+		err = jpeg.Encode(&encoded, img, &jpeg.Options{Quality: quality})
+		if err != nil {
+			return err
+		}
+	case "image/png":
+		img, err := png.Decode(bytes.NewReader(data))
+		if err != nil {
+			return err
+		}
+		encoder := png.Encoder{CompressionLevel: png.BestCompression}
+		err = encoder.Encode(&encoded, img)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeFileAtomic(destination, encoded.Bytes())
+}
+
+func (p *ImageProcessor) encodeWebP(source string, destination string) error {
+	temp := destination + ".tmp"
+	cmd := exec.Command(p.cwebp,
+		"-quiet",
+		"-metadata", "none",
+		"-q", strconv.Itoa(p.webpQuality),
+		source,
+		"-o", temp,
+	)
+	var output bytes.Buffer
+	cmd.Stdout = &output
+	cmd.Stderr = &output
+
+	err := cmd.Run()
+	if err != nil {
+		os.Remove(temp)
+		return fmt.Errorf("cwebp: %v: %s", err, strings.TrimSpace(output.String()))
+	}
+
+	logger.Debug("Generated WebP image", zap.String("file", destination), zap.String("output", strings.TrimSpace(output.String())))
+
+	return os.Rename(temp, destination)
+}
+
+func writeFileAtomic(destination string, data []byte) error {
+	temp := destination + ".tmp"
+	err := ioutil.WriteFile(temp, data, 0644)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temp, destination)
+}
+
+// jpegSegments calls fn with the marker and payload of every segment before the
+// image data, stopping early when fn returns false
+func jpegSegments(data []byte, fn func(marker byte, payload []byte) bool) {
+	if len(data) < 4 || data[0] != 0xFF || data[1] != 0xD8 {
+		return
+	}
+
+	for i := 2; i+4 <= len(data); {
+		if data[i] != 0xFF {
+			return
+		}
+		marker := data[i+1]
+		if marker == 0xDA || marker == 0xD9 {
+			return
+		}
+		length := int(binary.BigEndian.Uint16(data[i+2:]))
+		if length < 2 || i+2+length > len(data) {
+			return
+		}
+		if !fn(marker, data[i+4:i+2+length]) {
+			return
+		}
+		i += 2 + length
+	}
+}
+
+// jpegQuality estimates the quality a JPEG was encoded at from its luminance
+// quantization table, returning 0 when it cannot tell
+func jpegQuality(data []byte) int {
+	quality := 0
+	jpegSegments(data, func(marker byte, payload []byte) bool {
+		if marker != 0xDB {
+			return true
+		}
+
+		for len(payload) > 0 {
+			precision, id := payload[0]>>4, payload[0]&0x0F
+			size := 64
+			if precision == 1 {
+				size = 128
+			}
+			if len(payload) < 1+size {
+				return false
+			}
+
+			if id == 0 {
+				sum, standard := 0, 0
+				for i := 0; i < 64; i++ {
+					if precision == 1 {
+						sum += int(binary.BigEndian.Uint16(payload[1+i*2:]))
+					} else {
+						sum += int(payload[1+i])
+					}
+					standard += standardLuminanceTable[i]
+				}
+
+				// Encoders scale the standard table by 5000/q below 50 and 200-2q above
+				scale := float64(sum) * 100 / float64(standard)
+				if scale <= 100 {
+					quality = int((200-scale)/2 + 0.5)
+				} else {
+					quality = int(5000/scale + 0.5)
+				}
+				if quality < 1 {
+					quality = 1
+				}
+				if quality > 100 {
+					quality = 100
+				}
+				return false
+			}
+			payload = payload[1+size:]
+		}
+
+		return true
+	})
+
+	return quality
+}
+
+// exifOrientation returns the EXIF orientation of a JPEG, 1 meaning upright
+func exifOrientation(data []byte) int {
+	orientation := 1
+	jpegSegments(data, func(marker byte, payload []byte) bool {
+		if marker != 0xE1 || !bytes.HasPrefix(payload, []byte("Exif\x00\x00")) {
+			return true
+		}
+		tiff := payload[6:]
+		if len(tiff) < 8 {
+			return false
+		}
+
+		var order binary.ByteOrder
+		switch string(tiff[:2]) {
+		case "II":
+			order = binary.LittleEndian
+		case "MM":
+			order = binary.BigEndian
+		default:
+			return false
+		}
+
+		offset := int(order.Uint32(tiff[4:]))
+		if offset+2 > len(tiff) {
+			return false
+		}
+		entries := int(order.Uint16(tiff[offset:]))
+		for i := 0; i < entries; i++ {
+			entry := offset + 2 + i*12
+			if entry+12 > len(tiff) {
+				return false
+			}
+			if order.Uint16(tiff[entry:]) == 0x0112 {
+				value := int(order.Uint16(tiff[entry+8:]))
+				if value >= 1 && value <= 8 {
+					orientation = value
+				}
+				return false
+			}
+		}
+
+		return false
+	})
+
+	return orientation
+}
+
+// orient applies an EXIF orientation so that the image is stored upright
+func orient(img image.Image, orientation int) image.Image {
+	if orientation < 2 || orientation > 8 {
+		return img
+	}
+
+	// Pixels are copied between RGBA buffers rather than through At and Set, which
+	// allocate a color for every pixel of what may be a very large photo
+	src, ok := img.(*image.RGBA)
+	if !ok {
+		src = image.NewRGBA(image.Rect(0, 0, img.Bounds().Dx(), img.Bounds().Dy()))
+		draw.Draw(src, src.Bounds(), img, img.Bounds().Min, draw.Src)
+	}
+	bounds := src.Bounds()
+	w, h := bounds.Dx(), bounds.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+
+	out := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		row := out.Pix[y*out.Stride : y*out.Stride+dw*4]
+		if orientation <= 4 {
+			// Orientations 2 to 4 keep whole rows, mirrored, flipped top to bottom or both
+			sy := y
+			if orientation != 2 {
+				sy = h - 1 - y
+			}
+			start := src.PixOffset(bounds.Min.X, bounds.Min.Y+sy)
+			copy(row, src.Pix[start:start+w*4])
+			if orientation != 4 {
+				for l, r := 0, (dw-1)*4; l < r; l, r = l+4, r-4 {
+					for i := 0; i < 4; i++ {
+						row[l+i], row[r+i] = row[r+i], row[l+i]
+					}
+				}
+			}
+			continue
+		}
+
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			i := src.PixOffset(bounds.Min.X+sx, bounds.Min.Y+sy)
+			copy(row[x*4:x*4+4], src.Pix[i:i+4])
+		}
+	}
+
+	return out
+}
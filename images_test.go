@@ -0,0 +1,200 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// jpegWithOrientation encodes a test image and inserts an EXIF segment holding the
+// orientation, along with a GPS tag pointer that must not survive processing
+func jpegWithOrientation(t *testing.T, width int, height int, orientation uint16) []byte {
+	img := image.NewRGBA(image.Rect(0, 0, width, height))
+	img.Set(0, 0, color.RGBA{255, 0, 0, 255})
+
+	var encoded bytes.Buffer
+	err := jpeg.Encode(&encoded, img, &jpeg.Options{Quality: 95})
+	if err != nil {
+		t.Fatal("unable to encode the test image: ", err.Error())
+	}
+
+	tiff := []byte("II*\x00\x08\x00\x00\x00")
+	ifd := make([]byte, 2+2*12+4)
+	binary.LittleEndian.PutUint16(ifd, 2)
+	binary.LittleEndian.PutUint16(ifd[2:], 0x0112)
+	binary.LittleEndian.PutUint16(ifd[4:], 3)
+	binary.LittleEndian.PutUint32(ifd[6:], 1)
+	binary.LittleEndian.PutUint16(ifd[10:], orientation)
+	binary.LittleEndian.PutUint16(ifd[14:], 0x8825)
+	binary.LittleEndian.PutUint16(ifd[16:], 4)
+	binary.LittleEndian.PutUint32(ifd[18:], 1)
+	payload := append([]byte("Exif\x00\x00"), append(tiff, ifd...)...)
+
+	segment := []byte{0xFF, 0xE1, 0, 0}
+	binary.BigEndian.PutUint16(segment[2:], uint16(len(payload)+2))
+	segment = append(segment, payload...)
+
+	data := encoded.Bytes()
+	return append(append([]byte{0xFF, 0xD8}, segment...), data[2:]...)
+}
+
+func TestExifOrientation(t *testing.T) {
+	data := jpegWithOrientation(t, 4, 2, 6)
+	if orientation := exifOrientation(data); orientation != 6 {
+		t.Errorf("expected orientation 6, got %d", orientation)
+	}
+
+	rotated := orient(image.NewRGBA(image.Rect(0, 0, 4, 2)), 6)
+	if rotated.Bounds().Dx() != 2 || rotated.Bounds().Dy() != 4 {
+		t.Errorf("expected a rotated image to swap its dimensions, got %v", rotated.Bounds())
+	}
+}
+
+func TestJpegQuality(t *testing.T) {
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for _, quality := range []int{30, 60, 90} {
+		var encoded bytes.Buffer
+		jpeg.Encode(&encoded, img, &jpeg.Options{Quality: quality})
+
+		estimate := jpegQuality(encoded.Bytes())
+		if estimate < quality-3 || estimate > quality+3 {
+			t.Errorf("expected a quality estimate close to %d, got %d", quality, estimate)
+		}
+	}
+}
+
+func TestImageProcessor(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetimages")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "camera.jpg")
+	err = ioutil.WriteFile(source, jpegWithOrientation(t, 40, 20, 6), 0644)
+	if err != nil {
+		t.Fatal("unable to write the test image: ", err.Error())
+	}
+	stat, _ := os.Stat(source)
+
+	processor, err := NewImageProcessor(ImagesConfig{Patterns: []string{"*.jpg"}, Quality: 80}, filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal("unable to create the image processor: ", err.Error())
+	}
+
+	in := fileStats(
+		&FileStat{Name: "2018/camera.jpg", Path: source, Size: stat.Size(), ModTime: stat.ModTime()},
+		&FileStat{Name: "document.pdf", Path: "testdata/dummy.pdf", Size: 13264, ModTime: time.Now()},
+	)
+	results := map[string]*FileStat{}
+	for file := range processor.processImages(in) {
+		if file.Err != nil {
+			t.Fatal("unable to process the images: ", file.Err.Error())
+		}
+		results[file.Name] = file
+	}
+
+	if results["document.pdf"].Path != "testdata/dummy.pdf" {
+		t.Error("files that do not match the image patterns should be passed through")
+	}
+
+	processed := results["2018/camera.jpg"]
+	if processed == nil || processed.Path == source {
+		t.Fatal("expected the image to be replaced by its processed copy")
+	}
+	if !processed.ModTime.Equal(stat.ModTime()) {
+		t.Error("the processed copy should keep the modification time of the original")
+	}
+
+	data, _ := ioutil.ReadFile(processed.Path)
+	if bytes.Contains(data, []byte("Exif")) {
+		t.Error("the EXIF data should be stripped from the processed copy")
+	}
+	config, err := jpeg.DecodeConfig(bytes.NewReader(data))
+	if err != nil || config.Width != 20 || config.Height != 40 {
+		t.Errorf("expected the processed copy to be rotated upright, got %+v", config)
+	}
+
+	original, _ := ioutil.ReadFile(source)
+	if !bytes.Contains(original, []byte("Exif")) {
+		t.Error("the original image should not be modified")
+	}
+
+	// A cached copy is reused even if the original can no longer be read
+	os.Chmod(source, 0)
+	defer os.Chmod(source, 0644)
+	again, err := processor.process(&FileStat{Name: "2018/camera.jpg", Path: source, Size: stat.Size(), ModTime: stat.ModTime()})
+	if err != nil || again[0].Path != processed.Path {
+		t.Errorf("expected the cached copy to be reused, got %v", err)
+	}
+}
+
+func TestOrient(t *testing.T) {
+	img := image.NewNRGBA(image.Rect(3, 5, 8, 8))
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			img.Set(x, y, color.NRGBA{R: uint8(x), G: uint8(y), B: 9, A: 255})
+		}
+	}
+
+	// Where the top left, top right and bottom left pixels of the upright image come from
+	for orientation, corners := range map[int][3]image.Point{
+		2: {{7, 5}, {3, 5}, {7, 7}},
+		3: {{7, 7}, {3, 7}, {7, 5}},
+		4: {{3, 7}, {7, 7}, {3, 5}},
+		5: {{3, 5}, {3, 7}, {7, 5}},
+		6: {{3, 7}, {3, 5}, {7, 7}},
+		7: {{7, 7}, {7, 5}, {3, 7}},
+		8: {{7, 5}, {7, 7}, {3, 5}},
+	} {
+		out := orient(img, orientation)
+		bounds := out.Bounds()
+		for i, at := range []image.Point{bounds.Min, {bounds.Max.X - 1, bounds.Min.Y}, {bounds.Min.X, bounds.Max.Y - 1}} {
+			r, g, _, _ := out.At(at.X, at.Y).RGBA()
+			if int(r>>8) != corners[i].X || int(g>>8) != corners[i].Y {
+				t.Errorf("orientation %d: expected pixel %v to come from %v, got (%d,%d)", orientation, at, corners[i], r>>8, g>>8)
+			}
+		}
+	}
+}
+
+func TestImageProcessorDryRun(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetimages")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	source := filepath.Join(dir, "camera.jpg")
+	err = ioutil.WriteFile(source, jpegWithOrientation(t, 40, 20, 6), 0644)
+	if err != nil {
+		t.Fatal("unable to write the test image: ", err.Error())
+	}
+	stat, _ := os.Stat(source)
+
+	processor, err := NewImageProcessor(ImagesConfig{Patterns: []string{"*.jpg"}, WebP: true, CWebP: "/nonexistent/cwebp"}, filepath.Join(dir, "cache"))
+	if err != nil {
+		t.Fatal("unable to create the image processor: ", err.Error())
+	}
+
+	dryRun = true
+	defer func() { dryRun = false }()
+	files, err := processor.process(&FileStat{Name: "camera.jpg", Path: source, Size: stat.Size(), ModTime: stat.ModTime()})
+	if err != nil {
+		t.Fatal("a dry run should not process images: ", err.Error())
+	}
+	if len(files) != 2 || files[0].Path != source || files[1].Name != "camera.jpg.webp" {
+		t.Errorf("expected the original and a planned WebP sibling, got %+v", files)
+	}
+	cached, _ := ioutil.ReadDir(filepath.Join(dir, "cache"))
+	if len(cached) != 0 {
+		t.Errorf("a dry run should not write to the cache, found %d files", len(cached))
+	}
+}
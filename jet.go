@@ -30,10 +30,15 @@ import (
 var (
 	backupName         string
 	currentEnvironment string
+	dryRun             bool
+
+	// logger is shared by every step so that output stays structured
+	logger = zap.NewNop()
 )
 
 func main() {
 	flag.StringVar(&currentEnvironment, "environment", "", "contains the environment in which the tool is currently running")
+	flag.BoolVar(&dryRun, "dry-run", false, "list what would be synced and excluded without uploading anything")
 	flag.Parse()
 
 	if currentEnvironment == "" {
@@ -43,8 +48,9 @@ func main() {
 	start := time.Now()
 
 	// Initialize logger
-	logger, _ := zap.NewProduction()
+	logger, _ = zap.NewProduction(zap.Hooks(releaseLocksOnFatal), zap.WrapCore(redactCore))
 	defer logger.Sync()
+	defer closeSSHClients()
 
 	logger.Info("Production Deployment Started")
 
@@ -54,6 +60,67 @@ func main() {
 		logger.Fatal(err.Error())
 	}
 
+	/**
+	 * Commands
+	 */
+	if flag.Arg(0) == "status" {
+		err = ReportStatus(config, currentEnvironment)
+		if err != nil {
+			logger.Fatal("There was an error reading the deployment status",
+				zap.Error(err),
+			)
+		}
+		return
+	}
+	if flag.Arg(0) == "swap" {
+		lock, err := AcquireDeployLock(config, currentEnvironment, "swap "+flag.Arg(1))
+		if err != nil {
+			logger.Fatal("Could not acquire the deployment lock", zap.Error(err))
+		}
+		defer lock.Release()
+
+		// Swapping the tables of a backup back in rolls a rename-tables deploy back
+		err = SwapDatabase(config, flag.Arg(1))
+		if err == nil {
+			err = FlushWebNodes(config)
+		}
+		if err != nil {
+			logger.Fatal("There was an error swapping the database",
+				zap.Error(err),
+			)
+		}
+		return
+	}
+	if flag.Arg(0) == "revoke" {
+		lock, err := AcquireDeployLock(config, currentEnvironment, "revoke "+flag.Arg(1))
+		if err != nil {
+			logger.Fatal("Could not acquire the deployment lock", zap.Error(err))
+		}
+		defer lock.Release()
+
+		err = RevokeUnusedBackupDatabase(config, flag.Arg(1))
+		if err != nil {
+			logger.Fatal("There was an error revoking the privileges on the backup database",
+				zap.Error(err),
+			)
+		}
+		return
+	}
+	if flag.Arg(0) == "backup" {
+		runBackupCommand(config, flag.Args()[1:])
+		return
+	}
+	if flag.Arg(0) == "uploads" {
+		lock, err := AcquireDeployLock(config, currentEnvironment, "uploads "+flag.Arg(1))
+		if err != nil {
+			logger.Fatal("Could not acquire the deployment lock", zap.Error(err))
+		}
+		defer lock.Release()
+
+		runUploadsCommand(config, flag.Args()[1:])
+		return
+	}
+
 	/**
 	 * Staging Server
 	 */
@@ -64,64 +131,114 @@ func main() {
 			zap.String("name", backupName),
 		)
 
+		run := startRun(config)
+		defer run.Close()
+
+		lock, err := AcquireDeployLock(config, currentEnvironment, backupName)
+		if err != nil {
+			logger.Fatal("Could not acquire the deployment lock", zap.Error(err))
+		}
+		defer lock.Release()
+
 		// Push wp-uploads to S3
-		err = SyncUploads(config)
+		err = SyncUploads(config, run)
 		if err != nil {
 			logger.Fatal("There was an error syncing uploads with S3",
 				zap.Error(err),
 			)
 		}
+		if dryRun {
+			logger.Info("Dry Run Completed, Nothing Was Deployed")
+			return
+		}
 		logger.Info("Pushed Uploads to S3")
+		recordStep(run, "sync uploads")
 
 		// Dump MySQL database
-		err = DumpDatabase(config)
+		err = DumpDatabase(config, run)
 		if err != nil {
 			logger.Fatal("There was an error dumping the MySQL database",
 				zap.Error(err),
 			)
 		}
 		logger.Info("Staging Database Backup Created")
+		recordStep(run, "dump database")
 
 		// Push MySQL Dump to Production
-		err = TransferFile("staging_dump.sql", config)
+		transferKey, err := TransferDump(config, run)
 		if err != nil {
 			logger.Fatal("There was an error transfering the MySQL dump to production",
 				zap.Error(err),
 			)
 		}
-		logger.Info("Pushed MySQL Dump to Production")
+		logger.Info("Pushed MySQL Dump to Production",
+			zap.String("transport", config.Transfer.Transport),
+			zap.String("transfer key", transferKey),
+		)
+		recordStep(run, "transfer dump")
+
+		cleanupRuns(config, run)
 	}
 
 	/**
 	 * Production Server
 	 */
 	if currentEnvironment == "production" {
-		backupName = os.Args[1]
+		backupName = flag.Arg(0)
+		run := startRun(config)
+		defer run.Close()
+
+		renameTables, err := usesRenameTables(config)
+		if err != nil {
+			logger.Fatal(err.Error())
+		}
+
+		lock, err := AcquireDeployLock(config, currentEnvironment, backupName)
+		if err != nil {
+			logger.Fatal("Could not acquire the deployment lock", zap.Error(err))
+		}
+		defer lock.Release()
+
+		// Fetch the MySQL dump when staging handed it over through S3
+		if config.Transfer.Transport == "s3" {
+			transferKey := defaultTransferKey(backupName)
+			err = FetchTransfer(config, run, transferKey)
+			if err != nil {
+				logger.Fatal("There was an error fetching the MySQL dump from S3",
+					zap.Error(err),
+				)
+			}
+			logger.Info("Fetched MySQL Dump from S3", zap.String("key", transferKey))
+			recordStep(run, "fetch transfer")
+		}
 
 		// Back up persistent tables
-		err = DumpPersistentTables(config)
+		err = DumpPersistentTables(config, run)
 		if err != nil {
 			logger.Fatal("There was an error dumping the MySQL database",
 				zap.Error(err),
 			)
 		}
 		logger.Info("Persistent Tables Backup Created")
+		recordStep(run, "dump persistent tables")
 
 		// Restore the database backup
-		err = RestoreFromBackup(config, backupName)
+		err = RestoreFromBackup(config, run)
 		if err != nil {
 			logger.Fatal("There was an error restoring the database",
 				zap.Error(err),
 			)
 		}
+		recordStep(run, "restore database")
 
 		// Restore persistent tables
-		err = RestorePersistentTables(config, backupName)
+		err = RestorePersistentTables(config, run)
 		if err != nil {
 			logger.Fatal("There was an error restoring the persistent tables",
 				zap.Error(err),
 			)
 		}
+		recordStep(run, "restore persistent tables")
 
 		// Rename URLs
 		err = RenameUrls(config, backupName)
@@ -130,33 +247,212 @@ func main() {
 				zap.Error(err),
 			)
 		}
+		recordStep(run, "rename urls")
 
-		// Flush WordPress cache
-		err = FlushWordPressCache(config)
-		if err != nil {
-			logger.Fatal("There was an error flushing the WordPress cache",
-				zap.Error(err),
-			)
+		// Flush WordPress cache, web nodes are flushed when they are switched
+		if len(config.Environments.Production.Nodes) == 0 && !renameTables {
+			err = FlushWordPressCache(config)
+			if err != nil {
+				logger.Fatal("There was an error flushing the WordPress cache",
+					zap.Error(err),
+				)
+			}
+			recordStep(run, "flush cache")
 		}
 
 		// Sync MySQL backup to S3
-		err = SyncDatabaseBackup(config, backupName)
+		err = SyncDatabaseBackup(config, run)
 		if err != nil {
 			logger.Fatal("There was an error syncing the database backup to S3",
 				zap.Error(err),
 			)
 		}
+		recordStep(run, "sync database backup")
 
-		// Update production .env file
-		err = UpdateEnvFile(backupName)
+		// Point production at the restored database, on every web node when there are several
+		if renameTables {
+			err = SwapDatabase(config, backupName)
+			if err == nil {
+				err = FlushWebNodes(config)
+			}
+		} else if len(config.Environments.Production.Nodes) == 0 {
+			err = SwitchDatabase(config, backupName)
+		} else {
+			err = SwitchWebNodes(config, backupName)
+		}
 		if err != nil {
-			logger.Fatal("There was an error updating the .env file",
+			logger.Fatal("There was an error switching production to the restored database",
 				zap.Error(err),
 			)
 		}
+		recordStep(run, "switch database")
+
+		cleanupRuns(config, run)
 	}
 
 	logger.Info("Production Deployment Completed Successfully!",
 		zap.Duration("execution time", time.Since(start)),
 	)
 }
+
+// startRun creates the directory of the run named after the backup and copies the
+// log into it
+func startRun(config Config) *Run {
+	run, err := NewRun(config, backupName)
+	if err != nil {
+		logger.Fatal("Could not create the run directory", zap.Error(err))
+	}
+	err = run.StartLog()
+	if err != nil {
+		logger.Fatal("Could not create the run log", zap.Error(err))
+	}
+	logger.Info("Started Run", zap.String("directory", run.Directory))
+
+	// Steps are not skipped, but what an earlier attempt got through is worth knowing
+	journal, err := run.Journal()
+	if err != nil {
+		logger.Warn("Could not read the run journal", zap.Error(err))
+	}
+	if len(journal) > 0 {
+		steps := make([]string, 0, len(journal))
+		for _, entry := range journal {
+			steps = append(steps, entry.Step)
+		}
+		logger.Warn("An earlier attempt of this run completed steps", zap.Strings("steps", steps))
+	}
+
+	return run
+}
+
+// recordStep adds a completed step to the journal of the run
+func recordStep(run *Run, step string) {
+	err := run.Complete(step)
+	if err != nil {
+		logger.Warn("Could not record the step in the run journal", zap.String("step", step), zap.Error(err))
+	}
+}
+
+// cleanupRuns removes old run directories once a run has succeeded
+func cleanupRuns(config Config, run *Run) {
+	err := CleanupRuns(config, run)
+	if err != nil {
+		logger.Warn("Could not remove old run directories", zap.Error(err))
+	}
+}
+
+// runBackupCommand runs one of the `jet backup <command>` commands
+func runBackupCommand(config Config, args []string) {
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "fetch":
+		flags := flag.NewFlagSet("fetch", flag.ExitOnError)
+		output := flags.String("output", "", "where to write the dump, <BACKUP_NAME>.sql by default")
+		flags.Parse(args[1:])
+		if flags.Arg(0) == "" {
+			logger.Fatal("Please pass in the name of the backup to fetch.")
+		}
+		if *output == "" {
+			*output = flags.Arg(0) + ".sql"
+		}
+
+		err := FetchBackup(config, flags.Arg(0), *output)
+		if err != nil {
+			logger.Fatal("There was an error fetching the database backup",
+				zap.Error(err),
+			)
+		}
+	default:
+		logger.Fatal("Unknown backup command, expected one of: fetch",
+			zap.String("command", command),
+		)
+	}
+}
+
+// runUploadsCommand runs one of the `jet uploads <command>` maintenance commands
+func runUploadsCommand(config Config, args []string) {
+	environment, err := GetEnvironment(config, currentEnvironment)
+	if err != nil {
+		logger.Fatal(err.Error())
+	}
+
+	command := ""
+	if len(args) > 0 {
+		command = args[0]
+	}
+
+	switch command {
+	case "pull":
+		err = PullUploads(config, environment)
+		if err != nil {
+			logger.Fatal("There was an error pulling uploads from S3",
+				zap.Error(err),
+			)
+		}
+		logger.Info("Pulled Uploads from S3")
+	case "rollback":
+		if len(args) < 2 {
+			logger.Fatal("Please pass in the name of the backup to roll uploads back to.")
+		}
+		err = RollbackUploads(config, environment, args[1])
+		if err != nil {
+			logger.Fatal("There was an error rolling back uploads",
+				zap.Error(err),
+			)
+		}
+		logger.Info("Rolled Back Uploads", zap.String("backup", args[1]))
+	case "abort-stale":
+		flags := flag.NewFlagSet("abort-stale", flag.ExitOnError)
+		olderThan := flags.Duration("older-than", 24*time.Hour, "abort incomplete multipart uploads started longer ago than this")
+		flags.Parse(args[1:])
+
+		err = AbortStaleUploads(config, *olderThan)
+		if err != nil {
+			logger.Fatal("There was an error aborting stale multipart uploads",
+				zap.Error(err),
+			)
+		}
+	case "orphans":
+		flags := flag.NewFlagSet("orphans", flag.ExitOnError)
+		local := flags.Bool("local", false, "check the uploads directory instead of the S3 bucket")
+		remove := flags.Bool("delete", false, "delete the orphaned uploads")
+		databaseName := flags.String("database", "", "the database to look for references in, by default the one the site is live on")
+		flags.Parse(args[1:])
+
+		// Production runs on the database of its latest backup, or of several while
+		// its web nodes are switched
+		names := []string{environment.Database.Name}
+		if *databaseName != "" {
+			names = []string{*databaseName}
+		} else if currentEnvironment == "production" {
+			names, err = liveDatabases(config)
+			if err != nil {
+				logger.Fatal("Could not find the live database", zap.Error(err))
+			}
+		}
+		var databases []Database
+		seen := make(map[string]bool)
+		for _, name := range names {
+			if name == "" || seen[name] {
+				continue
+			}
+			seen[name] = true
+			database := environment.Database
+			database.Name = name
+			databases = append(databases, database)
+		}
+		err = FindOrphanedUploads(config, environment, databases, *local, *remove)
+		if err != nil {
+			logger.Fatal("There was an error finding orphaned uploads",
+				zap.Error(err),
+			)
+		}
+	default:
+		logger.Fatal("Unknown uploads command, expected one of: pull, rollback, abort-stale, orphans",
+			zap.String("command", command),
+		)
+	}
+}
@@ -0,0 +1,511 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// defaultLockStaleAfter is how old a lock has to be before it is taken over when the
+// config does not say otherwise
+const defaultLockStaleAfter = 6 * time.Hour
+
+// lockPrefix is where distributed locks are kept in the bucket
+const lockPrefix = "locks/"
+
+// lockWriteGrace is how long a local lock that cannot be read is left alone, since
+// the run that created it may not have written it yet
+const lockWriteGrace = time.Minute
+
+// LockConfig describes how concurrent runs are kept apart
+type LockConfig struct {
+	// Distributed is "s3" to also lock through the bucket, "mysql" to also take a
+	// GET_LOCK on the database of the environment, or empty for the local lock only
+	Distributed string `json:"distributed"`
+	// StaleAfter is how many minutes old a lock has to be before it is taken over
+	StaleAfter int `json:"stale_after"`
+}
+
+func (c LockConfig) staleAfter() time.Duration {
+	if c.StaleAfter <= 0 {
+		return defaultLockStaleAfter
+	}
+
+	return time.Duration(c.StaleAfter) * time.Minute
+}
+
+// LockInfo describes who holds a lock
+type LockInfo struct {
+	PID         int       `json:"pid"`
+	Host        string    `json:"host"`
+	Started     time.Time `json:"started"`
+	Environment string    `json:"environment"`
+	Run         string    `json:"run"`
+}
+
+func (i LockInfo) String() string {
+	return fmt.Sprintf("%s on %s (pid %d) since %s", i.Run, i.Host, i.PID, i.Started.Format(time.RFC3339))
+}
+
+// stale reports whether the lock was left behind by a run that is gone. A run on
+// this host holds its lock for as long as its process lives, however long it takes,
+// the age of the lock only counts for runs on other hosts.
+func (i LockInfo) stale(staleAfter time.Duration) bool {
+	hostname, _ := os.Hostname()
+	if i.Host == hostname {
+		return !processAlive(i.PID)
+	}
+
+	return time.Since(i.Started) > staleAfter
+}
+
+// DeployLock is held for the whole of a run so that two runs of the same environment
+// never overlap
+type DeployLock struct {
+	localPath string
+
+	s3config *S3Config
+	s3Key    string
+	s3ETag   string
+
+	mysql      *exec.Cmd
+	mysqlStdin io.WriteCloser
+	mysqlName  string
+
+	mu       sync.Mutex
+	released bool
+}
+
+// heldLocks are released when the logger reports a fatal error, which exits without
+// running deferred functions
+var heldLocks = struct {
+	sync.Mutex
+	locks []*DeployLock
+}{}
+
+// releaseLocksOnFatal is a logger hook releasing every held lock before a fatal exit
+func releaseLocksOnFatal(entry zapcore.Entry) error {
+	if entry.Level < zapcore.DPanicLevel {
+		return nil
+	}
+
+	heldLocks.Lock()
+	locks := heldLocks.locks
+	heldLocks.Unlock()
+	for _, lock := range locks {
+		lock.Release()
+	}
+
+	return nil
+}
+
+func newLockInfo(environment string, run string) LockInfo {
+	hostname, _ := os.Hostname()
+
+	return LockInfo{
+		PID:         os.Getpid(),
+		Host:        hostname,
+		Started:     time.Now().UTC(),
+		Environment: environment,
+		Run:         run,
+	}
+}
+
+// localLockPath returns the lock file of an environment
+func localLockPath(environment string) string {
+	return path.Join(jetDirectory(), "locks", environment+".lock")
+}
+
+// AcquireDeployLock takes the local lock of an environment and, when configured, the
+// distributed lock as well. It fails straight away when another run holds either.
+func AcquireDeployLock(config Config, environment string, run string) (*DeployLock, error) {
+	info := newLockInfo(environment, run)
+	lock := &DeployLock{localPath: localLockPath(environment)}
+
+	err := acquireLocalLock(lock.localPath, info, config.Lock.staleAfter())
+	if err != nil {
+		return nil, err
+	}
+
+	switch config.Lock.Distributed {
+	case "":
+	case "s3":
+		err = lock.acquireS3(config, info)
+	case "mysql":
+		err = lock.acquireMySQL(config, info)
+	default:
+		err = fmt.Errorf("unknown distributed lock %q, expected s3 or mysql", config.Lock.Distributed)
+	}
+	if err != nil {
+		os.Remove(lock.localPath)
+		return nil, err
+	}
+
+	heldLocks.Lock()
+	heldLocks.locks = append(heldLocks.locks, lock)
+	heldLocks.Unlock()
+
+	logger.Info("Acquired Deployment Lock",
+		zap.String("environment", environment),
+		zap.String("run", run),
+		zap.String("distributed", config.Lock.Distributed),
+	)
+
+	return lock, nil
+}
+
+func acquireLocalLock(lockPath string, info LockInfo, staleAfter time.Duration) error {
+	err := os.MkdirAll(path.Dir(lockPath), 0755)
+	if err != nil {
+		return err
+	}
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		file, err := os.OpenFile(lockPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0644)
+		if err == nil {
+			_, err = file.Write(data)
+			if closeErr := file.Close(); err == nil {
+				err = closeErr
+			}
+			if err != nil {
+				os.Remove(lockPath)
+			}
+			return err
+		}
+		if !os.IsExist(err) {
+			return err
+		}
+
+		held, err := ioutil.ReadFile(lockPath)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		var holder LockInfo
+		err = json.Unmarshal(held, &holder)
+		if err == nil && !holder.stale(staleAfter) {
+			return fmt.Errorf("deployment already running: %s", holder)
+		}
+		if err != nil {
+			stat, statErr := os.Stat(lockPath)
+			if statErr == nil && time.Since(stat.ModTime()) < lockWriteGrace {
+				return fmt.Errorf("deployment already running: %s is being written", lockPath)
+			}
+		}
+		logger.Warn("Taking over stale deployment lock", zap.String("lock", lockPath), zap.Stringer("holder", holder))
+		err = takeOverLocalLock(lockPath, held)
+		if err != nil {
+			return err
+		}
+	}
+
+	return errors.New("could not take over the stale deployment lock")
+}
+
+// takeOverLocalLock removes a stale lock by moving it aside first, so that of the
+// runs that found it stale only one removes it. When what was moved aside is not the
+// stale lock, another run took the lock in the meantime and it is put back.
+func takeOverLocalLock(lockPath string, stale []byte) error {
+	aside := fmt.Sprintf("%s.stale-%d", lockPath, os.Getpid())
+	err := os.Rename(lockPath, aside)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer os.Remove(aside)
+
+	moved, err := ioutil.ReadFile(aside)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(moved, stale) {
+		// Linking fails rather than replace a lock yet another run has taken since
+		err = os.Link(aside, lockPath)
+		if err != nil {
+			return fmt.Errorf("deployment lock changed while it was taken over: %v", err)
+		}
+	}
+
+	return nil
+}
+
+func readLocalLock(lockPath string) (LockInfo, error) {
+	var info LockInfo
+	data, err := ioutil.ReadFile(lockPath)
+	if err != nil {
+		return info, err
+	}
+	err = json.Unmarshal(data, &info)
+
+	return info, err
+}
+
+// acquireS3 creates the lock object only if it does not exist yet, so that two runs
+// can never both believe they hold it
+func (l *DeployLock) acquireS3(config Config, info LockInfo) error {
+	err := loadAwsConfigFile()
+	if err != nil {
+		return err
+	}
+	l.s3config, err = newS3Config(config, lockPrefix)
+	if err != nil {
+		return err
+	}
+	l.s3Key = lockPrefix + info.Environment + ".lock"
+
+	data, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+
+	for attempt := 0; attempt < 2; attempt++ {
+		request, output := l.s3config.S3Service.PutObjectRequest(&s3.PutObjectInput{
+			Bucket:      aws.String(l.s3config.Bucket),
+			Key:         aws.String(l.s3Key),
+			Body:        strings.NewReader(string(data)),
+			ContentType: aws.String("application/json"),
+		})
+		request.HTTPRequest.Header.Set("If-None-Match", "*")
+		err = request.Send()
+		if err == nil {
+			l.s3ETag = aws.StringValue(output.ETag)
+			return nil
+		}
+		if reqErr, ok := err.(awserr.RequestFailure); !ok || (reqErr.StatusCode() != 412 && reqErr.StatusCode() != 409) {
+			return err
+		}
+
+		holder, etag, err := readS3Lock(l.s3config, l.s3Key)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			continue
+		}
+		if err == nil && !holder.stale(config.Lock.staleAfter()) {
+			return fmt.Errorf("deployment already running: %s", holder)
+		}
+		if etag == "" {
+			if err == nil {
+				err = errors.New("the lock object has no ETag")
+			}
+			return fmt.Errorf("reading the deployment lock %s: %v", l.s3Key, err)
+		}
+		logger.Warn("Taking over stale deployment lock", zap.String("lock", l.s3Key), zap.Stringer("holder", holder))
+		// Only the stale lock is deleted, not one another run has put in its place since
+		request, _ = l.s3config.S3Service.DeleteObjectRequest(&s3.DeleteObjectInput{
+			Bucket: aws.String(l.s3config.Bucket),
+			Key:    aws.String(l.s3Key),
+		})
+		request.HTTPRequest.Header.Set("If-Match", etag)
+		err = request.Send()
+		if reqErr, ok := err.(awserr.RequestFailure); ok && (reqErr.StatusCode() == 412 || reqErr.StatusCode() == 404) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	return errors.New("could not take over the stale deployment lock")
+}
+
+// readS3Lock returns who holds the lock object along with its ETag
+func readS3Lock(config *S3Config, key string) (LockInfo, string, error) {
+	var info LockInfo
+	object, err := config.S3Service.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(key),
+	})
+	if err != nil {
+		return info, "", err
+	}
+	defer object.Body.Close()
+	err = json.NewDecoder(object.Body).Decode(&info)
+
+	return info, aws.StringValue(object.ETag), err
+}
+
+// mysqlLockName is the GET_LOCK name of an environment
+func mysqlLockName(environment string) string {
+	return "jet_deploy_" + environment
+}
+
+// acquireMySQL takes a GET_LOCK on the database of the environment. The lock belongs
+// to the connection, so the client is kept running until the lock is released and
+// MySQL frees it by itself if jet dies.
+func (l *DeployLock) acquireMySQL(config Config, info LockInfo) error {
+	environment, err := GetEnvironment(config, info.Environment)
+	if err != nil {
+		return err
+	}
+	database := environment.Database
+	l.mysqlName = mysqlLockName(info.Environment)
+
+	cmd, remove, err := mysqlCommand(config.BinaryPaths.MySQL, database,
+		"--batch",
+		"--skip-column-names",
+		"--unbuffered",
+	)
+	if err != nil {
+		return err
+	}
+	// The client has read its options once it answers, so the file need not outlive this
+	defer remove()
+	cmd.Stderr = os.Stderr
+	stdin, err := cmd.StdinPipe()
+	if err != nil {
+		return err
+	}
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(stdin, "SELECT GET_LOCK('%s', 0);\n", l.mysqlName)
+	result, err := bufio.NewReader(stdout).ReadString('\n')
+	result = strings.TrimSpace(result)
+	if err != nil || result != "1" {
+		stdin.Close()
+		cmd.Wait()
+		if err != nil {
+			return fmt.Errorf("taking the mysql lock %s: %v", l.mysqlName, err)
+		}
+		return fmt.Errorf("deployment already running: mysql lock %s is held", l.mysqlName)
+	}
+
+	l.mysql = cmd
+	l.mysqlStdin = stdin
+	go io.Copy(ioutil.Discard, stdout)
+
+	return nil
+}
+
+// Release gives up every lock that is held, it is safe to call more than once
+func (l *DeployLock) Release() {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.released {
+		return
+	}
+	l.released = true
+
+	if l.mysql != nil {
+		fmt.Fprintf(l.mysqlStdin, "SELECT RELEASE_LOCK('%s');\n", l.mysqlName)
+		l.mysqlStdin.Close()
+		l.mysql.Wait()
+	}
+	if l.s3config != nil {
+		// Only this run's lock is deleted, not one another run took over in the meantime
+		request, _ := l.s3config.S3Service.DeleteObjectRequest(&s3.DeleteObjectInput{
+			Bucket: aws.String(l.s3config.Bucket),
+			Key:    aws.String(l.s3Key),
+		})
+		if l.s3ETag != "" {
+			request.HTTPRequest.Header.Set("If-Match", l.s3ETag)
+		}
+		err := request.Send()
+		if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 412 {
+			logger.Warn("The distributed lock was taken over by another run", zap.String("lock", l.s3Key))
+		} else if err != nil {
+			logger.Error("Could not release the distributed lock", zap.String("lock", l.s3Key), zap.Error(err))
+		}
+	}
+	os.Remove(l.localPath)
+}
+
+// ReportStatus logs whether a run of the environment is in progress and who runs it
+func ReportStatus(config Config, environment string) error {
+	staleAfter := config.Lock.staleAfter()
+
+	holder, err := readLocalLock(localLockPath(environment))
+	if os.IsNotExist(err) {
+		logger.Info("No Deployment Running Locally", zap.String("environment", environment))
+	} else if err != nil {
+		return err
+	} else {
+		logger.Info("Deployment Running Locally",
+			zap.String("environment", environment),
+			zap.String("run", holder.Run),
+			zap.String("host", holder.Host),
+			zap.Int("pid", holder.PID),
+			zap.Time("started", holder.Started),
+			zap.Bool("stale", holder.stale(staleAfter)),
+		)
+	}
+
+	switch config.Lock.Distributed {
+	case "s3":
+		err := loadAwsConfigFile()
+		if err != nil {
+			return err
+		}
+		s3config, err := newS3Config(config, lockPrefix)
+		if err != nil {
+			return err
+		}
+		holder, _, err := readS3Lock(s3config, lockPrefix+environment+".lock")
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchKey {
+			logger.Info("No Deployment Holds the S3 Lock", zap.String("environment", environment))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		logger.Info("Deployment Holds the S3 Lock",
+			zap.String("environment", environment),
+			zap.String("run", holder.Run),
+			zap.String("host", holder.Host),
+			zap.Int("pid", holder.PID),
+			zap.Time("started", holder.Started),
+			zap.Bool("stale", holder.stale(staleAfter)),
+		)
+	case "mysql":
+		env, err := GetEnvironment(config, environment)
+		if err != nil {
+			return err
+		}
+		owner := ""
+		err = queryRows(config, env.Database, fmt.Sprintf("SELECT IS_USED_LOCK('%s')", mysqlLockName(environment)), func(row string) {
+			owner = row
+		})
+		if err != nil {
+			return err
+		}
+		logger.Info("MySQL Deployment Lock",
+			zap.String("environment", environment),
+			zap.Bool("held", owner != "" && owner != "NULL"),
+			zap.String("connection", owner),
+		)
+	}
+
+	return nil
+}
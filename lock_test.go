@@ -0,0 +1,126 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLocalLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetlock")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	lockPath := filepath.Join(dir, "locks", "staging.lock")
+
+	err = acquireLocalLock(lockPath, newLockInfo("staging", "first"), time.Hour)
+	if err != nil {
+		t.Fatal("unable to acquire the lock: ", err.Error())
+	}
+
+	err = acquireLocalLock(lockPath, newLockInfo("staging", "second"), time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "first") {
+		t.Errorf("expected the second run to be told about the first, got %v", err)
+	}
+
+	// A run on this host keeps its lock for as long as it runs, however old the lock is
+	long := newLockInfo("staging", "long restore")
+	long.Started = time.Now().Add(-2 * time.Hour)
+	data, _ := json.Marshal(long)
+	ioutil.WriteFile(lockPath, data, 0644)
+	err = acquireLocalLock(lockPath, newLockInfo("staging", "impatient"), time.Hour)
+	if err == nil || !strings.Contains(err.Error(), "long restore") {
+		t.Errorf("expected the lock of a running process not to be taken over, got %v", err)
+	}
+
+	// A lock whose process is gone is taken over
+	dead := newLockInfo("staging", "crashed")
+	dead.PID = 1 << 30
+	data, _ = json.Marshal(dead)
+	ioutil.WriteFile(lockPath, data, 0644)
+	err = acquireLocalLock(lockPath, newLockInfo("staging", "third"), time.Hour)
+	if err != nil {
+		t.Error("expected a lock left by a dead process to be taken over: ", err.Error())
+	}
+
+	// So is a lock that is older than the stale age, wherever it was taken
+	old := newLockInfo("staging", "forgotten")
+	old.Host = "another-host"
+	old.Started = time.Now().Add(-2 * time.Hour)
+	data, _ = json.Marshal(old)
+	ioutil.WriteFile(lockPath, data, 0644)
+	err = acquireLocalLock(lockPath, newLockInfo("staging", "fourth"), time.Hour)
+	if err != nil {
+		t.Error("expected an old lock to be taken over: ", err.Error())
+	}
+
+	holder, _ := readLocalLock(lockPath)
+	if holder.Run != "fourth" || holder.PID != os.Getpid() {
+		t.Errorf("expected the lock to be held by this run, got %+v", holder)
+	}
+}
+
+func TestDeployLockRelease(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetlock")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	lock := &DeployLock{localPath: filepath.Join(dir, "production.lock")}
+	acquireLocalLock(lock.localPath, newLockInfo("production", "run"), time.Hour)
+
+	lock.Release()
+	lock.Release()
+	if _, err := os.Stat(lock.localPath); !os.IsNotExist(err) {
+		t.Error("expected the lock file to be removed")
+	}
+}
+
+func TestTakeOverLocalLock(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetlock")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	lockPath := filepath.Join(dir, "staging.lock")
+
+	stale, _ := json.Marshal(newLockInfo("staging", "crashed"))
+	live, _ := json.Marshal(newLockInfo("staging", "faster"))
+
+	// Another run found the same stale lock and took it over first
+	ioutil.WriteFile(lockPath, live, 0644)
+	err = takeOverLocalLock(lockPath, stale)
+	if err != nil {
+		t.Fatal("unable to take over the lock: ", err.Error())
+	}
+	holder, err := readLocalLock(lockPath)
+	if err != nil || holder.Run != "faster" {
+		t.Errorf("expected the lock of the faster run to be put back, got %+v: %v", holder, err)
+	}
+
+	ioutil.WriteFile(lockPath, stale, 0644)
+	err = takeOverLocalLock(lockPath, stale)
+	if err != nil {
+		t.Fatal("unable to take over the lock: ", err.Error())
+	}
+	if _, err := os.Stat(lockPath); !os.IsNotExist(err) {
+		t.Error("expected the stale lock to be removed")
+	}
+	entries, _ := ioutil.ReadDir(dir)
+	if len(entries) != 0 {
+		t.Errorf("expected nothing to be left aside, found %d files", len(entries))
+	}
+
+	// A lock that cannot be read yet may still be being written by the run that took it
+	ioutil.WriteFile(lockPath, nil, 0644)
+	err = acquireLocalLock(lockPath, newLockInfo("staging", "second"), time.Hour)
+	if err == nil {
+		t.Error("expected a lock that was just created not to be taken over")
+	}
+}
@@ -0,0 +1,9 @@
+//go:build windows
+// +build windows
+
+package main
+
+// processAlive cannot tell on Windows, so a lock is only stale once it is old enough
+func processAlive(pid int) bool {
+	return pid > 0
+}
@@ -0,0 +1,611 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+// manifestPrefix is where upload manifests are stored in the bucket, next to the
+// database_backups prefix
+const manifestPrefix = "uploads_manifests/"
+
+// ManifestEntry records a single object as it was when a backup was made
+type ManifestEntry struct {
+	Key       string `json:"key"`
+	SHA256    string `json:"sha256"`
+	Size      int64  `json:"size"`
+	ETag      string `json:"etag"`
+	VersionID string `json:"version_id,omitempty"`
+	// Source is the local file the object was uploaded from, which for a processed
+	// image is its copy in the cache rather than the original
+	Source string `json:"source,omitempty"`
+}
+
+// Manifest records the state of every object under the uploads prefix after the
+// uploads sync of a backup, so that uploads can be rolled back along with the database
+type Manifest struct {
+	BackupName string          `json:"backup_name"`
+	Bucket     string          `json:"bucket"`
+	Prefix     string          `json:"prefix"`
+	Created    time.Time       `json:"created"`
+	Versioned  bool            `json:"versioned"`
+	Objects    []ManifestEntry `json:"objects"`
+}
+
+// remoteObject is the current state of an object in the bucket
+type remoteObject struct {
+	ETag      string
+	Size      int64
+	VersionID string
+	Deleted   bool
+}
+
+func manifestKey(backupName string) string {
+	return manifestPrefix + backupName + ".json"
+}
+
+// objectKey returns the key of a synced file under the bucket prefix
+func objectKey(config *S3Config, name string) string {
+	return strings.TrimPrefix(path.Join(config.BucketPrefix, name), "/")
+}
+
+// ensureVersioning turns on object versioning for the bucket if it is not already on
+func ensureVersioning(config *S3Config) error {
+	status, err := config.S3Service.GetBucketVersioning(&s3.GetBucketVersioningInput{
+		Bucket: aws.String(config.Bucket),
+	})
+	if err != nil {
+		return err
+	}
+	if aws.StringValue(status.Status) == s3.BucketVersioningStatusEnabled {
+		return nil
+	}
+
+	_, err = config.S3Service.PutBucketVersioning(&s3.PutBucketVersioningInput{
+		Bucket: aws.String(config.Bucket),
+		VersioningConfiguration: &s3.VersioningConfiguration{
+			Status: aws.String(s3.BucketVersioningStatusEnabled),
+		},
+	})
+	if err != nil {
+		return err
+	}
+	logger.Info("Enabled S3 Object Versioning", zap.String("bucket", config.Bucket))
+
+	return nil
+}
+
+// listRemoteState returns the latest state of every object under the bucket prefix.
+// With versioning the version IDs are included and deleted objects are reported.
+func listRemoteState(config *S3Config, versioned bool) (map[string]remoteObject, error) {
+	state := make(map[string]remoteObject)
+
+	if !versioned {
+		err := config.S3Service.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+			Bucket: aws.String(config.Bucket),
+			Prefix: aws.String(config.BucketPrefix),
+		}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+			for _, object := range page.Contents {
+				state[aws.StringValue(object.Key)] = remoteObject{
+					ETag: aws.StringValue(object.ETag),
+					Size: aws.Int64Value(object.Size),
+				}
+			}
+			return true
+		})
+
+		return state, err
+	}
+
+	err := config.S3Service.ListObjectVersionsPages(&s3.ListObjectVersionsInput{
+		Bucket: aws.String(config.Bucket),
+		Prefix: aws.String(config.BucketPrefix),
+	}, func(page *s3.ListObjectVersionsOutput, lastPage bool) bool {
+		for _, version := range page.Versions {
+			if aws.BoolValue(version.IsLatest) {
+				state[aws.StringValue(version.Key)] = remoteObject{
+					ETag:      aws.StringValue(version.ETag),
+					Size:      aws.Int64Value(version.Size),
+					VersionID: aws.StringValue(version.VersionId),
+				}
+			}
+		}
+		for _, marker := range page.DeleteMarkers {
+			if aws.BoolValue(marker.IsLatest) {
+				state[aws.StringValue(marker.Key)] = remoteObject{
+					VersionID: aws.StringValue(marker.VersionId),
+					Deleted:   true,
+				}
+			}
+		}
+		return true
+	})
+
+	return state, err
+}
+
+// buildManifest describes every object under the bucket prefix that is not excluded,
+// not only the files this sync touched, so that a rollback leaves alone the objects
+// that were already there. Checksums are only known for the synced files.
+func buildManifest(config *S3Config, backupName string, files []*FileStat, hashes *hashCache, state map[string]remoteObject, versioned bool) (*Manifest, error) {
+	manifest := &Manifest{
+		BackupName: backupName,
+		Bucket:     config.Bucket,
+		Prefix:     config.BucketPrefix,
+		Created:    time.Now().UTC(),
+		Versioned:  versioned,
+		Objects:    make([]ManifestEntry, 0, len(state)),
+	}
+
+	synced := make(map[string]*FileStat, len(files))
+	for _, file := range files {
+		synced[objectKey(config, file.Name)] = file
+	}
+
+	for key, remote := range state {
+		if remote.Deleted {
+			continue
+		}
+		if excluded, _ := config.Matcher.Excluded(strings.TrimPrefix(key, config.BucketPrefix)); excluded {
+			continue
+		}
+
+		entry := ManifestEntry{
+			Key:       key,
+			Size:      remote.Size,
+			ETag:      remote.ETag,
+			VersionID: remote.VersionID,
+		}
+		if file, ok := synced[key]; ok {
+			sum, err := hashes.sum(file)
+			if err != nil {
+				return nil, err
+			}
+			entry.SHA256 = sum
+			entry.Size = file.Size
+			entry.Source = file.Path
+		}
+		manifest.Objects = append(manifest.Objects, entry)
+	}
+	sort.Slice(manifest.Objects, func(i, j int) bool {
+		return manifest.Objects[i].Key < manifest.Objects[j].Key
+	})
+
+	return manifest, nil
+}
+
+// writeUploadsManifest records the objects as they now exist in the bucket under
+// the name of the backup, and keeps a copy in the run directory
+func writeUploadsManifest(config *S3Config, run *Run, files []*FileStat, versioned bool) error {
+	backupName := run.Name
+	hashes := loadHashCache(path.Join(jetDirectory(), "upload-hashes.json"))
+
+	state, err := listRemoteState(config, versioned)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := buildManifest(config, backupName, files, hashes, state, versioned)
+	if err != nil {
+		return err
+	}
+
+	err = writeManifest(config, manifest)
+	if err != nil {
+		return err
+	}
+	body, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+	err = ioutil.WriteFile(run.Path(uploadsManifestFile), body, 0600)
+	if err != nil {
+		return err
+	}
+	logger.Info("Wrote Uploads Manifest",
+		zap.String("key", manifestKey(backupName)),
+		zap.Int("objects", len(manifest.Objects)),
+		zap.Bool("versioned", versioned),
+	)
+
+	err = hashes.save()
+	if err != nil {
+		logger.Warn("Could not save the upload checksum cache", zap.Error(err))
+	}
+
+	return nil
+}
+
+func writeManifest(config *S3Config, manifest *Manifest) error {
+	body, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+
+	_, err = config.S3Service.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(config.Bucket),
+		Key:         aws.String(manifestKey(manifest.BackupName)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+
+	return err
+}
+
+func loadManifest(config *S3Config, backupName string) (*Manifest, error) {
+	object, err := config.S3Service.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(manifestKey(backupName)),
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not load the uploads manifest for %s: %v", backupName, err)
+	}
+	defer object.Body.Close()
+
+	manifest := &Manifest{}
+	err = json.NewDecoder(object.Body).Decode(manifest)
+	if err != nil {
+		return nil, fmt.Errorf("could not parse the uploads manifest for %s: %v", backupName, err)
+	}
+
+	return manifest, nil
+}
+
+// manifestedKeys returns the key of every object an uploads manifest lists, which a
+// rollback to that backup expects to find
+func manifestedKeys(config *S3Config) (map[string]bool, error) {
+	var backups []string
+	err := config.S3Service.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(config.Bucket),
+		Prefix: aws.String(manifestPrefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, object := range page.Contents {
+			name := strings.TrimPrefix(aws.StringValue(object.Key), manifestPrefix)
+			if strings.HasSuffix(name, ".json") {
+				backups = append(backups, strings.TrimSuffix(name, ".json"))
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	keys := make(map[string]bool)
+	for _, backup := range backups {
+		manifest, err := loadManifest(config, backup)
+		if err != nil {
+			return nil, err
+		}
+		for _, entry := range manifest.Objects {
+			keys[entry.Key] = true
+		}
+	}
+
+	return keys, nil
+}
+
+// planRollback works out which manifest entries have to be restored and which
+// objects were added after the manifest was written
+func planRollback(manifest *Manifest, state map[string]remoteObject) ([]ManifestEntry, []string) {
+	var restore []ManifestEntry
+	inManifest := make(map[string]bool, len(manifest.Objects))
+
+	for _, entry := range manifest.Objects {
+		inManifest[entry.Key] = true
+		current, ok := state[entry.Key]
+		switch {
+		case !ok || current.Deleted:
+			restore = append(restore, entry)
+		case manifest.Versioned && entry.VersionID != "" && current.VersionID != entry.VersionID:
+			restore = append(restore, entry)
+		case current.ETag != entry.ETag:
+			restore = append(restore, entry)
+		}
+	}
+
+	var added []string
+	for key, current := range state {
+		if !current.Deleted && !inManifest[key] {
+			added = append(added, key)
+		}
+	}
+	sort.Strings(added)
+
+	return restore, added
+}
+
+// RollbackUploads restores the objects under the uploads prefix to the state recorded
+// in the manifest of a backup. Versioned manifests are restored from the recorded
+// object versions, otherwise local files with a matching checksum are uploaded again.
+func RollbackUploads(config Config, environment Environment, rollbackTo string) error {
+	err := loadAwsConfigFile()
+	if err != nil {
+		return err
+	}
+
+	s3config, err := newS3Config(config, config.S3.BucketPrefix+"/")
+	if err != nil {
+		return err
+	}
+
+	uploadsPath := path.Join(GetWorkingDirectory(), environment.UploadsLocation)
+	matcher, err := NewIgnoreMatcher(config.Uploads.Exclude, path.Join(uploadsPath, IgnoreFileName), config.Uploads.Include)
+	if err != nil {
+		return err
+	}
+
+	manifest, err := loadManifest(s3config, rollbackTo)
+	if err != nil {
+		return err
+	}
+
+	state, err := listRemoteState(s3config, manifest.Versioned)
+	if err != nil {
+		return err
+	}
+	for key := range state {
+		if excluded, _ := matcher.Excluded(strings.TrimPrefix(key, s3config.BucketPrefix)); excluded {
+			delete(state, key)
+		}
+	}
+
+	restore, added := planRollback(manifest, state)
+	summary := &SyncSummary{}
+
+	for _, entry := range restore {
+		if dryRun {
+			logger.Info("Would restore object", zap.String("key", entry.Key), zap.String("version", entry.VersionID))
+			continue
+		}
+
+		err := restoreObject(s3config, manifest, entry, uploadsPath)
+		if err != nil {
+			summary.failed(fmt.Errorf("%s: %v", entry.Key, err))
+			continue
+		}
+		summary.uploaded(&FileStat{Name: entry.Key, Size: entry.Size})
+	}
+
+	for _, key := range added {
+		// Without versioning a deleted object is gone for good, so it is left in place
+		if dryRun || !manifest.Versioned {
+			logger.Info("Object was added after the backup", zap.String("key", key), zap.Bool("removed", false))
+			continue
+		}
+
+		_, err := s3config.S3Service.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(s3config.Bucket),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			summary.failed(fmt.Errorf("%s: %v", key, err))
+			continue
+		}
+		logger.Info("Object was added after the backup", zap.String("key", key), zap.Bool("removed", true))
+	}
+
+	logger.Info("Uploads Rollback Summary",
+		zap.String("backup", rollbackTo),
+		zap.Bool("versioned", manifest.Versioned),
+		zap.Bool("dry run", dryRun),
+		zap.Int("restored", summary.Uploaded),
+		zap.Int("added since backup", len(added)),
+		zap.Int("failed", summary.Failed),
+	)
+
+	return summary.Err()
+}
+
+func restoreObject(config *S3Config, manifest *Manifest, entry ManifestEntry, uploadsPath string) error {
+	if manifest.Versioned && entry.VersionID != "" {
+		source := (&url.URL{Path: config.Bucket + "/" + entry.Key}).EscapedPath()
+		_, err := config.S3Service.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(config.Bucket),
+			Key:        aws.String(entry.Key),
+			CopySource: aws.String(source + "?versionId=" + url.QueryEscape(entry.VersionID)),
+		})
+
+		return err
+	}
+
+	if entry.SHA256 == "" {
+		return errors.New("no versioned copy and the object was not synced by the backup")
+	}
+	name := strings.TrimPrefix(entry.Key, config.BucketPrefix)
+	localPath := entry.Source
+	if localPath == "" {
+		localPath = filepath.Join(uploadsPath, filepath.FromSlash(name))
+	}
+	sum, err := hashFile(localPath)
+	if err != nil {
+		return fmt.Errorf("no versioned copy and no local copy: %v", err)
+	}
+	if sum != entry.SHA256 {
+		return errors.New("no versioned copy and the local copy has changed since the backup")
+	}
+
+	stat, err := os.Stat(localPath)
+	if err != nil {
+		return err
+	}
+
+	return upload(config, &FileStat{Name: name, Path: localPath, Size: stat.Size(), ModTime: stat.ModTime()})
+}
+
+func hashFile(filePath string) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	_, err = io.Copy(hash, file)
+	if err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// hashCache remembers the checksums of local files so that unchanged files are not
+// read again on every sync
+type hashCache struct {
+	path    string
+	mu      sync.Mutex
+	entries map[string]hashCacheEntry
+}
+
+type hashCacheEntry struct {
+	Size    int64     `json:"size"`
+	ModTime time.Time `json:"mod_time"`
+	SHA256  string    `json:"sha256,omitempty"`
+	// ETag is what S3 reports for the file once uploaded, see localETag
+	ETag string `json:"etag,omitempty"`
+}
+
+// loadHashCache reads the cache from disk. A missing or unreadable cache starts empty.
+func loadHashCache(cachePath string) *hashCache {
+	cache := &hashCache{path: cachePath, entries: make(map[string]hashCacheEntry)}
+
+	data, err := ioutil.ReadFile(cachePath)
+	if err == nil {
+		json.Unmarshal(data, &cache.entries)
+	}
+
+	return cache
+}
+
+// entry returns the cached checksums of a file, which are empty once it has changed
+func (c *hashCache) entry(file *FileStat) hashCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	entry, ok := c.entries[file.Path]
+	if !ok || entry.Size != file.Size || !entry.ModTime.Equal(file.ModTime) {
+		return hashCacheEntry{Size: file.Size, ModTime: file.ModTime}
+	}
+
+	return entry
+}
+
+func (c *hashCache) store(file *FileStat, entry hashCacheEntry) {
+	c.mu.Lock()
+	c.entries[file.Path] = entry
+	c.mu.Unlock()
+}
+
+func (c *hashCache) sum(file *FileStat) (string, error) {
+	entry := c.entry(file)
+	if entry.SHA256 != "" {
+		return entry.SHA256, nil
+	}
+
+	sum, err := hashFile(file.Path)
+	if err != nil {
+		return "", err
+	}
+	entry.SHA256 = sum
+	c.store(file, entry)
+
+	return sum, nil
+}
+
+// etag returns the ETag of a file the way S3 computed the one of an object, in one
+// piece or in parts
+func (c *hashCache) etag(file *FileStat, remoteETag string, partSize int64) (string, error) {
+	multipart := strings.Contains(remoteETag, "-")
+	entry := c.entry(file)
+	if entry.ETag != "" && strings.Contains(entry.ETag, "-") == multipart {
+		return entry.ETag, nil
+	}
+
+	if !multipart {
+		partSize = 0
+	} else {
+		partSize = partSizeFor(file.Size, partSize)
+	}
+	etag, err := localETag(file.Path, partSize)
+	if err != nil {
+		return "", err
+	}
+	entry.ETag = etag
+	c.store(file, entry)
+
+	return etag, nil
+}
+
+// localETag returns the ETag S3 gives an upload of a file: the MD5 of the contents
+// when it is uploaded in one piece, or the MD5 of the MD5s of its parts followed by
+// the number of parts when it is uploaded in parts of partSize
+func localETag(filePath string, partSize int64) (string, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	if partSize <= 0 {
+		hash := md5.New()
+		_, err = io.Copy(hash, file)
+		if err != nil {
+			return "", err
+		}
+		return hex.EncodeToString(hash.Sum(nil)), nil
+	}
+
+	parts := md5.New()
+	count := 0
+	for {
+		hash := md5.New()
+		n, err := io.CopyN(hash, file, partSize)
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		if n == 0 && count > 0 {
+			break
+		}
+		parts.Write(hash.Sum(nil))
+		count++
+		if n < partSize {
+			break
+		}
+	}
+
+	return fmt.Sprintf("%s-%d", hex.EncodeToString(parts.Sum(nil)), count), nil
+}
+
+func (c *hashCache) save() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	data, err := json.Marshal(c.entries)
+	if err != nil {
+		return err
+	}
+	err = os.MkdirAll(filepath.Dir(c.path), 0755)
+	if err != nil {
+		return err
+	}
+
+	return ioutil.WriteFile(c.path, data, 0644)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestPlanRollback(t *testing.T) {
+	manifest := &Manifest{
+		Versioned: true,
+		Objects: []ManifestEntry{
+			{Key: "uploads/unchanged.jpg", ETag: "a", VersionID: "v1"},
+			{Key: "uploads/overwritten.jpg", ETag: "b", VersionID: "v1"},
+			{Key: "uploads/deleted.jpg", ETag: "c", VersionID: "v1"},
+			{Key: "uploads/missing.jpg", ETag: "d", VersionID: "v1"},
+		},
+	}
+	state := map[string]remoteObject{
+		"uploads/unchanged.jpg":   {ETag: "a", VersionID: "v1"},
+		"uploads/overwritten.jpg": {ETag: "b2", VersionID: "v2"},
+		"uploads/deleted.jpg":     {VersionID: "v2", Deleted: true},
+		"uploads/added.jpg":       {ETag: "e", VersionID: "v1"},
+	}
+
+	restore, added := planRollback(manifest, state)
+
+	var keys []string
+	for _, entry := range restore {
+		keys = append(keys, entry.Key)
+	}
+	expected := []string{"uploads/overwritten.jpg", "uploads/deleted.jpg", "uploads/missing.jpg"}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("expected %v to be restored, got %v", expected, keys)
+	}
+	if !reflect.DeepEqual(added, []string{"uploads/added.jpg"}) {
+		t.Errorf("expected uploads/added.jpg to be reported as added, got %v", added)
+	}
+}
+
+func TestBuildManifest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetmanifest")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	files := []*FileStat{
+		{Name: "test.html", Path: "testdata/test.html", Size: 10},
+		{Name: "empty.txt", Path: "testdata/empty.txt", Size: 0},
+	}
+	state := map[string]remoteObject{
+		"uploads/test.html": {ETag: `"etag"`, Size: 10, VersionID: "v7"},
+		"uploads/empty.txt": {ETag: `"d41d8cd98f00b204e9800998ecf8427e"`, VersionID: "v2"},
+	}
+	hashes := loadHashCache(filepath.Join(dir, "hashes.json"))
+
+	manifest, err := buildManifest(&S3Config{Bucket: "bucket", BucketPrefix: "uploads/"}, "backup", files, hashes, state, true)
+	if err != nil {
+		t.Fatal("unable to build the manifest: ", err.Error())
+	}
+
+	if len(manifest.Objects) != 2 || manifest.Objects[0].Key != "uploads/empty.txt" {
+		t.Fatalf("expected the manifest to be sorted by key, got %+v", manifest.Objects)
+	}
+	if manifest.Objects[0].SHA256 != "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855" {
+		t.Errorf("unexpected checksum for an empty file: %s", manifest.Objects[0].SHA256)
+	}
+	if manifest.Objects[1].VersionID != "v7" || manifest.Objects[1].ETag != `"etag"` {
+		t.Errorf("expected the remote state to be recorded, got %+v", manifest.Objects[1])
+	}
+
+	err = hashes.save()
+	if err != nil {
+		t.Fatal("unable to save the checksum cache: ", err.Error())
+	}
+	reloaded := loadHashCache(filepath.Join(dir, "hashes.json"))
+	if len(reloaded.entries) != 2 {
+		t.Errorf("expected 2 cached checksums, got %d", len(reloaded.entries))
+	}
+}
+
+func TestRollbackKeepsRemoteOnlyObjects(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetmanifest")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	matcher, err := NewIgnoreMatcher([]string{"cache/"}, "", nil)
+	if err != nil {
+		t.Fatal("unable to build the matcher: ", err.Error())
+	}
+	config := &S3Config{Bucket: "bucket", BucketPrefix: "uploads/", Matcher: matcher}
+
+	// Only test.html was synced, the other objects were already in the bucket
+	files := []*FileStat{{Name: "test.html", Path: "testdata/test.html", Size: 10}}
+	state := map[string]remoteObject{
+		"uploads/test.html":          {ETag: `"a"`, Size: 10, VersionID: "v1"},
+		"uploads/remote-only.jpg":    {ETag: `"b"`, Size: 5, VersionID: "v1"},
+		"uploads/removed.jpg":        {VersionID: "v3", Deleted: true},
+		"uploads/cache/excluded.css": {ETag: `"c"`, Size: 3, VersionID: "v1"},
+	}
+
+	manifest, err := buildManifest(config, "backup", files, loadHashCache(filepath.Join(dir, "hashes.json")), state, true)
+	if err != nil {
+		t.Fatal("unable to build the manifest: ", err.Error())
+	}
+
+	var keys []string
+	for _, entry := range manifest.Objects {
+		keys = append(keys, entry.Key)
+	}
+	if !reflect.DeepEqual(keys, []string{"uploads/remote-only.jpg", "uploads/test.html"}) {
+		t.Fatalf("expected every current object that is not excluded, got %v", keys)
+	}
+	if manifest.Objects[0].SHA256 != "" || manifest.Objects[0].Size != 5 || manifest.Objects[1].SHA256 == "" {
+		t.Errorf("expected checksums only for synced files, got %+v", manifest.Objects)
+	}
+
+	// A later deploy overwrites test.html and adds a new object
+	state["uploads/test.html"] = remoteObject{ETag: `"a2"`, Size: 11, VersionID: "v2"}
+	state["uploads/new.jpg"] = remoteObject{ETag: `"d"`, Size: 4, VersionID: "v1"}
+	delete(state, "uploads/cache/excluded.css")
+
+	restore, added := planRollback(manifest, state)
+	if len(restore) != 1 || restore[0].Key != "uploads/test.html" {
+		t.Errorf("expected only uploads/test.html to be restored, got %+v", restore)
+	}
+	if !reflect.DeepEqual(added, []string{"uploads/new.jpg"}) {
+		t.Errorf("expected the remote-only object to survive the rollback, got %v removed", added)
+	}
+}
+
+func TestRestoreObjectFromSource(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetmanifest")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	// The uploads directory holds the original, the bucket got the processed copy
+	err = ioutil.WriteFile(filepath.Join(dir, "photo.jpg"), []byte("original with metadata"), 0644)
+	if err != nil {
+		t.Fatal("unable to write the original: ", err.Error())
+	}
+	processed := filepath.Join(dir, "processed.jpg")
+	err = ioutil.WriteFile(processed, []byte("processed"), 0644)
+	if err != nil {
+		t.Fatal("unable to write the processed copy: ", err.Error())
+	}
+	sum, _ := hashFile(processed)
+
+	uploader := &fakeUploader{uploaded: map[string]int{}}
+	config := &S3Config{Uploader: uploader, Bucket: "bucket", BucketPrefix: "uploads/", Progress: &Progress{}}
+	manifest := &Manifest{}
+
+	err = restoreObject(config, manifest, ManifestEntry{Key: "uploads/photo.jpg", SHA256: sum, Source: processed}, dir)
+	if err != nil {
+		t.Fatal("unable to restore the processed copy: ", err.Error())
+	}
+	if uploader.uploaded["uploads/photo.jpg"] != 1 {
+		t.Error("expected the processed copy to be uploaded")
+	}
+
+	err = restoreObject(config, manifest, ManifestEntry{Key: "uploads/photo.jpg", SHA256: sum}, dir)
+	if err == nil {
+		t.Error("expected the original not to match the checksum of the processed copy")
+	}
+	err = restoreObject(config, manifest, ManifestEntry{Key: "uploads/remote-only.jpg"}, dir)
+	if err == nil {
+		t.Error("expected an object without a checksum not to be restored")
+	}
+}
+
+func TestManifestedKeys(t *testing.T) {
+	older, _ := json.Marshal(&Manifest{BackupName: "2018-05-1_12-0-0", Objects: []ManifestEntry{
+		{Key: "uploads/2018/05/removed.jpg"},
+		{Key: "uploads/2018/05/photo.jpg"},
+	}})
+	newer, _ := json.Marshal(&Manifest{BackupName: "2018-05-2_12-0-0", Objects: []ManifestEntry{
+		{Key: "uploads/2018/05/photo.jpg"},
+	}})
+	service := &fakeS3{objects: map[string][]byte{
+		manifestKey("2018-05-1_12-0-0"): older,
+		manifestKey("2018-05-2_12-0-0"): newer,
+		"uploads/2018/05/photo.jpg":     []byte("photo"),
+	}}
+	config := &S3Config{S3Service: service, Bucket: "bucket", BucketPrefix: "uploads/"}
+
+	keys, err := manifestedKeys(config)
+	if err != nil {
+		t.Fatal("unable to read the manifests: ", err.Error())
+	}
+	if len(keys) != 2 || !keys["uploads/2018/05/removed.jpg"] || !keys["uploads/2018/05/photo.jpg"] {
+		t.Errorf("expected the objects of every manifest, got %v", keys)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"os/exec"
+	"path"
 	"strings"
 	"time"
 )
@@ -16,29 +17,187 @@ func GenerateBackupString() string {
 		t.Minute(), t.Second())
 }
 
-// RenameUrls uses the PHP binary to rename URL's
+// GetEnvironment returns the configuration of the named environment
+func GetEnvironment(config Config, name string) (Environment, error) {
+	switch name {
+	case "staging":
+		return config.Environments.Staging, nil
+	case "production":
+		return config.Environments.Production, nil
+	case "load_balancer":
+		return config.Environments.LoadBalancer, nil
+	}
+
+	return Environment{}, fmt.Errorf("unknown environment %q", name)
+}
+
+// srdbScript runs Search Replace DB with the settings it is given in its environment,
+// since its command line tool only takes the password as an argument, which any user
+// of the server can read. It connects through mysqli itself, as Search Replace DB
+// knows nothing of sockets and TLS. Search Replace DB 4 picks PDO over mysqli whenever
+// pdo_mysql is loaded, so the choice is taken away from it, and the script fails if
+// the replacement ran over any connection but its own. The methods it overrides are
+// internals of Search Replace DB 4, so it refuses to run against a version that does
+// not have them, or that left the replacement a dry run.
+const srdbScript = `<?php
+require getenv('JET_SRDB_CLASS');
+
+$missing = array();
+foreach (array('db_setup', 'connect', 'use_pdo', 'connect_mysqli', 'add_error', 'get', 'set') as $method) {
+	if (!method_exists('icit_srdb', $method)) {
+		$missing[] = "$method()";
+	}
+}
+foreach (array('host', 'port', 'name', 'user', 'pass', 'dry_run', 'errors') as $property) {
+	if (!property_exists('icit_srdb', $property)) {
+		$missing[] = "\$$property";
+	}
+}
+if ($missing) {
+	fwrite(STDERR, "compat: unsupported version of Search Replace DB, expected 4.x, missing " . implode(', ', $missing) . "\n");
+	exit(1);
+}
+
+class jet_srdb extends icit_srdb {
+	public static $connected = false;
+
+	public function db_setup() {
+		if (!class_exists('mysqli')) {
+			$this->add_error('the mysqli extension is not loaded', 'db');
+			return false;
+		}
+		// PHP 8.1 throws on mysqli errors by default, Search Replace DB checks return values
+		mysqli_report(MYSQLI_REPORT_OFF);
+		$this->set('use_pdo', false);
+		$this->set('db', $this->connect_mysqli());
+
+		return (bool) $this->get('db');
+	}
+
+	public function connect($type = '') {
+		return $this->connect_mysqli();
+	}
+
+	public function use_pdo() {
+		return false;
+	}
+
+	public function connect_mysqli() {
+		// The mysql client prefers TLS unless told otherwise
+		$mode = getenv('JET_DB_SSL_MODE') ?: 'preferred';
+		$connection = $this->connect_with($mode !== 'disabled', $mode);
+		// Like the mysql client, fall back on an unencrypted connection when TLS is only preferred
+		if (!$connection && $mode === 'preferred') {
+			$connection = $this->connect_with(false, $mode);
+		}
+		if (!$connection) {
+			$this->add_error(mysqli_connect_error(), 'db');
+		}
+
+		return $connection;
+	}
+
+	private function connect_with($tls, $mode) {
+		$connection = mysqli_init();
+		$flags = 0;
+		if ($tls) {
+			mysqli_ssl_set($connection, getenv('JET_DB_SSL_KEY') ?: null, getenv('JET_DB_SSL_CERT') ?: null, getenv('JET_DB_SSL_CA') ?: null, null, null);
+			$flags = MYSQLI_CLIENT_SSL;
+			if ($mode === 'verify-identity') {
+				mysqli_options($connection, MYSQLI_OPT_SSL_VERIFY_SERVER_CERT, true);
+			} else {
+				$flags |= MYSQLI_CLIENT_SSL_DONT_VERIFY_SERVER_CERT;
+			}
+		}
+		$socket = getenv('JET_DB_SOCKET') ?: null;
+		if (!@mysqli_real_connect($connection, $this->host, $this->user, $this->pass, $this->name, (int) $this->port, $socket, $flags)) {
+			return false;
+		}
+		self::$connected = true;
+
+		return $connection;
+	}
+}
+
+$srdb = new jet_srdb(array(
+	'host' => getenv('JET_DB_HOST'),
+	'port' => getenv('JET_DB_PORT'),
+	'name' => getenv('JET_DB_NAME'),
+	'user' => getenv('JET_DB_USER'),
+	'pass' => getenv('JET_DB_PASSWORD'),
+	'search' => getenv('JET_SRDB_SEARCH'),
+	'replace' => getenv('JET_SRDB_REPLACE'),
+	'regex' => true,
+	// Search Replace DB only writes its changes when told to
+	'dry_run' => false,
+));
+$failed = false;
+foreach ($srdb->errors as $type => $errors) {
+	foreach ((array) $errors as $error) {
+		fwrite(STDERR, "$type: $error\n");
+		$failed = true;
+	}
+}
+if (!$failed && $srdb->get('dry_run')) {
+	fwrite(STDERR, "compat: Search Replace DB ran as a dry run and changed nothing\n");
+	$failed = true;
+}
+if (!$failed && !jet_srdb::$connected) {
+	fwrite(STDERR, "db: Search Replace DB did not connect through jet, so the socket and TLS settings were not used\n");
+	$failed = true;
+}
+exit($failed ? 1 : 0);
+`
+
+// RenameUrls uses the PHP binary to rename URL's in the database of a backup
 func RenameUrls(config Config, backupName string) error {
-	replacePattern := strings.Join(config.Environments.Production.TargetURLPatterns, "|")
-	cmd := exec.Command(config.BinaryPaths.PHP,
-		fmt.Sprintf("%s/vendor/bin/srdb.cli.php", GetWorkingDirectory()),
-		fmt.Sprintf("--host=%s", config.Environments.Production.Database.Host),
-		fmt.Sprintf("--port=%d", config.Environments.Production.Database.Port),
-		fmt.Sprintf("--user=%s", config.Environments.Production.Database.Username),
-		fmt.Sprintf("--pass=%s", config.Environments.Production.Database.Password),
-		"--regex",
-		fmt.Sprintf("--search=%s", replacePattern),
-		fmt.Sprintf("--replace=%s", config.Environments.Production.ReplacementURL),
-	)
-	cmd.Stdin = os.Stdin
+	cmd, err := srdbCommand(config, backupName)
+	if err != nil {
+		return err
+	}
 	cmd.Stdout = os.Stdout
 	cmd.Stderr = os.Stderr
 
-	err := cmd.Run()
+	return cmd.Run()
+}
+
+// srdbCommand returns the PHP command running srdbScript on the database of a backup
+func srdbCommand(config Config, backupName string) (*exec.Cmd, error) {
+	database := config.Environments.Production.Database
+	password, err := databasePassword(database)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	_, err = database.TLS.sslMode()
+	if err != nil {
+		return nil, err
+	}
+	// mysqli only connects through the socket to localhost
+	host := database.Host
+	if database.Socket != "" {
+		host = "localhost"
 	}
 
-	return nil
+	replacePattern := strings.Join(config.Environments.Production.TargetURLPatterns, "|")
+	cmd := exec.Command(config.BinaryPaths.PHP)
+	cmd.Env = append(os.Environ(),
+		"JET_SRDB_CLASS="+path.Join(GetWorkingDirectory(), "vendor/interconnectit/search-replace-db/srdb.class.php"),
+		"JET_DB_HOST="+host,
+		fmt.Sprintf("JET_DB_PORT=%d", database.Port),
+		"JET_DB_SOCKET="+expandHome(database.Socket),
+		"JET_DB_SSL_MODE="+database.TLS.Mode,
+		"JET_DB_SSL_CA="+expandHome(database.TLS.CA),
+		"JET_DB_SSL_CERT="+expandHome(database.TLS.Cert),
+		"JET_DB_SSL_KEY="+expandHome(database.TLS.Key),
+		"JET_DB_NAME="+backupDatabaseName(config, backupName),
+		"JET_DB_USER="+database.Username,
+		"JET_DB_PASSWORD="+password,
+		"JET_SRDB_SEARCH="+replacePattern,
+		"JET_SRDB_REPLACE="+config.Environments.Production.ReplacementURL,
+	)
+	cmd.Stdin = strings.NewReader(srdbScript)
+
+	return cmd, nil
 }
 
 // FlushWordPressCache flushes the WP cache
@@ -59,27 +218,3 @@ func FlushWordPressCache(config Config) error {
 
 	return nil
 }
-
-// CallProductionScript calls the production script and passes in the backup name
-func CallProductionScript(config Config, backupName string) error {
-	cmd := exec.Command(config.BinaryPaths.SSH,
-		fmt.Sprintf("%s@%s",
-			config.Environments.Production.User,
-			config.Environments.Production.Host,
-		),
-		fmt.Sprintf("cd %s && /usr/local/bin/jet --environment=production %s",
-			config.Environments.Production.RootDirectory,
-			backupName,
-		),
-	)
-	cmd.Stdin = os.Stdin
-	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
-
-	err := cmd.Run()
-	if err != nil {
-		return err
-	}
-
-	return nil
-}
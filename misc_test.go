@@ -1,6 +1,12 @@
 package main
 
 import (
+	"bytes"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
 	"testing"
 )
 
@@ -67,3 +73,115 @@ func TestFlushWordPressCache(t *testing.T) {
 		t.Error("there was an issue flushing the WordPress cache", err.Error())
 	}
 }
+
+// vendoredSrdb returns the PHP binary and the vendored Search Replace DB class, set
+// JET_TEST_SRDB_CLASS to test another copy of srdb.class.php
+func vendoredSrdb(t *testing.T) (string, string) {
+	php, err := exec.LookPath("php")
+	if err != nil {
+		t.Skip("php is not installed")
+	}
+	class := os.Getenv("JET_TEST_SRDB_CLASS")
+	if class == "" {
+		class = filepath.Join(GetWorkingDirectory(), "vendor/interconnectit/search-replace-db/srdb.class.php")
+	}
+	if _, err := os.Stat(class); err != nil {
+		t.Skip("Search Replace DB is not vendored")
+	}
+
+	return php, class
+}
+
+func TestSrdbScriptUsesMysqli(t *testing.T) {
+	php, class := vendoredSrdb(t)
+
+	config := Config{}
+	config.BinaryPaths.PHP = php
+	// Nothing listens on port 1, so the error shows which extension tried to connect
+	config.Environments.Production.Database = Database{Name: "test", Host: "127.0.0.1", Port: 1, Username: "test", Password: "test"}
+	config.Environments.Production.TargetURLPatterns = []string{"badexample.com"}
+	config.Environments.Production.ReplacementURL = "example.com"
+
+	cmd, err := srdbCommand(config, "2018-05-1_12-0-0")
+	if err != nil {
+		t.Fatal("unable to build the command: ", err.Error())
+	}
+	cmd.Env = append(cmd.Env, "JET_SRDB_CLASS="+class)
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err == nil {
+		t.Fatal("expected the script to fail without a database")
+	}
+	if strings.Contains(stderr.String(), "compat: ") {
+		t.Fatalf("expected the vendored Search Replace DB to be supported, got %q", stderr.String())
+	}
+	// PDO reports connection errors with an SQLSTATE, mysqli does not
+	if !strings.Contains(stderr.String(), "db: ") || strings.Contains(stderr.String(), "SQLSTATE") {
+		t.Errorf("expected the connection to be made through mysqli, got %q", stderr.String())
+	}
+}
+
+// TestSrdbScriptReplaces renames the URLs of a backup database on the database of
+// docker-compose.yml
+func TestSrdbScriptReplaces(t *testing.T) {
+	php, class := vendoredSrdb(t)
+
+	config := Config{}
+	config.BinaryPaths.PHP = php
+	config.BinaryPaths.MySQL = "/usr/local/bin/mysql"
+	config.Environments.Production.Database = Database{
+		Name:     "test",
+		Host:     "127.0.0.1",
+		Port:     4336,
+		Username: "test",
+		Password: "test",
+		Admin:    DatabaseAdmin{Username: "root", Password: "test"},
+	}
+	config.Environments.Production.TargetURLPatterns = []string{"badexample.com", "notexample.com"}
+	config.Environments.Production.ReplacementURL = "example.com"
+	database := config.Environments.Production.Database
+	backupName := GenerateBackupString()
+	name := backupDatabaseName(config, backupName)
+
+	execute := func(query string) {
+		cmd, remove, err := mysqlCommand(config.BinaryPaths.MySQL, database, "--execute", query)
+		if err != nil {
+			t.Fatal("unable to build the mysql command: ", err.Error())
+		}
+		defer remove()
+		output, err := cmd.CombinedOutput()
+		if err != nil {
+			t.Fatalf("unable to run %q: %v: %s", query, err, output)
+		}
+	}
+	execute(fmt.Sprintf("CREATE DATABASE `%s`; "+
+		"CREATE TABLE `%s`.wp_options (option_id bigint PRIMARY KEY, option_value longtext); "+
+		"INSERT INTO `%s`.wp_options VALUES (1, 'http://badexample.com/about'), (2, 'http://example.org/'); "+
+		"GRANT ALL ON `%s`.* TO 'test'@'%%'",
+		name, name, name, name,
+	))
+	defer execute(fmt.Sprintf("DROP DATABASE `%s`", name))
+
+	cmd, err := srdbCommand(config, backupName)
+	if err != nil {
+		t.Fatal("unable to build the command: ", err.Error())
+	}
+	cmd.Env = append(cmd.Env, "JET_SRDB_CLASS="+class)
+	output, err := cmd.CombinedOutput()
+	if err != nil {
+		t.Fatalf("unable to rename the URLs: %v: %s", err, output)
+	}
+
+	var rows []string
+	err = queryRows(config, database, fmt.Sprintf("SELECT option_value FROM `%s`.wp_options ORDER BY option_id", name), func(row string) {
+		rows = append(rows, row)
+	})
+	if err != nil {
+		t.Fatal("unable to read the options: ", err.Error())
+	}
+	if strings.Join(rows, ",") != "http://example.com/about,http://example.org/" {
+		t.Errorf("expected only the staging URL to be renamed, got %v", rows)
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"go.uber.org/zap"
+)
+
+// defaultResumableThreshold is the file size from which uploads become resumable
+// when the config does not say otherwise
+const defaultResumableThreshold = 64 * 1024 * 1024
+
+// multipartState is saved after every completed part so that an interrupted upload
+// can carry on where it left off on the next run
+type multipartState struct {
+	Bucket   string           `json:"bucket"`
+	Key      string           `json:"key"`
+	UploadID string           `json:"upload_id"`
+	Size     int64            `json:"size"`
+	ModTime  time.Time        `json:"mod_time"`
+	PartSize int64            `json:"part_size"`
+	Parts    map[int64]string `json:"parts"`
+
+	path string
+	mu   sync.Mutex
+}
+
+func multipartStatePath(directory string, bucket string, key string) string {
+	sum := sha256.Sum256([]byte(bucket + "/" + key))
+
+	return filepath.Join(directory, hex.EncodeToString(sum[:])+".json")
+}
+
+// loadMultipartState reads the saved state of an upload, returning nil when there is none
+func loadMultipartState(statePath string) (*multipartState, error) {
+	data, err := ioutil.ReadFile(statePath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &multipartState{}
+	err = json.Unmarshal(data, state)
+	if err != nil {
+		// A corrupt state file can only be started over
+		return nil, nil
+	}
+	state.path = statePath
+
+	return state, nil
+}
+
+func (s *multipartState) save() error {
+	s.mu.Lock()
+	data, err := json.Marshal(s)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	err = os.MkdirAll(filepath.Dir(s.path), 0755)
+	if err != nil {
+		return err
+	}
+	temp := s.path + ".tmp"
+	err = ioutil.WriteFile(temp, data, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(temp, s.path)
+}
+
+func (s *multipartState) completed(part int64, etag string) error {
+	s.mu.Lock()
+	s.Parts[part] = etag
+	s.mu.Unlock()
+
+	return s.save()
+}
+
+// matches reports whether the saved upload is of the same, unchanged file
+func (s *multipartState) matches(bucket string, key string, file *FileStat) bool {
+	return s.Bucket == bucket && s.Key == key && s.Size == file.Size && s.ModTime.Equal(file.ModTime)
+}
+
+// partSizeFor grows the configured part size when needed to stay within the S3 limits
+func partSizeFor(size int64, partSize int64) int64 {
+	if partSize < s3manager.MinUploadPartSize {
+		partSize = s3manager.MinUploadPartSize
+	}
+	if size/partSize >= s3manager.MaxUploadParts {
+		partSize = size/(s3manager.MaxUploadParts-1) + 1
+	}
+
+	return partSize
+}
+
+// uploadResumable uploads a large file part by part, saving its progress locally so
+// that a failed upload is resumed instead of started again from the first byte
+func uploadResumable(config *S3Config, file *os.File, fileStat *FileStat, key string, contentType string) error {
+	statePath := multipartStatePath(config.StateDirectory, config.Bucket, key)
+	state, err := loadMultipartState(statePath)
+	if err != nil {
+		return err
+	}
+
+	if state != nil && !state.matches(config.Bucket, key, fileStat) {
+		// The file changed since the last attempt so its parts are useless
+		abortMultipartUpload(config, state.Key, state.UploadID)
+		state = nil
+	}
+
+	if state != nil {
+		parts, err := listUploadedParts(config, state)
+		if aerr, ok := err.(awserr.Error); ok && aerr.Code() == s3.ErrCodeNoSuchUpload {
+			state = nil
+		} else if err != nil {
+			return err
+		} else {
+			state.Parts = parts
+			logger.Info("Resuming multipart upload",
+				zap.String("key", key),
+				zap.Int("completed parts", len(parts)),
+			)
+		}
+	}
+
+	if state == nil {
+		created, err := config.S3Service.CreateMultipartUpload(&s3.CreateMultipartUploadInput{
+			Bucket:      aws.String(config.Bucket),
+			Key:         aws.String(key),
+			ContentType: aws.String(contentType),
+		})
+		if err != nil {
+			return err
+		}
+		state = &multipartState{
+			Bucket:   config.Bucket,
+			Key:      key,
+			UploadID: aws.StringValue(created.UploadId),
+			Size:     fileStat.Size,
+			ModTime:  fileStat.ModTime,
+			PartSize: partSizeFor(fileStat.Size, config.PartSize),
+			Parts:    make(map[int64]string),
+			path:     statePath,
+		}
+		err = state.save()
+		if err != nil {
+			return err
+		}
+	}
+
+	err = uploadParts(config, file, state)
+	if err != nil {
+		return err
+	}
+
+	completed := make([]*s3.CompletedPart, 0, len(state.Parts))
+	for number, etag := range state.Parts {
+		completed = append(completed, &s3.CompletedPart{
+			PartNumber: aws.Int64(number),
+			ETag:       aws.String(etag),
+		})
+	}
+	sort.Slice(completed, func(i, j int) bool {
+		return *completed[i].PartNumber < *completed[j].PartNumber
+	})
+
+	_, err = config.S3Service.CompleteMultipartUpload(&s3.CompleteMultipartUploadInput{
+		Bucket:          aws.String(config.Bucket),
+		Key:             aws.String(key),
+		UploadId:        aws.String(state.UploadID),
+		MultipartUpload: &s3.CompletedMultipartUpload{Parts: completed},
+	})
+	if err != nil {
+		return err
+	}
+
+	return os.Remove(statePath)
+}
+
+// uploadParts uploads every part that is not yet recorded in the state
+func uploadParts(config *S3Config, file *os.File, state *multipartState) error {
+	concurrency := config.PartConcurrency
+	if concurrency < 1 {
+		concurrency = s3manager.DefaultUploadConcurrency
+	}
+	sem := make(chan bool, concurrency)
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+
+	parts := (state.Size + state.PartSize - 1) / state.PartSize
+	for number := int64(1); number <= parts; number++ {
+		state.mu.Lock()
+		_, done := state.Parts[number]
+		state.mu.Unlock()
+		if done {
+			config.Progress.transferred(partLength(state, number))
+			continue
+		}
+
+		sem <- true
+		mu.Lock()
+		failed := firstErr != nil
+		mu.Unlock()
+		if failed {
+			<-sem
+			break
+		}
+
+		wg.Add(1)
+		go func(number int64) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			err := uploadPart(config, file, state, number)
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+		}(number)
+	}
+
+	wg.Wait()
+
+	return firstErr
+}
+
+// partLength returns the size of a part, the last part holds whatever is left
+func partLength(state *multipartState, number int64) int64 {
+	offset := (number - 1) * state.PartSize
+	if offset+state.PartSize > state.Size {
+		return state.Size - offset
+	}
+
+	return state.PartSize
+}
+
+func uploadPart(config *S3Config, file *os.File, state *multipartState, number int64) error {
+	offset := (number - 1) * state.PartSize
+	size := partLength(state, number)
+
+	// The part is read once into memory so that the SDK can re-read it for signing
+	// and retries without counting it against the bandwidth limit twice
+	reader := &progressReader{r: io.NewSectionReader(file, offset, size), progress: config.Progress}
+	buffer := make([]byte, size)
+	_, err := io.ReadFull(config.Limiter.Reader(reader), buffer)
+	if err != nil {
+		reader.rollback()
+		return err
+	}
+
+	output, err := config.S3Service.UploadPart(&s3.UploadPartInput{
+		Bucket:     aws.String(state.Bucket),
+		Key:        aws.String(state.Key),
+		UploadId:   aws.String(state.UploadID),
+		PartNumber: aws.Int64(number),
+		Body:       bytes.NewReader(buffer),
+	})
+	if err != nil {
+		reader.rollback()
+		return err
+	}
+
+	return state.completed(number, aws.StringValue(output.ETag))
+}
+
+// listUploadedParts asks S3 which parts of an upload it already has
+func listUploadedParts(config *S3Config, state *multipartState) (map[int64]string, error) {
+	parts := make(map[int64]string)
+	err := config.S3Service.ListPartsPages(&s3.ListPartsInput{
+		Bucket:   aws.String(state.Bucket),
+		Key:      aws.String(state.Key),
+		UploadId: aws.String(state.UploadID),
+	}, func(page *s3.ListPartsOutput, lastPage bool) bool {
+		for _, part := range page.Parts {
+			parts[aws.Int64Value(part.PartNumber)] = aws.StringValue(part.ETag)
+		}
+		return true
+	})
+
+	return parts, err
+}
+
+func abortMultipartUpload(config *S3Config, key string, uploadID string) error {
+	_, err := config.S3Service.AbortMultipartUpload(&s3.AbortMultipartUploadInput{
+		Bucket:   aws.String(config.Bucket),
+		Key:      aws.String(key),
+		UploadId: aws.String(uploadID),
+	})
+
+	return err
+}
+
+// AbortStaleUploads aborts every incomplete multipart upload under the uploads prefix
+// that was started more than olderThan ago, along with its local resume state.
+// Incomplete uploads are billed for the parts they hold until they are aborted.
+func AbortStaleUploads(config Config, olderThan time.Duration) error {
+	err := loadAwsConfigFile()
+	if err != nil {
+		return err
+	}
+
+	s3config, err := newS3Config(config, config.S3.BucketPrefix+"/")
+	if err != nil {
+		return err
+	}
+
+	cutoff := time.Now().Add(-olderThan)
+	var stale []*s3.MultipartUpload
+	err = s3config.S3Service.ListMultipartUploadsPages(&s3.ListMultipartUploadsInput{
+		Bucket: aws.String(s3config.Bucket),
+		Prefix: aws.String(s3config.BucketPrefix),
+	}, func(page *s3.ListMultipartUploadsOutput, lastPage bool) bool {
+		for _, upload := range page.Uploads {
+			if aws.TimeValue(upload.Initiated).Before(cutoff) {
+				stale = append(stale, upload)
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+
+	summary := &SyncSummary{}
+	for _, upload := range stale {
+		key := aws.StringValue(upload.Key)
+		logger.Info("Stale multipart upload",
+			zap.String("key", key),
+			zap.Time("initiated", aws.TimeValue(upload.Initiated)),
+			zap.Bool("aborted", !dryRun),
+		)
+		if dryRun {
+			continue
+		}
+
+		uploadID := aws.StringValue(upload.UploadId)
+		err := abortMultipartUpload(s3config, key, uploadID)
+		if err != nil {
+			summary.failed(err)
+			continue
+		}
+
+		statePath := multipartStatePath(s3config.StateDirectory, s3config.Bucket, key)
+		state, _ := loadMultipartState(statePath)
+		if state != nil && state.UploadID == uploadID {
+			os.Remove(statePath)
+		}
+	}
+
+	logger.Info("Stale Multipart Uploads",
+		zap.Int("found", len(stale)),
+		zap.Int("failed", summary.Failed),
+		zap.Bool("dry run", dryRun),
+	)
+
+	return summary.Err()
+}
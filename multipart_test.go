@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+type fakeMultipartS3 struct {
+	s3iface.S3API
+	mu        sync.Mutex
+	failPart  int64
+	parts     map[int64]int
+	completed []*s3.CompletedPart
+}
+
+func (f *fakeMultipartS3) CreateMultipartUpload(input *s3.CreateMultipartUploadInput) (*s3.CreateMultipartUploadOutput, error) {
+	return &s3.CreateMultipartUploadOutput{UploadId: aws.String("upload-1")}, nil
+}
+
+func (f *fakeMultipartS3) UploadPart(input *s3.UploadPartInput) (*s3.UploadPartOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	number := aws.Int64Value(input.PartNumber)
+	if number == f.failPart {
+		f.failPart = 0
+		return nil, errors.New("connection reset by peer")
+	}
+	f.parts[number]++
+
+	return &s3.UploadPartOutput{ETag: aws.String("etag-" + string(rune('0'+number)))}, nil
+}
+
+func (f *fakeMultipartS3) ListPartsPages(input *s3.ListPartsInput, fn func(*s3.ListPartsOutput, bool) bool) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	output := &s3.ListPartsOutput{}
+	for number := range f.parts {
+		output.Parts = append(output.Parts, &s3.Part{
+			PartNumber: aws.Int64(number),
+			ETag:       aws.String("etag-" + string(rune('0'+number))),
+		})
+	}
+	fn(output, true)
+
+	return nil
+}
+
+func (f *fakeMultipartS3) CompleteMultipartUpload(input *s3.CompleteMultipartUploadInput) (*s3.CompleteMultipartUploadOutput, error) {
+	f.completed = input.MultipartUpload.Parts
+
+	return &s3.CompleteMultipartUploadOutput{}, nil
+}
+
+func TestUploadResumable(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetmultipart")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	filePath := filepath.Join(dir, "video.mp4")
+	err = ioutil.WriteFile(filePath, make([]byte, 11*1024*1024), 0644)
+	if err != nil {
+		t.Fatal("unable to write the test file: ", err.Error())
+	}
+	stat, _ := os.Stat(filePath)
+	fileStat := &FileStat{Name: "video.mp4", Path: filePath, Size: stat.Size(), ModTime: stat.ModTime()}
+
+	service := &fakeMultipartS3{failPart: 2, parts: map[int64]int{}}
+	config := &S3Config{
+		S3Service:       service,
+		Bucket:          "bucket",
+		BucketPrefix:    "uploads/",
+		PartConcurrency: 1,
+		StateDirectory:  filepath.Join(dir, "state"),
+	}
+
+	file, _ := os.Open(filePath)
+	err = uploadResumable(config, file, fileStat, "uploads/video.mp4", "video/mp4")
+	file.Close()
+	if err == nil {
+		t.Fatal("expected the first attempt to fail")
+	}
+
+	statePath := multipartStatePath(config.StateDirectory, "bucket", "uploads/video.mp4")
+	state, err := loadMultipartState(statePath)
+	if err != nil || state == nil || len(state.Parts) != 1 {
+		t.Fatalf("expected the completed part to be saved, got %+v", state)
+	}
+
+	file, _ = os.Open(filePath)
+	err = uploadResumable(config, file, fileStat, "uploads/video.mp4", "video/mp4")
+	file.Close()
+	if err != nil {
+		t.Fatal("unable to resume the upload: ", err.Error())
+	}
+
+	if service.parts[1] != 1 {
+		t.Errorf("the first part should not be uploaded again, it was uploaded %d times", service.parts[1])
+	}
+	if len(service.completed) != 3 || aws.Int64Value(service.completed[2].PartNumber) != 3 {
+		t.Errorf("expected 3 parts in order to be completed, got %v", service.completed)
+	}
+	if _, err := os.Stat(statePath); !os.IsNotExist(err) {
+		t.Error("the resume state should be removed once the upload completes")
+	}
+}
+
+func TestPartSizeFor(t *testing.T) {
+	if partSizeFor(100, 0) != 5*1024*1024 {
+		t.Error("part sizes below the S3 minimum should be raised")
+	}
+
+	size := int64(100 * 1024 * 1024 * 1024)
+	partSize := partSizeFor(size, 5*1024*1024)
+	if (size+partSize-1)/partSize > 10000 {
+		t.Errorf("part size %d would need more than 10000 parts", partSize)
+	}
+}
+
+func TestMultipartStateMatches(t *testing.T) {
+	now := time.Now()
+	state := &multipartState{Bucket: "bucket", Key: "key", Size: 10, ModTime: now}
+
+	if !state.matches("bucket", "key", &FileStat{Size: 10, ModTime: now}) {
+		t.Error("an unchanged file should match its saved upload")
+	}
+	if state.matches("bucket", "key", &FileStat{Size: 10, ModTime: now.Add(time.Second)}) {
+		t.Error("a modified file should not resume its old upload")
+	}
+}
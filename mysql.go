@@ -0,0 +1,230 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strconv"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// TLS modes of a MySQL connection
+const (
+	TLSModeDisabled       = "disabled"
+	TLSModePreferred      = "preferred"
+	TLSModeRequired       = "required"
+	TLSModeVerifyIdentity = "verify-identity"
+)
+
+// sslModes are the ssl-mode option values of the TLS modes
+var sslModes = map[string]string{
+	TLSModeDisabled:       "DISABLED",
+	TLSModePreferred:      "PREFERRED",
+	TLSModeRequired:       "REQUIRED",
+	TLSModeVerifyIdentity: "VERIFY_IDENTITY",
+}
+
+// legacyDefaultsFile is the option file in the working directory that every MySQL
+// client read its credentials from before they were set in the database config
+const legacyDefaultsFile = "mysql.cnf"
+
+// legacyDefaultsFileWarning is only logged once per run
+var legacyDefaultsFileWarning sync.Once
+
+// DatabasePort is the TCP port of a database, written in the config as a number or
+// a string
+type DatabasePort uint16
+
+// UnmarshalJSON accepts both 3306 and "3306". Like an empty string, null leaves the
+// default port.
+func (p *DatabasePort) UnmarshalJSON(data []byte) error {
+	value := string(data)
+	if value == "null" {
+		return nil
+	}
+	if bytes.HasPrefix(data, []byte(`"`)) {
+		err := json.Unmarshal(data, &value)
+		if err != nil {
+			return err
+		}
+		if value == "" {
+			*p = 0
+			return nil
+		}
+	}
+
+	port, err := strconv.ParseUint(value, 10, 16)
+	if err != nil {
+		return fmt.Errorf("invalid database port %s", data)
+	}
+	*p = DatabasePort(port)
+
+	return nil
+}
+
+// DatabaseAdmin is the MySQL user that dumps, restores and grants, when it is not
+// the user the site connects as
+type DatabaseAdmin struct {
+	Username        string `json:"username"`
+	Password        string `json:"password"`
+	PasswordEnv     string `json:"password_env"`
+	PasswordFile    string `json:"password_file"`
+	PasswordCommand string `json:"password_command"`
+}
+
+// TLSConfig describes how a MySQL connection is encrypted
+type TLSConfig struct {
+	// Mode is disabled, preferred, required or verify-identity, the client default if empty
+	Mode string `json:"mode"`
+	CA   string `json:"ca"`
+	Cert string `json:"cert"`
+	Key  string `json:"key"`
+}
+
+// sslMode returns the ssl-mode option of the TLS config, after checking that it
+// has what its mode needs
+func (t TLSConfig) sslMode() (string, error) {
+	if (t.Cert == "") != (t.Key == "") {
+		return "", errors.New("tls cert and key must be set together")
+	}
+	if t.Mode == "" {
+		return "", nil
+	}
+
+	mode, ok := sslModes[t.Mode]
+	if !ok {
+		return "", fmt.Errorf("unknown tls mode %q, expected disabled, preferred, required or verify-identity", t.Mode)
+	}
+	if t.Mode == TLSModeVerifyIdentity && t.CA == "" {
+		return "", errors.New("tls mode verify-identity needs a ca")
+	}
+	if t.Mode == TLSModeDisabled && (t.CA != "" || t.Cert != "") {
+		return "", errors.New("tls certificates are set but tls mode is disabled")
+	}
+
+	return mode, nil
+}
+
+// asAdmin returns the database as its admin user connects to it
+func (d Database) asAdmin() Database {
+	if d.Admin.Username == "" {
+		return d
+	}
+	d.Username = d.Admin.Username
+	d.Password = d.Admin.Password
+	d.PasswordEnv = d.Admin.PasswordEnv
+	d.PasswordFile = d.Admin.PasswordFile
+	d.PasswordCommand = d.Admin.PasswordCommand
+
+	return d
+}
+
+// mysqlDefaultsFile writes the client options of a database, as its user connects to
+// it, to a temporary option file that only the current user can read. It returns the
+// option passing it to a MySQL client, which must come first, and a function
+// removing the file. A defaults_file in the config is included last, so that what
+// it sets wins.
+func mysqlDefaultsFile(database Database) (string, func(), error) {
+	password, err := databasePassword(database)
+	if err != nil {
+		return "", nil, err
+	}
+	sslMode, err := database.TLS.sslMode()
+	if err != nil {
+		return "", nil, err
+	}
+
+	options := [][2]string{
+		{"user", database.Username},
+		{"password", password},
+	}
+	// The client would connect over TCP to any host but localhost
+	if database.Socket != "" {
+		options = append(options, [2]string{"protocol", "SOCKET"}, [2]string{"socket", expandHome(database.Socket)})
+	} else {
+		options = append(options, [2]string{"host", database.Host})
+		if database.Port != 0 {
+			options = append(options, [2]string{"port", strconv.Itoa(int(database.Port))})
+		}
+	}
+	options = append(options,
+		[2]string{"ssl-mode", sslMode},
+		[2]string{"ssl-ca", expandHome(database.TLS.CA)},
+		[2]string{"ssl-cert", expandHome(database.TLS.Cert)},
+		[2]string{"ssl-key", expandHome(database.TLS.Key)},
+	)
+	contents := "[client]\n"
+	for _, option := range options {
+		if option[1] != "" {
+			contents += option[0] + "=" + quoteOption(option[1]) + "\n"
+		}
+	}
+	if database.DefaultsFile != "" {
+		override, err := filepath.Abs(expandHome(database.DefaultsFile))
+		if err != nil {
+			return "", nil, err
+		}
+		contents += "!include " + override + "\n"
+	}
+
+	file, err := ioutil.TempFile("", "jet-mysql-")
+	if err != nil {
+		return "", nil, err
+	}
+	remove := func() { os.Remove(file.Name()) }
+
+	err = file.Chmod(0600)
+	if err == nil {
+		_, err = file.WriteString(contents)
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		remove()
+		return "", nil, err
+	}
+
+	return "--defaults-file=" + file.Name(), remove, nil
+}
+
+// withLegacyDefaultsFile includes the mysql.cnf of the working directory when neither
+// an admin user nor a defaults_file is set, so that a site that still keeps its admin
+// credentials there is not dumped and restored as the application user
+func withLegacyDefaultsFile(database Database) Database {
+	if database.Admin.Username != "" || database.DefaultsFile != "" {
+		return database
+	}
+	legacy := path.Join(GetWorkingDirectory(), legacyDefaultsFile)
+	if _, err := os.Stat(legacy); err != nil {
+		return database
+	}
+
+	legacyDefaultsFileWarning.Do(func() {
+		logger.Warn("Including mysql.cnf, set admin or defaults_file in the database config instead",
+			zap.String("file", legacy),
+		)
+	})
+	database.DefaultsFile = legacy
+
+	return database
+}
+
+// mysqlCommand returns a MySQL client command connecting to a database as its admin
+// user, along with a function removing its option file once the command is done
+func mysqlCommand(binary string, database Database, args ...string) (*exec.Cmd, func(), error) {
+	defaultsFile, remove, err := mysqlDefaultsFile(withLegacyDefaultsFile(database).asAdmin())
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return exec.Command(binary, append([]string{defaultsFile}, args...)...), remove, nil
+}
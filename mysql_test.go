@@ -0,0 +1,172 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestMySQLDefaultsFile(t *testing.T) {
+	option, remove, err := mysqlDefaultsFile(Database{
+		Username:     "site",
+		Password:     `p"a\ss`,
+		Host:         "db.example.com",
+		Port:         3307,
+		TLS:          TLSConfig{Mode: TLSModeVerifyIdentity, CA: "/etc/mysql/ca.pem"},
+		DefaultsFile: "/etc/mysql/jet.cnf",
+	})
+	if err != nil {
+		t.Fatal("unable to write the defaults file: ", err.Error())
+	}
+	file := strings.TrimPrefix(option, "--defaults-file=")
+
+	stat, err := os.Stat(file)
+	if err != nil || stat.Mode().Perm() != 0600 {
+		t.Error("expected the defaults file to be private")
+	}
+	contents, _ := ioutil.ReadFile(file)
+	expected := "[client]\n" +
+		"user=\"site\"\n" +
+		"password=\"p\\\"a\\\\ss\"\n" +
+		"host=\"db.example.com\"\n" +
+		"port=\"3307\"\n" +
+		"ssl-mode=\"VERIFY_IDENTITY\"\n" +
+		"ssl-ca=\"/etc/mysql/ca.pem\"\n" +
+		"!include /etc/mysql/jet.cnf\n"
+	if string(contents) != expected {
+		t.Errorf("expected the options to be generated from the config, got %q", contents)
+	}
+
+	remove()
+	if _, err := os.Stat(file); !os.IsNotExist(err) {
+		t.Error("expected the defaults file to be removed")
+	}
+
+	option, remove, err = mysqlDefaultsFile(Database{Username: "site", Host: "db.example.com", Port: 3307, Socket: "/run/mysqld/mysqld.sock"})
+	if err != nil {
+		t.Fatal("unable to write the defaults file: ", err.Error())
+	}
+	defer remove()
+	contents, _ = ioutil.ReadFile(strings.TrimPrefix(option, "--defaults-file="))
+	if string(contents) != "[client]\nuser=\"site\"\nprotocol=\"SOCKET\"\nsocket=\"/run/mysqld/mysqld.sock\"\n" {
+		t.Errorf("expected a socket to replace the host and port, got %q", contents)
+	}
+}
+
+func TestDatabasePort(t *testing.T) {
+	for config, expected := range map[string]DatabasePort{
+		`{"port": 3306}`:   3306,
+		`{"port": "3306"}`: 3306,
+		`{"port": 40000}`:  40000,
+		`{"port": ""}`:     0,
+		`{"port": null}`:   0,
+		`{}`:               0,
+	} {
+		var database Database
+		err := json.Unmarshal([]byte(config), &database)
+		if err != nil {
+			t.Error("unable to parse "+config+": ", err.Error())
+		} else if database.Port != expected {
+			t.Errorf("expected %s to be port %d, got %d", config, expected, database.Port)
+		}
+	}
+
+	for _, config := range []string{`{"port": 70000}`, `{"port": -1}`, `{"port": "mysql"}`, `{"port": 3306.5}`} {
+		var database Database
+		if json.Unmarshal([]byte(config), &database) == nil {
+			t.Errorf("expected %s to be rejected", config)
+		}
+	}
+}
+
+func TestTLSMode(t *testing.T) {
+	for _, tls := range []TLSConfig{
+		{},
+		{Mode: TLSModeDisabled},
+		{Mode: TLSModeRequired},
+		{Mode: TLSModeVerifyIdentity, CA: "ca.pem", Cert: "cert.pem", Key: "key.pem"},
+	} {
+		_, err := tls.sslMode()
+		if err != nil {
+			t.Errorf("expected %+v to be accepted: %v", tls, err)
+		}
+	}
+
+	for _, tls := range []TLSConfig{
+		{Mode: "verify-ca"},
+		{Mode: TLSModeVerifyIdentity},
+		{Mode: TLSModeRequired, Cert: "cert.pem"},
+		{Mode: TLSModeDisabled, CA: "ca.pem"},
+	} {
+		_, err := tls.sslMode()
+		if err == nil {
+			t.Errorf("expected %+v to be rejected", tls)
+		}
+	}
+}
+
+func TestMySQLCommandAsAdmin(t *testing.T) {
+	database := Database{
+		Name:     "example_com",
+		Username: "site",
+		Password: "site-password",
+		Admin:    DatabaseAdmin{Username: "deploy", Password: "deploy-password"},
+	}
+
+	cmd, remove, err := mysqlCommand("mysql", database, "--batch", database.Name)
+	if err != nil {
+		t.Fatal("unable to build the command: ", err.Error())
+	}
+	defer remove()
+	if len(cmd.Args) != 4 || !strings.HasPrefix(cmd.Args[1], "--defaults-file=") || cmd.Args[3] != "example_com" {
+		t.Fatalf("expected the defaults file to come first, got %q", cmd.Args)
+	}
+	contents, _ := ioutil.ReadFile(strings.TrimPrefix(cmd.Args[1], "--defaults-file="))
+	if !strings.Contains(string(contents), "user=\"deploy\"\npassword=\"deploy-password\"\n") {
+		t.Errorf("expected the admin user to connect, got %q", contents)
+	}
+
+	if database.asAdmin().Username != "deploy" || (Database{Username: "site"}).asAdmin().Username != "site" {
+		t.Error("expected the admin user only to replace the site user when it is set")
+	}
+}
+
+func TestLegacyDefaultsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetmysql")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	wd, _ := os.Getwd()
+	defer os.Chdir(wd)
+	os.Chdir(dir)
+
+	database := Database{Name: "example_com", Username: "site"}
+	if withLegacyDefaultsFile(database).DefaultsFile != "" {
+		t.Error("expected no defaults file without a mysql.cnf")
+	}
+
+	ioutil.WriteFile("mysql.cnf", []byte("[client]\nuser=deploy\n"), 0600)
+	cmd, remove, err := mysqlCommand("mysql", database, database.Name)
+	if err != nil {
+		t.Fatal("unable to build the command: ", err.Error())
+	}
+	defer remove()
+	contents, _ := ioutil.ReadFile(strings.TrimPrefix(cmd.Args[1], "--defaults-file="))
+	if !strings.HasSuffix(string(contents), "!include "+filepath.Join(GetWorkingDirectory(), "mysql.cnf")+"\n") {
+		t.Errorf("expected mysql.cnf to be included when no admin user is set, got %q", contents)
+	}
+
+	database.Admin.Username = "deploy"
+	if withLegacyDefaultsFile(database).DefaultsFile != "" {
+		t.Error("expected mysql.cnf to be ignored once an admin user is set")
+	}
+	database.Admin.Username = ""
+	database.DefaultsFile = "/etc/mysql/jet.cnf"
+	if withLegacyDefaultsFile(database).DefaultsFile != "/etc/mysql/jet.cnf" {
+		t.Error("expected a configured defaults_file to win over mysql.cnf")
+	}
+}
@@ -0,0 +1,382 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+)
+
+// Node roles
+const (
+	// RoleDatabasePrimary is the node the database dump is restored on
+	RoleDatabasePrimary = "db-primary"
+	// RoleWeb nodes serve the site, their .env is switched and their cache flushed
+	RoleWeb = "web"
+)
+
+// Node is one server of an environment. Fields left empty are taken from the
+// environment, and a node without a host is the machine jet is running on.
+type Node struct {
+	Name          string     `json:"name"`
+	User          string     `json:"user"`
+	Host          string     `json:"host"`
+	RootDirectory string     `json:"root_directory"`
+	Roles         []string   `json:"roles"`
+	SSH           *SSHConfig `json:"ssh"`
+}
+
+func (n Node) hasRole(role string) bool {
+	for _, r := range n.Roles {
+		if r == role {
+			return true
+		}
+	}
+
+	return false
+}
+
+// nodeEnvironment returns the environment as seen from a single node, so that the
+// SSH and transfer functions can address it
+func nodeEnvironment(environment Environment, node Node) Environment {
+	if node.User != "" {
+		environment.User = node.User
+	}
+	environment.Host = node.Host
+	if node.RootDirectory != "" {
+		environment.RootDirectory = node.RootDirectory
+	}
+	if node.SSH != nil {
+		environment.SSH = *node.SSH
+	}
+	environment.Nodes = nil
+
+	return environment
+}
+
+// nodesWithRole returns the nodes of an environment that have a role. An
+// environment without nodes is a single node that has every role.
+func nodesWithRole(environment Environment, role string) []Node {
+	if len(environment.Nodes) == 0 {
+		return []Node{{
+			Name:  environment.Host,
+			Host:  environment.Host,
+			Roles: []string{RoleDatabasePrimary, RoleWeb},
+		}}
+	}
+
+	var nodes []Node
+	for _, node := range environment.Nodes {
+		if !node.hasRole(role) {
+			continue
+		}
+		if node.Name == "" {
+			node.Name = node.Host
+		}
+		if node.Name == "" {
+			node.Name = "local"
+		}
+		nodes = append(nodes, node)
+	}
+
+	return nodes
+}
+
+// databaseNode returns the environment as seen from its single db-primary node
+func databaseNode(environment Environment) (Environment, error) {
+	nodes := nodesWithRole(environment, RoleDatabasePrimary)
+	if len(nodes) != 1 {
+		return Environment{}, fmt.Errorf("expected exactly one %s node, found %d", RoleDatabasePrimary, len(nodes))
+	}
+
+	return nodeEnvironment(environment, nodes[0]), nil
+}
+
+// nodeFiles reads and writes files on a node, locally or over SFTP
+type nodeFiles interface {
+	Stat(name string) (os.FileInfo, error)
+	ReadFile(name string) ([]byte, error)
+	Readlink(name string) (string, error)
+	Symlink(target string, name string) error
+	// WriteFile writes a file to disk with the mode and ownership of like
+	WriteFile(name string, data []byte, like os.FileInfo) error
+	// Rename replaces newName atomically and durably
+	Rename(oldName string, newName string) error
+	Remove(name string) error
+	ReadDir(name string) ([]os.FileInfo, error)
+	Close() error
+}
+
+type localFiles struct{}
+
+func (localFiles) Stat(name string) (os.FileInfo, error)      { return os.Stat(name) }
+func (localFiles) ReadFile(name string) ([]byte, error)       { return ioutil.ReadFile(name) }
+func (localFiles) Readlink(name string) (string, error)       { return os.Readlink(name) }
+func (localFiles) Symlink(target, name string) error          { return os.Symlink(target, name) }
+func (localFiles) Remove(name string) error                   { return os.Remove(name) }
+func (localFiles) ReadDir(name string) ([]os.FileInfo, error) { return ioutil.ReadDir(name) }
+func (localFiles) Close() error                               { return nil }
+
+func (localFiles) WriteFile(name string, data []byte, like os.FileInfo) error {
+	file, err := os.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, like.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Chmod(name, like.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	return chownLike(name, like)
+}
+
+func (localFiles) Rename(oldName, newName string) error {
+	err := os.Rename(oldName, newName)
+	if err != nil {
+		return err
+	}
+
+	// The rename itself only survives a crash once the directory is synced
+	return syncDirectory(path.Dir(newName))
+}
+
+type sftpFiles struct {
+	client *sftp.Client
+}
+
+func (f sftpFiles) Stat(name string) (os.FileInfo, error) { return f.client.Stat(name) }
+func (f sftpFiles) Rename(oldName, newName string) error {
+	return f.client.PosixRename(oldName, newName)
+}
+func (f sftpFiles) Readlink(name string) (string, error)       { return f.client.ReadLink(name) }
+func (f sftpFiles) Symlink(target, name string) error          { return f.client.Symlink(target, name) }
+func (f sftpFiles) Remove(name string) error                   { return f.client.Remove(name) }
+func (f sftpFiles) ReadDir(name string) ([]os.FileInfo, error) { return f.client.ReadDir(name) }
+func (f sftpFiles) Close() error                               { return f.client.Close() }
+
+func (f sftpFiles) ReadFile(name string) ([]byte, error) {
+	file, err := f.client.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
+func (f sftpFiles) WriteFile(name string, data []byte, like os.FileInfo) error {
+	file, err := f.client.OpenFile(name, os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	// Servers without the OpenSSH fsync extension cannot be asked to sync
+	if _, canSync := f.client.HasExtension("fsync@openssh.com"); err == nil && canSync {
+		err = file.Sync()
+	}
+	if err != nil {
+		file.Close()
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = f.client.Chmod(name, like.Mode().Perm())
+	if err != nil {
+		return err
+	}
+
+	owner, ok := like.Sys().(*sftp.FileStat)
+	if !ok {
+		return nil
+	}
+	stat, err := f.client.Stat(name)
+	if err != nil {
+		return err
+	}
+	if current, ok := stat.Sys().(*sftp.FileStat); ok && current.UID == owner.UID && current.GID == owner.GID {
+		return nil
+	}
+
+	// Only root may give a file away, and the copy is still usable without its owner
+	err = f.client.Chown(name, int(owner.UID), int(owner.GID))
+	if err != nil {
+		logger.Warn("Could not copy the owner of the file it replaces",
+			zap.String("file", name),
+			zap.Uint32("uid", owner.UID),
+			zap.Uint32("gid", owner.GID),
+			zap.Error(err),
+		)
+	}
+
+	return nil
+}
+
+func openNodeFiles(environment Environment) (nodeFiles, error) {
+	if environment.Host == "" {
+		return localFiles{}, nil
+	}
+
+	client, err := newSFTPClient(environment)
+	if err != nil {
+		return nil, err
+	}
+
+	return sftpFiles{client: client}, nil
+}
+
+// SwitchWebNodes points every web node of production at the database of a backup
+// and flushes their caches. The switched config files are first staged on every node,
+// and only once all of them are in place are they renamed over the live ones
+// together, so that the nodes disagree about the database for as short as possible.
+// If any node cannot be switched, the nodes that were are switched back.
+func SwitchWebNodes(config Config, backupName string) error {
+	if backupName == "" {
+		return errors.New("backupName string cannot be blank")
+	}
+	production := config.Environments.Production
+	nodes := nodesWithRole(production, RoleWeb)
+	if len(nodes) == 0 {
+		return fmt.Errorf("production has no %s nodes", RoleWeb)
+	}
+
+	switches := make([]databaseSwitch, len(nodes))
+	defer func() {
+		for _, s := range switches {
+			if s != nil {
+				s.close()
+			}
+		}
+	}()
+
+	// Phase one: stage the switched config on every node
+	previous := make([]string, len(nodes))
+	database := backupDatabaseName(config, backupName)
+	err := eachNode(nodes, func(i int, node Node) error {
+		environment := nodeEnvironment(production, node)
+		files, err := openNodeFiles(environment)
+		if err != nil {
+			return err
+		}
+		switches[i], err = newDatabaseSwitch(production.Switch, files, environment.RootDirectory, backupName)
+		if err != nil {
+			files.Close()
+			return err
+		}
+
+		previous[i], err = switches[i].current()
+		if err != nil {
+			return err
+		}
+
+		return switches[i].prepare(database)
+	})
+	if err != nil {
+		return fmt.Errorf("preparing the database switch, no node was switched: %v", err)
+	}
+
+	// Phase two: swap them in on every node at once
+	committed := make([]bool, len(nodes))
+	err = eachNode(nodes, func(i int, node Node) error {
+		err := switches[i].commit()
+		committed[i] = err == nil
+		return err
+	})
+	if err != nil {
+		for i, s := range switches {
+			if !committed[i] {
+				continue
+			}
+			rollbackErr := s.rollback()
+			if rollbackErr != nil {
+				logger.Error("Could not switch node back", zap.String("node", nodes[i].Name), zap.Error(rollbackErr))
+			}
+		}
+		return fmt.Errorf("switching the database, switched nodes were rolled back: %v", err)
+	}
+	logger.Info("Switched Web Nodes to Backup", zap.String("backup", backupName), zap.Int("nodes", len(nodes)))
+	revokeExpired(config, database)
+
+	err = eachNode(nodes, func(i int, node Node) error {
+		return switches[i].prune(config.Runs.keep())
+	})
+	if err != nil {
+		logger.Warn("Could not remove old database switch files", zap.Error(err))
+	}
+
+	return FlushWebNodes(config)
+}
+
+// FlushWebNodes flushes the WordPress cache of every web node of production, or of
+// production itself when it has no nodes
+func FlushWebNodes(config Config) error {
+	production := config.Environments.Production
+	if len(production.Nodes) == 0 {
+		return FlushWordPressCache(config)
+	}
+
+	return eachNode(nodesWithRole(production, RoleWeb), func(i int, node Node) error {
+		return flushNodeCache(config, nodeEnvironment(production, node))
+	})
+}
+
+// eachNode calls fn for every node at once and returns the first error
+func eachNode(nodes []Node, fn func(i int, node Node) error) error {
+	errs := make([]error, len(nodes))
+	var wg sync.WaitGroup
+	for i, node := range nodes {
+		wg.Add(1)
+		go func(i int, node Node) {
+			defer wg.Done()
+			errs[i] = fn(i, node)
+			if errs[i] != nil {
+				logger.Warn("Node step failed", zap.String("node", node.Name), zap.Error(errs[i]))
+			}
+		}(i, node)
+	}
+	wg.Wait()
+
+	for i, err := range errs {
+		if err != nil {
+			return fmt.Errorf("%s: %v", nodes[i].Name, err)
+		}
+	}
+
+	return nil
+}
+
+// flushNodeCache flushes the WordPress cache of a node
+func flushNodeCache(config Config, environment Environment) error {
+	if environment.Host == "" {
+		return FlushWordPressCache(config)
+	}
+
+	return RunRemoteCommand(environment,
+		fmt.Sprintf("%s cache flush --path=%s",
+			config.BinaryPaths.WP,
+			shellQuote(path.Join(environment.RootDirectory, "htdocs/wp/")),
+		),
+		os.Stdout,
+		os.Stderr,
+	)
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestSwitchWebNodes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetnodes")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer closeSSHClients()
+
+	key := testSSHKey(t, dir)
+	server := startTestSSHServer(t, key)
+	defer server.listener.Close()
+	remote := testSSHEnvironment(t, dir, server)
+
+	webOne, webTwo := filepath.Join(dir, "web1"), filepath.Join(dir, "web2")
+	for _, root := range []string{webOne, webTwo} {
+		os.Mkdir(root, 0755)
+		ioutil.WriteFile(filepath.Join(root, ".env"), []byte("DB_NAME=example_com\nDB_HOST=db\n"), 0640)
+	}
+
+	var config Config
+	config.BinaryPaths.WP = "true"
+	config.Environments.Production = Environment{
+		User:     remote.User,
+		Host:     remote.Host,
+		SSH:      remote.SSH,
+		Database: Database{Name: "example_com"},
+		Nodes: []Node{
+			{Name: "db", Host: remote.Host, RootDirectory: dir, Roles: []string{RoleDatabasePrimary}},
+			{Name: "web1", RootDirectory: webOne, Roles: []string{RoleWeb}},
+			{Name: "web2", Host: remote.Host, RootDirectory: webTwo, Roles: []string{RoleWeb}},
+		},
+	}
+
+	database, err := databaseNode(config.Environments.Production)
+	if err != nil || database.RootDirectory != dir {
+		t.Errorf("expected the db-primary node to receive the dump, got %+v: %v", database, err)
+	}
+
+	err = SwitchWebNodes(config, "backup")
+	if err != nil {
+		t.Fatal("unable to switch the web nodes: ", err.Error())
+	}
+	for _, root := range []string{webOne, webTwo} {
+		env, _ := ioutil.ReadFile(filepath.Join(root, ".env"))
+		if string(env) != "DB_NAME=example_com_backup\nDB_HOST=db\n" {
+			t.Errorf("expected %s to be switched, got %q", root, env)
+		}
+		stat, _ := os.Stat(filepath.Join(root, ".env"))
+		if stat.Mode().Perm() != 0640 {
+			t.Errorf("expected the .env permissions to be kept, got %v", stat.Mode())
+		}
+		if _, err := os.Stat(filepath.Join(root, ".env.jet-backup")); !os.IsNotExist(err) {
+			t.Error("expected the staged .env to be gone")
+		}
+	}
+
+	// A node that cannot be prepared leaves every node untouched
+	os.Remove(filepath.Join(webTwo, ".env"))
+	err = SwitchWebNodes(config, "another")
+	if err == nil {
+		t.Fatal("expected the switch to fail")
+	}
+	env, _ := ioutil.ReadFile(filepath.Join(webOne, ".env"))
+	if string(env) != "DB_NAME=example_com_backup\nDB_HOST=db\n" {
+		t.Errorf("expected web1 not to be switched, got %q", env)
+	}
+	if _, err := os.Stat(filepath.Join(webOne, ".env.jet-another")); !os.IsNotExist(err) {
+		t.Error("expected the staged .env to be removed")
+	}
+}
@@ -0,0 +1,357 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+// defaultUploadsURLPath is where WordPress serves the uploads directory from
+const defaultUploadsURLPath = "/wp-content/uploads/"
+
+// Where a reference to an upload was found
+const (
+	referenceAttachment = "attachment"
+	referenceMetadata   = "attachment metadata"
+	referencePost       = "post content"
+	referencePostMeta   = "post meta"
+	referenceOption     = "option"
+)
+
+// metadataFilePattern matches the file names in a serialized _wp_attachment_metadata
+// value: the attached file itself, its original before scaling, and every size
+var metadataFilePattern = regexp.MustCompile(`"(file|original_image)";s:\d+:"([^"]*)"`)
+
+// escapedSlashPattern matches slashes escaped in JSON or by the mysql client
+var escapedSlashPattern = regexp.MustCompile(`\\+/`)
+
+// uploadReferences maps every upload referenced by the database, relative to the
+// uploads directory, to where the first reference to it was found
+type uploadReferences map[string]string
+
+func (r uploadReferences) add(name string, source string) {
+	name = strings.TrimPrefix(path.Clean("/"+name), "/")
+	if name == "" {
+		return
+	}
+	if _, ok := r[name]; !ok {
+		r[name] = source
+	}
+}
+
+// addMetadata adds the files of a serialized attachment metadata value. Sizes are
+// stored without their directory, which is that of the attached file.
+func (r uploadReferences) addMetadata(value string) {
+	directory := ""
+	for _, match := range metadataFilePattern.FindAllStringSubmatch(value, -1) {
+		name := match[2]
+		if strings.Contains(name, "/") {
+			directory = path.Dir(name)
+		} else if directory != "" {
+			name = path.Join(directory, name)
+		}
+		r.add(name, referenceMetadata)
+	}
+}
+
+// addURLs adds every upload linked to from a piece of text
+func (r uploadReferences) addURLs(text string, source string, patterns []*regexp.Regexp) {
+	text = escapedSlashPattern.ReplaceAllString(text, "/")
+	for _, pattern := range patterns {
+		for _, match := range pattern.FindAllStringSubmatch(text, -1) {
+			name, err := url.PathUnescape(match[1])
+			if err != nil {
+				name = match[1]
+			}
+			r.add(name, source)
+		}
+	}
+}
+
+// uploadsURLPatterns matches URLs into the uploads directory for each URL path
+func uploadsURLPatterns(urlPaths []string) []*regexp.Regexp {
+	if len(urlPaths) == 0 {
+		urlPaths = []string{defaultUploadsURLPath}
+	}
+
+	patterns := make([]*regexp.Regexp, 0, len(urlPaths))
+	for _, urlPath := range urlPaths {
+		urlPath = "/" + strings.Trim(urlPath, "/") + "/"
+		patterns = append(patterns, regexp.MustCompile(regexp.QuoteMeta(urlPath)+`([^\s"'<>()\\?#]+)`))
+	}
+
+	return patterns
+}
+
+// isReferenced reports whether an upload is referenced, directly or because it is
+// the WebP copy jet generates next to a referenced image
+func (r uploadReferences) isReferenced(name string) bool {
+	if _, ok := r[name]; ok {
+		return true
+	}
+	if strings.HasSuffix(name, ".webp") {
+		_, ok := r[strings.TrimSuffix(name, ".webp")]
+		return ok
+	}
+
+	return false
+}
+
+// brokenReference is an upload the database refers to that does not exist
+type brokenReference struct {
+	Name   string
+	Source string
+}
+
+// findOrphans compares the uploads with the references to them, returning the
+// uploads nothing refers to and the references to uploads that do not exist
+func findOrphans(files []*FileStat, references uploadReferences) ([]*FileStat, []brokenReference) {
+	var orphans []*FileStat
+	existing := make(map[string]bool, len(files))
+	for _, file := range files {
+		existing[file.Name] = true
+		if !references.isReferenced(file.Name) {
+			orphans = append(orphans, file)
+		}
+	}
+
+	var broken []brokenReference
+	for name, source := range references {
+		if !existing[name] {
+			broken = append(broken, brokenReference{Name: name, Source: source})
+		}
+	}
+
+	sort.Slice(orphans, func(i, j int) bool { return orphans[i].Name < orphans[j].Name })
+	sort.Slice(broken, func(i, j int) bool { return broken[i].Name < broken[j].Name })
+
+	return orphans, broken
+}
+
+// loadUploadReferences reads every reference to an upload from the databases
+func loadUploadReferences(config Config, databases []Database) (uploadReferences, error) {
+	references := make(uploadReferences)
+	for _, database := range databases {
+		err := addUploadReferences(config, database, references)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return references, nil
+}
+
+func addUploadReferences(config Config, database Database, references uploadReferences) error {
+	patterns := uploadsURLPatterns(config.Uploads.URLPaths)
+	prefix := database.TablePrefix
+
+	queries := []struct {
+		query string
+		add   func(value string)
+	}{
+		{
+			fmt.Sprintf("SELECT meta_value FROM `%spostmeta` WHERE meta_key = '_wp_attached_file'", prefix),
+			func(value string) { references.add(value, referenceAttachment) },
+		},
+		{
+			fmt.Sprintf("SELECT meta_value FROM `%spostmeta` WHERE meta_key = '_wp_attachment_metadata'", prefix),
+			references.addMetadata,
+		},
+		{
+			fmt.Sprintf("SELECT post_content FROM `%sposts`", prefix),
+			func(value string) { references.addURLs(value, referencePost, patterns) },
+		},
+		{
+			fmt.Sprintf("SELECT meta_value FROM `%spostmeta` WHERE meta_key NOT IN ('_wp_attached_file', '_wp_attachment_metadata')", prefix),
+			func(value string) { references.addURLs(value, referencePostMeta, patterns) },
+		},
+		{
+			fmt.Sprintf("SELECT option_value FROM `%soptions`", prefix),
+			func(value string) { references.addURLs(value, referenceOption, patterns) },
+		},
+	}
+
+	for _, q := range queries {
+		err := queryRows(config, database, q.query, q.add)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// queryRows runs a query with the mysql client and calls fn with every row. Rows
+// are read one line at a time, the client escapes newlines inside values.
+func queryRows(config Config, database Database, query string, fn func(row string)) error {
+	cmd, remove, err := mysqlCommand(config.BinaryPaths.MySQL, database,
+		"--batch",
+		"--skip-column-names",
+		"--execute", query,
+		database.Name,
+	)
+	if err != nil {
+		return err
+	}
+	defer remove()
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return err
+	}
+
+	scanner := bufio.NewScanner(stdout)
+	scanner.Buffer(make([]byte, 64*1024), 64*1024*1024)
+	for scanner.Scan() {
+		fn(scanner.Text())
+	}
+	err = scanner.Err()
+	if err != nil {
+		// The rows that were not read would leave mysql blocked on a full pipe
+		cmd.Process.Kill()
+		cmd.Wait()
+		return err
+	}
+
+	return cmd.Wait()
+}
+
+// FindOrphanedUploads reports the uploads that no attachment, post, post meta or
+// option in any of the databases refers to, and the references to uploads that are
+// missing. The uploads are listed from S3, or from the uploads directory of the
+// environment when local is set. With remove set the orphans are deleted, except for
+// objects an uploads manifest lists, which a rollback would restore.
+func FindOrphanedUploads(config Config, environment Environment, databases []Database, local bool, remove bool) error {
+	// Without references every upload would be an orphan
+	if len(databases) == 0 {
+		return errors.New("no database to look for references in")
+	}
+	uploadsPath := path.Join(GetWorkingDirectory(), environment.UploadsLocation)
+	matcher, err := NewIgnoreMatcher(config.Uploads.Exclude, path.Join(uploadsPath, IgnoreFileName), config.Uploads.Include)
+	if err != nil {
+		return err
+	}
+
+	var (
+		s3config *S3Config
+		listing  chan *FileStat
+	)
+	if local {
+		listing = loadLocalFiles(uploadsPath)
+	} else {
+		err = loadAwsConfigFile()
+		if err != nil {
+			return err
+		}
+		s3config, err = newS3Config(config, config.S3.BucketPrefix+"/")
+		if err != nil {
+			return err
+		}
+		listing = loadS3Files(s3config, 50000)
+	}
+
+	references, err := loadUploadReferences(config, databases)
+	if err != nil {
+		return err
+	}
+	manifested := map[string]bool{}
+	if remove && !local {
+		manifested, err = manifestedKeys(s3config)
+		if err != nil {
+			return err
+		}
+	}
+
+	var files []*FileStat
+	for file := range excludeFiles(listing, matcher) {
+		if file.Err != nil {
+			return file.Err
+		}
+		// Excluded files are not deployed, so whether anything refers to them is moot
+		if file.ExcludedBy != "" || file.Name == "" || strings.HasSuffix(file.Name, "/") {
+			continue
+		}
+		files = append(files, file)
+	}
+
+	orphans, broken := findOrphans(files, references)
+
+	var orphanedBytes int64
+	for _, file := range orphans {
+		orphanedBytes += file.Size
+		logger.Info("Orphaned upload",
+			zap.String("file", file.Name),
+			zap.Int64("size", file.Size),
+		)
+	}
+	for _, reference := range broken {
+		logger.Warn("Broken upload reference",
+			zap.String("file", reference.Name),
+			zap.String("source", reference.Source),
+		)
+	}
+
+	summary := &SyncSummary{}
+	removed, kept := 0, 0
+	if remove && !dryRun {
+		for _, file := range orphans {
+			if !local && manifested[file.Path] {
+				kept++
+				continue
+			}
+			if local {
+				err = os.Remove(file.Path)
+			} else {
+				_, err = s3config.S3Service.DeleteObject(&s3.DeleteObjectInput{
+					Bucket: aws.String(s3config.Bucket),
+					Key:    aws.String(file.Path),
+				})
+			}
+			if err != nil {
+				summary.failed(fmt.Errorf("%s: %v", file.Name, err))
+				continue
+			}
+			removed++
+		}
+	}
+
+	logger.Info("Orphaned Uploads Report",
+		zap.Strings("databases", databaseNames(databases)),
+		zap.Bool("local", local),
+		zap.Int("uploads", len(files)),
+		zap.Int("references", len(references)),
+		zap.Int("orphans", len(orphans)),
+		zap.Int64("orphaned bytes", orphanedBytes),
+		zap.Int("broken references", len(broken)),
+		zap.Int("removed", removed),
+		zap.Int("kept for rollback", kept),
+		zap.Int("failed", summary.Failed),
+		zap.Bool("dry run", dryRun),
+	)
+
+	return summary.Err()
+}
+
+func databaseNames(databases []Database) []string {
+	names := make([]string, len(databases))
+	for i, database := range databases {
+		names[i] = database.Name
+	}
+
+	return names
+}
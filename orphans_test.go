@@ -0,0 +1,48 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestUploadReferences(t *testing.T) {
+	references := make(uploadReferences)
+	references.add("2018/05/photo-scaled.jpg", referenceAttachment)
+	references.addMetadata(`a:5:{s:5:"width";i:2560;s:4:"file";s:24:"2018/05/photo-scaled.jpg";s:5:"sizes";a:1:{s:9:"thumbnail";a:4:{s:4:"file";s:21:"photo-150x150.jpg";s:5:"width";i:150;}}s:14:"original_image";s:9:"photo.jpg";}`)
+	references.addURLs(`<img src="https:\/\/example.com\/wp-content\/uploads\/2018\/06\/banner%20wide.png?ver=2"> <a href='/wp-content/uploads/2018/06/brochure.pdf'>`, referencePost, uploadsURLPatterns(nil))
+
+	expected := map[string]string{
+		"2018/05/photo-scaled.jpg":  referenceAttachment,
+		"2018/05/photo-150x150.jpg": referenceMetadata,
+		"2018/05/photo.jpg":         referenceMetadata,
+		"2018/06/banner wide.png":   referencePost,
+		"2018/06/brochure.pdf":      referencePost,
+	}
+	if len(references) != len(expected) {
+		t.Errorf("expected %d references, got %v", len(expected), references)
+	}
+	for name, source := range expected {
+		if references[name] != source {
+			t.Errorf("expected %s to be referenced by %s, got %q", name, source, references[name])
+		}
+	}
+}
+
+func TestFindOrphans(t *testing.T) {
+	references := uploadReferences{
+		"2018/05/photo.jpg":   referenceAttachment,
+		"2018/05/missing.jpg": referencePost,
+	}
+	files := []*FileStat{
+		{Name: "2018/05/photo.jpg"},
+		{Name: "2018/05/photo.jpg.webp"},
+		{Name: "2018/05/unused.jpg"},
+	}
+
+	orphans, broken := findOrphans(files, references)
+	if len(orphans) != 1 || orphans[0].Name != "2018/05/unused.jpg" {
+		t.Errorf("expected only the unused upload to be orphaned, got %v", orphans)
+	}
+	if len(broken) != 1 || broken[0].Name != "2018/05/missing.jpg" || broken[0].Source != referencePost {
+		t.Errorf("expected the missing upload to be a broken reference, got %v", broken)
+	}
+}
@@ -0,0 +1,262 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// defaultProgressInterval is how often progress is logged when the config does not say
+const defaultProgressInterval = 10 * time.Second
+
+// Progress tracks a running sync so that it can be reported while it runs. All of
+// its methods may be called on a nil Progress, which tracks nothing.
+type Progress struct {
+	LocalScanned  int64
+	RemoteScanned int64
+	Queued        int64
+	QueuedBytes   int64
+	Completed     int64
+	Bytes         int64
+
+	// listed is set once every file that needs transferring has been queued
+	listed int32
+	start  time.Time
+}
+
+// NewProgress starts tracking a sync
+func NewProgress() *Progress {
+	return &Progress{start: time.Now()}
+}
+
+// countScanned passes every file through while counting it
+func (p *Progress) countScanned(in chan *FileStat, counter *int64) chan *FileStat {
+	if p == nil {
+		return in
+	}
+	out := make(chan *FileStat, cap(in))
+
+	go func() {
+		defer close(out)
+
+		for file := range in {
+			if file.Err == nil {
+				atomic.AddInt64(counter, 1)
+			}
+			out <- file
+		}
+	}()
+
+	return out
+}
+
+func (p *Progress) queued(file *FileStat) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.Queued, 1)
+	atomic.AddInt64(&p.QueuedBytes, file.Size)
+}
+
+// finished is called once per queued file, whether it succeeded or not
+func (p *Progress) finished() {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.Completed, 1)
+}
+
+// doneListing marks that no more files will be queued, which makes an ETA possible
+func (p *Progress) doneListing() {
+	if p == nil {
+		return
+	}
+	atomic.StoreInt32(&p.listed, 1)
+}
+
+func (p *Progress) transferred(n int64) {
+	if p == nil {
+		return
+	}
+	atomic.AddInt64(&p.Bytes, n)
+}
+
+// ProgressSnapshot is a consistent view of a Progress at a point in time
+type ProgressSnapshot struct {
+	LocalScanned  int64
+	RemoteScanned int64
+	Queued        int64
+	QueuedBytes   int64
+	Completed     int64
+	Bytes         int64
+	Elapsed       time.Duration
+	// Throughput is the average rate in bytes per second
+	Throughput float64
+	// ETA is zero until every file has been queued and the throughput is known
+	ETA time.Duration
+}
+
+// Snapshot reads the current counters and derives the throughput and ETA
+func (p *Progress) Snapshot() ProgressSnapshot {
+	s := ProgressSnapshot{
+		LocalScanned:  atomic.LoadInt64(&p.LocalScanned),
+		RemoteScanned: atomic.LoadInt64(&p.RemoteScanned),
+		Queued:        atomic.LoadInt64(&p.Queued),
+		QueuedBytes:   atomic.LoadInt64(&p.QueuedBytes),
+		Completed:     atomic.LoadInt64(&p.Completed),
+		Bytes:         atomic.LoadInt64(&p.Bytes),
+		Elapsed:       time.Since(p.start),
+	}
+
+	if s.Elapsed > 0 {
+		s.Throughput = float64(s.Bytes) / s.Elapsed.Seconds()
+	}
+	remaining := s.QueuedBytes - s.Bytes
+	if atomic.LoadInt32(&p.listed) == 1 && s.Throughput > 0 && remaining > 0 {
+		s.ETA = time.Duration(float64(remaining) / s.Throughput * float64(time.Second))
+	}
+
+	return s
+}
+
+// Report logs the progress every interval and, when live is set, redraws a single
+// status line on the terminal. The returned function stops reporting.
+func (p *Progress) Report(interval time.Duration, live bool) func() {
+	if interval <= 0 {
+		interval = defaultProgressInterval
+	}
+	done := make(chan bool)
+	stopped := make(chan bool)
+
+	go func() {
+		defer close(stopped)
+
+		logTicker := time.NewTicker(interval)
+		defer logTicker.Stop()
+
+		var draw <-chan time.Time
+		if live {
+			drawTicker := time.NewTicker(500 * time.Millisecond)
+			defer drawTicker.Stop()
+			draw = drawTicker.C
+		}
+
+		for {
+			select {
+			case <-done:
+				if live {
+					p.draw(os.Stdout)
+					fmt.Fprintln(os.Stdout)
+				}
+				return
+			case <-logTicker.C:
+				p.log()
+			case <-draw:
+				p.draw(os.Stdout)
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+	}
+}
+
+func (p *Progress) log() {
+	s := p.Snapshot()
+	logger.Info("Sync Progress",
+		zap.Int64("local files scanned", s.LocalScanned),
+		zap.Int64("remote files scanned", s.RemoteScanned),
+		zap.Int64("files queued", s.Queued),
+		zap.Int64("files completed", s.Completed),
+		zap.Int64("bytes transferred", s.Bytes),
+		zap.Int64("bytes queued", s.QueuedBytes),
+		zap.Float64("bytes per second", s.Throughput),
+		zap.Duration("eta", s.ETA),
+	)
+}
+
+func (p *Progress) draw(w io.Writer) {
+	s := p.Snapshot()
+	eta := "--"
+	if s.ETA > 0 {
+		eta = s.ETA.Round(time.Second).String()
+	}
+	fmt.Fprintf(w, "\r\033[K%d/%d files  %s/%s  %s/s  ETA %s  (scanned %d local, %d remote)",
+		s.Completed, s.Queued,
+		formatBytes(s.Bytes), formatBytes(s.QueuedBytes),
+		formatBytes(int64(s.Throughput)), eta,
+		s.LocalScanned, s.RemoteScanned,
+	)
+}
+
+// isTerminal reports whether the file is an interactive terminal
+func isTerminal(file *os.File) bool {
+	stat, err := file.Stat()
+	if err != nil {
+		return false
+	}
+
+	return stat.Mode()&os.ModeCharDevice != 0
+}
+
+// formatBytes renders a byte count using binary units
+func formatBytes(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%d B", n)
+	}
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+
+	return fmt.Sprintf("%.1f %ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
+
+// progressReader counts the bytes read through it towards a Progress
+type progressReader struct {
+	r        io.ReadSeeker
+	progress *Progress
+	n        int64
+}
+
+func (p *progressReader) Read(b []byte) (int, error) {
+	n, err := p.r.Read(b)
+	p.add(n)
+
+	return n, err
+}
+
+func (p *progressReader) Seek(offset int64, whence int) (int64, error) {
+	return p.r.Seek(offset, whence)
+}
+
+func (p *progressReader) add(n int) {
+	atomic.AddInt64(&p.n, int64(n))
+	p.progress.transferred(int64(n))
+}
+
+// rollback removes the bytes counted by a failed attempt, since they will be sent again
+func (p *progressReader) rollback() {
+	p.progress.transferred(-atomic.SwapInt64(&p.n, 0))
+}
+
+// progressWriter counts the bytes written through it towards a Progress
+type progressWriter struct {
+	w        io.Writer
+	progress *Progress
+}
+
+func (p *progressWriter) Write(b []byte) (int, error) {
+	n, err := p.w.Write(b)
+	p.progress.transferred(int64(n))
+
+	return n, err
+}
@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestProgressSnapshot(t *testing.T) {
+	progress := NewProgress()
+	progress.start = time.Now().Add(-10 * time.Second)
+
+	for range progress.countScanned(fileStats(&FileStat{Name: "a"}, &FileStat{Name: "b"}), &progress.LocalScanned) {
+	}
+	progress.queued(&FileStat{Size: 1000})
+	progress.queued(&FileStat{Size: 1000})
+	progress.transferred(500)
+	progress.finished()
+
+	s := progress.Snapshot()
+	if s.LocalScanned != 2 || s.Queued != 2 || s.QueuedBytes != 2000 || s.Completed != 1 {
+		t.Errorf("unexpected counters %+v", s)
+	}
+	if s.ETA != 0 {
+		t.Error("an ETA should not be given before every file has been queued")
+	}
+
+	progress.doneListing()
+	s = progress.Snapshot()
+	// 500 bytes in 10 seconds leaves 1500 bytes at 50 bytes per second
+	if s.ETA < 29*time.Second || s.ETA > 31*time.Second {
+		t.Errorf("expected an ETA of about 30s, got %v", s.ETA)
+	}
+
+	var line bytes.Buffer
+	progress.draw(&line)
+	if !strings.Contains(line.String(), "1/2 files") {
+		t.Errorf("unexpected progress line %q", line.String())
+	}
+}
+
+func TestProgressReaderRollback(t *testing.T) {
+	progress := NewProgress()
+	reader := &progressReader{r: bytes.NewReader(make([]byte, 100)), progress: progress}
+
+	ioutil.ReadAll(reader)
+	if progress.Bytes != 100 {
+		t.Errorf("expected 100 bytes to be counted, got %d", progress.Bytes)
+	}
+
+	reader.rollback()
+	if progress.Bytes != 0 {
+		t.Errorf("a failed attempt should not count towards the progress, got %d", progress.Bytes)
+	}
+}
+
+func TestFormatBytes(t *testing.T) {
+	cases := map[int64]string{
+		512:             "512 B",
+		2048:            "2.0 KiB",
+		5 * 1024 * 1024: "5.0 MiB",
+	}
+	for n, expected := range cases {
+		if formatBytes(n) != expected {
+			t.Errorf("expected %d to format as %s, got %s", n, expected, formatBytes(n))
+		}
+	}
+}
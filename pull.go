@@ -0,0 +1,306 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"go.uber.org/zap"
+)
+
+// partialSuffix marks files that are still being downloaded. The ETag of the object
+// is appended so that a partial download is only resumed from the same object.
+const partialSuffix = ".jetpart-"
+
+// PullUploads downloads every object under the uploads prefix that is missing locally
+// or differs from the local copy into the uploads directory of the environment
+func PullUploads(config Config, environment Environment) error {
+	err := loadAwsConfigFile()
+	if err != nil {
+		return err
+	}
+
+	s3config, err := newS3Config(config, config.S3.BucketPrefix+"/")
+	if err != nil {
+		return err
+	}
+
+	uploadsPath := path.Join(GetWorkingDirectory(), environment.UploadsLocation)
+	err = os.MkdirAll(uploadsPath, 0755)
+	if err != nil {
+		return err
+	}
+
+	matcher, err := NewIgnoreMatcher(config.Uploads.Exclude, path.Join(uploadsPath, IgnoreFileName), config.Uploads.Include)
+	if err != nil {
+		return err
+	}
+
+	start := time.Now()
+	summary := &SyncSummary{}
+	progress := s3config.Progress
+
+	stop := reportProgress(config, s3config)
+
+	local := excludeFiles(progress.countScanned(loadLocalFiles(uploadsPath), &progress.LocalScanned), matcher)
+	remote := excludeFiles(progress.countScanned(loadS3Files(s3config, 50000), &progress.RemoteScanned), matcher)
+
+	hashes := loadHashCache(path.Join(jetDirectory(), "upload-hashes.json"))
+	same := func(local, remote *FileStat) bool {
+		etag, err := hashes.etag(local, remote.ETag, s3config.PartSize)
+		if err != nil {
+			logger.Warn("Could not checksum local file", zap.String("file", local.Path), zap.Error(err))
+			return false
+		}
+		return etag == strings.Trim(remote.ETag, `"`)
+	}
+	files := compareRemote(local, remote, summary, same)
+
+	if dryRun {
+		planSync(files, summary)
+	} else {
+		downloadFiles(s3config, uploadsPath, files, summary)
+	}
+	stop()
+
+	err = hashes.save()
+	if err != nil {
+		logger.Warn("Could not save the upload checksum cache", zap.Error(err))
+	}
+
+	summary.Duration = time.Since(start)
+	logger.Info("S3 Pull Summary",
+		zap.String("bucket", s3config.Bucket),
+		zap.String("prefix", s3config.BucketPrefix),
+		zap.String("destination", uploadsPath),
+		zap.Bool("dry run", dryRun),
+		zap.Int("downloaded", summary.Downloaded),
+		zap.Int("skipped", summary.Skipped),
+		zap.Int("excluded", summary.Excluded),
+		zap.Int("failed", summary.Failed),
+		zap.Int64("bytes", summary.Bytes),
+		zap.Duration("duration", summary.Duration),
+	)
+
+	return summary.Err()
+}
+
+// compareRemote is the reverse of compare, it sends every remote object that is
+// missing locally or differs from the local copy. Modification times are not
+// compared, since a host that pushed its own uploads has older copies than the bucket.
+func compareRemote(foundLocal, foundRemote chan *FileStat, summary *SyncSummary, same func(local, remote *FileStat) bool) chan *FileStat {
+	download := make(chan *FileStat, 8)
+
+	go func() {
+		defer close(download)
+
+		localFiles := make(map[string]*FileStat)
+		for r := range foundLocal {
+			if r.Err != nil {
+				// Without a complete local listing we would download files we already have
+				download <- r
+				for range foundLocal {
+				}
+				for range foundRemote {
+				}
+				return
+			}
+			if r.ExcludedBy != "" {
+				summary.excluded(r)
+				continue
+			}
+			localFiles[r.Name] = r
+		}
+
+		for remote := range foundRemote {
+			if remote.Err != nil {
+				download <- remote
+				for range foundRemote {
+				}
+				return
+			}
+			if remote.ExcludedBy != "" {
+				summary.excluded(remote)
+				continue
+			}
+			// Folders created in the S3 console are zero byte objects ending with a slash
+			if remote.Name == "" || strings.HasSuffix(remote.Name, "/") {
+				continue
+			}
+
+			local, ok := localFiles[remote.Name]
+			if !ok || local.Size != remote.Size || !same(local, remote) {
+				download <- remote
+				continue
+			}
+			summary.skipped(remote)
+		}
+	}()
+
+	return download
+}
+
+func downloadFiles(config *S3Config, basePath string, in chan *FileStat, summary *SyncSummary) {
+	concurrency := config.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
+	sem := make(chan bool, concurrency)
+	var wg sync.WaitGroup
+
+	for file := range in {
+		if file.Err != nil {
+			logger.Error("Could not list files to pull", zap.Error(file.Err))
+			summary.failed(file.Err)
+			continue
+		}
+
+		config.Progress.queued(file)
+
+		sem <- true
+		wg.Add(1)
+		go func(file *FileStat) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			defer config.Progress.finished()
+
+			attempts, err := defaultRetryPolicy.Do(func() error {
+				return download(config, basePath, file)
+			}, isTransientS3Error)
+			if err != nil {
+				logger.Warn("Failed to download file",
+					zap.String("file", file.Name),
+					zap.Int("attempts", attempts),
+					zap.Error(err),
+				)
+				summary.failed(fmt.Errorf("%s: %v", file.Name, err))
+				return
+			}
+			summary.downloaded(file)
+		}(file)
+	}
+	config.Progress.doneListing()
+
+	wg.Wait()
+}
+
+// download fetches a single object into a partial file next to its destination,
+// resuming from whatever an earlier attempt already wrote, then moves it into place
+// and gives it the modification time of the object
+func download(config *S3Config, basePath string, remote *FileStat) error {
+	target := filepath.Join(basePath, filepath.FromSlash(remote.Name))
+	if !strings.HasPrefix(target, filepath.Clean(basePath)+string(filepath.Separator)) {
+		return errors.New("object key points outside of the uploads directory")
+	}
+
+	err := os.MkdirAll(filepath.Dir(target), 0755)
+	if err != nil {
+		return err
+	}
+
+	etag := strings.Trim(remote.ETag, `"`)
+	partial := target + partialSuffix + etag
+	err = removeStalePartials(target, partial)
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(partial, os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	offset := stat.Size()
+	if offset > remote.Size || etag == "" {
+		offset = 0
+	}
+	err = file.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return err
+	}
+
+	if offset < remote.Size {
+		input := &s3.GetObjectInput{
+			Bucket: aws.String(config.Bucket),
+			Key:    aws.String(remote.Path),
+		}
+		if etag != "" {
+			input.IfMatch = aws.String(remote.ETag)
+		}
+		if offset > 0 {
+			input.Range = aws.String(fmt.Sprintf("bytes=%d-", offset))
+		}
+
+		object, err := config.S3Service.GetObject(input)
+		if err != nil {
+			if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() == 412 {
+				os.Remove(partial)
+				return errors.New("object changed while it was being pulled")
+			}
+			return err
+		}
+		defer object.Body.Close()
+
+		_, err = io.Copy(&progressWriter{w: file, progress: config.Progress}, object.Body)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = file.Sync()
+	if err != nil {
+		return err
+	}
+	err = file.Close()
+	if err != nil {
+		return err
+	}
+
+	err = os.Rename(partial, target)
+	if err != nil {
+		return err
+	}
+
+	return os.Chtimes(target, remote.ModTime, remote.ModTime)
+}
+
+// removeStalePartials removes partial downloads of an older version of the object
+func removeStalePartials(target string, keep string) error {
+	entries, err := ioutil.ReadDir(filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+
+	prefix := filepath.Base(target) + partialSuffix
+	for _, entry := range entries {
+		name := filepath.Join(filepath.Dir(target), entry.Name())
+		if !strings.HasPrefix(entry.Name(), prefix) || name == keep {
+			continue
+		}
+		err = os.Remove(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,182 @@
+package main
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/hex"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+)
+
+type fakeS3 struct {
+	s3iface.S3API
+	objects map[string][]byte
+	ranges  []string
+}
+
+func (f *fakeS3) GetObject(input *s3.GetObjectInput) (*s3.GetObjectOutput, error) {
+	data := f.objects[aws.StringValue(input.Key)]
+	if input.Range != nil {
+		f.ranges = append(f.ranges, *input.Range)
+		offset, _ := strconv.Atoi(strings.TrimSuffix(strings.TrimPrefix(*input.Range, "bytes="), "-"))
+		data = data[offset:]
+	}
+
+	return &s3.GetObjectOutput{Body: ioutil.NopCloser(bytes.NewReader(data))}, nil
+}
+
+func (f *fakeS3) HeadObject(input *s3.HeadObjectInput) (*s3.HeadObjectOutput, error) {
+	data := f.objects[aws.StringValue(input.Key)]
+
+	return &s3.HeadObjectOutput{
+		ContentLength: aws.Int64(int64(len(data))),
+		ETag:          aws.String(`"fake"`),
+		LastModified:  aws.Time(time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)),
+	}, nil
+}
+
+func (f *fakeS3) DeleteObject(input *s3.DeleteObjectInput) (*s3.DeleteObjectOutput, error) {
+	delete(f.objects, aws.StringValue(input.Key))
+
+	return &s3.DeleteObjectOutput{}, nil
+}
+
+func (f *fakeS3) ListObjectsV2Pages(input *s3.ListObjectsV2Input, fn func(*s3.ListObjectsV2Output, bool) bool) error {
+	var keys []string
+	for key := range f.objects {
+		if strings.HasPrefix(key, aws.StringValue(input.Prefix)) {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+
+	page := &s3.ListObjectsV2Output{}
+	for _, key := range keys {
+		page.Contents = append(page.Contents, &s3.Object{
+			Key:  aws.String(key),
+			Size: aws.Int64(int64(len(f.objects[key]))),
+		})
+	}
+	fn(page, true)
+
+	return nil
+}
+
+func TestCompareRemote(t *testing.T) {
+	now := time.Now()
+	local := fileStats(
+		&FileStat{Name: "pulled.jpg", Size: 10, ModTime: now.Add(-time.Hour), ETag: "same"},
+		&FileStat{Name: "changed.jpg", Size: 10, ModTime: now, ETag: "old"},
+	)
+	remote := fileStats(
+		&FileStat{Name: "pulled.jpg", Size: 10, ModTime: now, ETag: `"same"`},
+		&FileStat{Name: "changed.jpg", Size: 10, ModTime: now.Add(-time.Hour), ETag: `"new"`},
+		&FileStat{Name: "missing.jpg", Size: 10, ModTime: now},
+		&FileStat{Name: "2018/", Size: 0, ModTime: now},
+	)
+	same := func(local, remote *FileStat) bool {
+		return local.ETag == strings.Trim(remote.ETag, `"`)
+	}
+
+	summary := &SyncSummary{}
+	var names []string
+	for file := range compareRemote(local, remote, summary, same) {
+		names = append(names, file.Name)
+	}
+
+	// A copy older than the object is only pulled when its contents differ
+	if strings.Join(names, ",") != "changed.jpg,missing.jpg" {
+		t.Errorf("expected changed.jpg and missing.jpg to be pulled, got %v", names)
+	}
+	if summary.Skipped != 1 {
+		t.Errorf("expected 1 skipped file, got %d", summary.Skipped)
+	}
+}
+
+func TestLocalETag(t *testing.T) {
+	file, err := ioutil.TempFile("", "jetetag")
+	if err != nil {
+		t.Fatal("unable to create a temporary file: ", err.Error())
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("0123456789")
+	file.Close()
+
+	etag, err := localETag(file.Name(), 0)
+	if err != nil || etag != "781e5e245d69b566979b86e28d23f2c7" {
+		t.Errorf("expected the MD5 of the file, got %s: %v", etag, err)
+	}
+
+	var digests []byte
+	for _, part := range []string{"0123", "4567", "89"} {
+		sum := md5.Sum([]byte(part))
+		digests = append(digests, sum[:]...)
+	}
+	sum := md5.Sum(digests)
+	etag, err = localETag(file.Name(), 4)
+	if err != nil || etag != hex.EncodeToString(sum[:])+"-3" {
+		t.Errorf("expected the ETag of a three part upload, got %s: %v", etag, err)
+	}
+}
+
+func TestDownloadResumesPartialFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetpull")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	content := []byte("the quick brown fox jumps over the lazy dog")
+	service := &fakeS3{objects: map[string][]byte{"uploads/2018/fox.txt": content}}
+	config := &S3Config{S3Service: service, Bucket: "bucket", BucketPrefix: "uploads/"}
+	modTime := time.Date(2018, 5, 1, 12, 0, 0, 0, time.UTC)
+	remote := &FileStat{
+		Name:    "2018/fox.txt",
+		Path:    "uploads/2018/fox.txt",
+		Size:    int64(len(content)),
+		ModTime: modTime,
+		ETag:    `"abc123"`,
+	}
+
+	target := filepath.Join(dir, "2018", "fox.txt")
+	os.MkdirAll(filepath.Dir(target), 0755)
+	ioutil.WriteFile(target+partialSuffix+"abc123", content[:10], 0644)
+	ioutil.WriteFile(target+partialSuffix+"oldetag", []byte("stale"), 0644)
+
+	err = download(config, dir, remote)
+	if err != nil {
+		t.Fatal("unable to download the file: ", err.Error())
+	}
+
+	downloaded, err := ioutil.ReadFile(target)
+	if err != nil || !bytes.Equal(downloaded, content) {
+		t.Errorf("expected the resumed file to be complete, got %q", downloaded)
+	}
+	if len(service.ranges) != 1 || service.ranges[0] != "bytes=10-" {
+		t.Errorf("expected the download to resume from byte 10, got %v", service.ranges)
+	}
+	if _, err := os.Stat(target + partialSuffix + "oldetag"); !os.IsNotExist(err) {
+		t.Error("partial downloads of other versions should be removed")
+	}
+	stat, _ := os.Stat(target)
+	if !stat.ModTime().Equal(modTime) {
+		t.Errorf("expected the modification time to be preserved, got %v", stat.ModTime())
+	}
+}
+
+func TestDownloadRejectsKeysOutsideUploads(t *testing.T) {
+	err := download(&S3Config{}, os.TempDir(), &FileStat{Name: "../../etc/passwd"})
+	if err == nil {
+		t.Error("keys escaping the uploads directory should be rejected")
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"os"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// RetryPolicy describes how many times and how patiently a failing operation is retried
+type RetryPolicy struct {
+	Attempts int
+	Delay    time.Duration
+	MaxDelay time.Duration
+}
+
+// defaultRetryPolicy is used whenever a step does not configure its own policy
+var defaultRetryPolicy = RetryPolicy{
+	Attempts: 4,
+	Delay:    500 * time.Millisecond,
+	MaxDelay: 10 * time.Second,
+}
+
+// Do calls fn until it succeeds, fails with an error that transient reports as
+// permanent, or runs out of attempts. The delay between attempts doubles each time.
+// It returns the number of attempts made along with the last error.
+func (p RetryPolicy) Do(fn func() error, transient func(error) bool) (int, error) {
+	attempts := p.Attempts
+	if attempts < 1 {
+		attempts = 1
+	}
+	delay := p.Delay
+
+	var err error
+	for i := 1; i <= attempts; i++ {
+		err = fn()
+		if err == nil || i == attempts || !transient(err) {
+			return i, err
+		}
+
+		time.Sleep(delay)
+		delay *= 2
+		if p.MaxDelay > 0 && delay > p.MaxDelay {
+			delay = p.MaxDelay
+		}
+	}
+
+	return attempts, err
+}
+
+// isTransientS3Error reports whether an S3 error is worth retrying. Problems reading
+// the local file are never transient.
+func isTransientS3Error(err error) bool {
+	if awsErr, ok := err.(awserr.Error); ok && awsErr.OrigErr() != nil {
+		if _, ok := awsErr.OrigErr().(*os.PathError); ok {
+			return false
+		}
+	}
+	if _, ok := err.(*os.PathError); ok {
+		return false
+	}
+	if request.IsErrorRetryable(err) || request.IsErrorThrottle(err) {
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok {
+		return reqErr.StatusCode() >= 500
+	}
+
+	return false
+}
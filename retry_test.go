@@ -0,0 +1,58 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+)
+
+func TestRetryPolicyDo(t *testing.T) {
+	policy := RetryPolicy{Attempts: 3, Delay: time.Millisecond}
+	transient := func(error) bool { return true }
+
+	calls := 0
+	attempts, err := policy.Do(func() error {
+		calls++
+		if calls < 2 {
+			return errors.New("connection reset")
+		}
+		return nil
+	}, transient)
+	if err != nil || attempts != 2 {
+		t.Errorf("expected success on attempt 2, got attempt %d with error %v", attempts, err)
+	}
+
+	attempts, err = policy.Do(func() error {
+		return errors.New("still broken")
+	}, transient)
+	if err == nil || attempts != 3 {
+		t.Errorf("expected failure after 3 attempts, got attempt %d with error %v", attempts, err)
+	}
+
+	attempts, _ = policy.Do(func() error {
+		return errors.New("permanent")
+	}, func(error) bool { return false })
+	if attempts != 1 {
+		t.Errorf("permanent errors should not be retried, got %d attempts", attempts)
+	}
+}
+
+func TestIsTransientS3Error(t *testing.T) {
+	serverError := awserr.NewRequestFailure(awserr.New("InternalError", "try again", nil), 503, "id")
+	if !isTransientS3Error(serverError) {
+		t.Error("5xx responses should be retried")
+	}
+
+	denied := awserr.NewRequestFailure(awserr.New("AccessDenied", "denied", nil), 403, "id")
+	if isTransientS3Error(denied) {
+		t.Error("access denied should not be retried")
+	}
+
+	_, err := os.Open("testdata/missing")
+	if isTransientS3Error(err) {
+		t.Error("local file errors should not be retried")
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// Artifacts kept in the directory of a run
+const (
+	stagingDumpFile          = "staging_dump.sql"
+	persistentTablesDumpFile = "persistent_tables_dump.sql"
+	uploadsManifestFile      = "uploads_manifest.json"
+	backupManifestFile       = "backup_manifest.json"
+	transferManifestFile     = "transfer_manifest.json"
+	runLogFile               = "jet.log"
+	runJournalFile           = "journal.jsonl"
+)
+
+// defaultRunsDirectory is where run directories are kept, relative to the root of
+// an environment, when the config does not say otherwise
+const defaultRunsDirectory = ".jet/runs"
+
+// defaultKeepRuns is how many run directories are kept when the config does not say
+const defaultKeepRuns = 5
+
+// RunsConfig describes where the artifacts of each run are kept
+type RunsConfig struct {
+	// Directory holds a directory per run, relative to the root of the environment
+	// unless it is absolute
+	Directory string `json:"directory"`
+	// Keep is how many of the most recent run directories are kept
+	Keep int `json:"keep"`
+}
+
+// Run is the context of a single deploy. Every artifact of the deploy, from the
+// database dumps to its log, is kept in its own directory so that runs never
+// overwrite or pick up each other's files.
+type Run struct {
+	Name      string
+	Directory string
+
+	log *os.File
+}
+
+// runsDirectory returns the directory holding the runs of an environment rooted at root
+func runsDirectory(config Config, root string) string {
+	directory := config.Runs.Directory
+	if directory == "" {
+		directory = defaultRunsDirectory
+	}
+	if path.IsAbs(directory) {
+		return directory
+	}
+
+	return path.Join(root, directory)
+}
+
+// NewRun creates the directory of a run, or opens it again when the run already has one
+func NewRun(config Config, name string) (*Run, error) {
+	if name == "" || name == "." || name == ".." || strings.ContainsAny(name, `/\`) {
+		return nil, errors.New("invalid backup name: " + name)
+	}
+
+	run := &Run{
+		Name:      name,
+		Directory: path.Join(runsDirectory(config, GetWorkingDirectory()), name),
+	}
+
+	// Dumps hold the whole database, so only the deploying user may read them
+	err := os.MkdirAll(run.Directory, 0700)
+	if err != nil {
+		return nil, err
+	}
+
+	return run, nil
+}
+
+// Path returns where an artifact of the run is kept
+func (r *Run) Path(artifact string) string {
+	return path.Join(r.Directory, artifact)
+}
+
+// remotePath returns where an artifact of the run is kept on an environment
+func (r *Run) remotePath(config Config, environment Environment, artifact string) string {
+	return path.Join(runsDirectory(config, environment.RootDirectory), r.Name, artifact)
+}
+
+// JournalEntry is a step of a run that completed
+type JournalEntry struct {
+	Step      string    `json:"step"`
+	Completed time.Time `json:"completed"`
+}
+
+// Complete appends a step to the journal of the run once it has completed, so that
+// a failed run shows which steps it got through
+func (r *Run) Complete(step string) error {
+	data, err := json.Marshal(JournalEntry{Step: step, Completed: time.Now().UTC()})
+	if err != nil {
+		return err
+	}
+
+	file, err := os.OpenFile(r.Path(runJournalFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(data, '\n'))
+	if err == nil {
+		err = file.Sync()
+	}
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+
+	return err
+}
+
+// Journal returns the completed steps of the run, in the order they completed
+func (r *Run) Journal() ([]JournalEntry, error) {
+	file, err := os.Open(r.Path(runJournalFile))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []JournalEntry
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry JournalEntry
+		// A line cut short by a crash is the last one and is left out
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+
+	return entries, scanner.Err()
+}
+
+// StartLog copies everything logged from now on to the log file of the run
+func (r *Run) StartLog() error {
+	file, err := os.OpenFile(r.Path(runLogFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	r.log = file
+
+	fileCore := zapcore.NewCore(
+		zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig()),
+		zapcore.AddSync(file),
+		zapcore.InfoLevel,
+	)
+	logger = logger.WithOptions(zap.WrapCore(func(core zapcore.Core) zapcore.Core {
+		return zapcore.NewTee(core, redactCore(fileCore))
+	}))
+
+	return nil
+}
+
+// Close stops copying the log to the run directory
+func (r *Run) Close() {
+	if r.log != nil {
+		logger.Sync()
+		r.log.Close()
+	}
+}
+
+// keep returns how many of the most recent runs are kept
+func (c RunsConfig) keep() int {
+	if c.Keep <= 0 {
+		return defaultKeepRuns
+	}
+
+	return c.Keep
+}
+
+// CleanupRuns removes all but the most recent run directories, never the current one
+func CleanupRuns(config Config, current *Run) error {
+	keep := config.Runs.keep()
+
+	directory := path.Dir(current.Directory)
+	entries, err := ioutil.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+
+	var runs []os.FileInfo
+	for _, entry := range entries {
+		if entry.IsDir() && entry.Name() != current.Name {
+			runs = append(runs, entry)
+		}
+	}
+	sort.Slice(runs, func(i, j int) bool {
+		return runs[i].ModTime().After(runs[j].ModTime())
+	})
+
+	// The current run is one of the runs that are kept
+	for i, run := range runs {
+		if i < keep-1 {
+			continue
+		}
+		err = os.RemoveAll(path.Join(directory, run.Name()))
+		if err != nil {
+			return err
+		}
+		logger.Debug("Removed old run directory", zap.String("run", run.Name()))
+	}
+
+	return nil
+}
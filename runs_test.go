@@ -0,0 +1,118 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testRun points the runs of config at a temporary directory and creates a run in
+// it holding an empty file for every artifact
+func testRun(t *testing.T, config *Config, name string, artifacts ...string) *Run {
+	dir, err := ioutil.TempDir("", "jetruns")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	config.Runs.Directory = dir
+
+	run, err := NewRun(*config, name)
+	if err != nil {
+		t.Fatal("unable to create the run: ", err.Error())
+	}
+	for _, artifact := range artifacts {
+		ioutil.WriteFile(run.Path(artifact), nil, 0600)
+	}
+
+	return run
+}
+
+func TestNewRun(t *testing.T) {
+	config := &Config{}
+	run := testRun(t, config, "2018-05-1_12-0-0")
+	defer os.RemoveAll(config.Runs.Directory)
+
+	if run.Path(stagingDumpFile) != filepath.Join(config.Runs.Directory, "2018-05-1_12-0-0", stagingDumpFile) {
+		t.Error("expected the dump in the run directory, got ", run.Path(stagingDumpFile))
+	}
+	stat, err := os.Stat(run.Directory)
+	if err != nil || stat.Mode().Perm() != 0700 {
+		t.Error("expected the run directory to be private")
+	}
+
+	for _, name := range []string{"", ".", "..", "../escape", "a/b"} {
+		_, err := NewRun(*config, name)
+		if err == nil {
+			t.Errorf("expected %q to be rejected as a backup name", name)
+		}
+	}
+
+	production := Environment{RootDirectory: "/var/www/site"}
+	config.Runs.Directory = ""
+	if run.remotePath(*config, production, stagingDumpFile) != "/var/www/site/.jet/runs/2018-05-1_12-0-0/staging_dump.sql" {
+		t.Error("expected the remote dump in the run directory under the root of the environment")
+	}
+}
+
+func TestCleanupRuns(t *testing.T) {
+	config := &Config{}
+	current := testRun(t, config, "current")
+	defer os.RemoveAll(config.Runs.Directory)
+	config.Runs.Keep = 3
+
+	old := time.Now().Add(-time.Hour)
+	for i, name := range []string{"oldest", "older", "old", "recent"} {
+		directory := filepath.Join(config.Runs.Directory, name)
+		os.Mkdir(directory, 0700)
+		modified := old.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(directory, modified, modified)
+	}
+
+	err := CleanupRuns(*config, current)
+	if err != nil {
+		t.Fatal("unable to clean up the runs: ", err.Error())
+	}
+
+	entries, _ := ioutil.ReadDir(config.Runs.Directory)
+	var kept []string
+	for _, entry := range entries {
+		kept = append(kept, entry.Name())
+	}
+	if len(kept) != 3 || kept[0] != "current" || kept[1] != "old" || kept[2] != "recent" {
+		t.Error("expected the current run and the two most recent ones to be kept, got ", kept)
+	}
+}
+
+func TestRunJournal(t *testing.T) {
+	config := &Config{}
+	run := testRun(t, config, "2018-05-1_12-0-0")
+	defer os.RemoveAll(config.Runs.Directory)
+
+	journal, err := run.Journal()
+	if err != nil || len(journal) != 0 {
+		t.Errorf("expected an empty journal, got %v: %v", journal, err)
+	}
+
+	for _, step := range []string{"dump persistent tables", "restore database"} {
+		err = run.Complete(step)
+		if err != nil {
+			t.Fatal("unable to record the step: ", err.Error())
+		}
+	}
+	// A crash while a step was being recorded leaves a partial line behind
+	file, _ := os.OpenFile(run.Path(runJournalFile), os.O_WRONLY|os.O_APPEND, 0600)
+	file.WriteString(`{"step":"restore pers`)
+	file.Close()
+
+	journal, err = run.Journal()
+	if err != nil {
+		t.Fatal("unable to read the journal: ", err.Error())
+	}
+	if len(journal) != 2 || journal[0].Step != "dump persistent tables" || journal[1].Step != "restore database" {
+		t.Errorf("expected the completed steps in order, got %+v", journal)
+	}
+	if journal[0].Completed.IsZero() {
+		t.Error("expected the completion time to be recorded")
+	}
+}
@@ -3,98 +3,300 @@ package main
 import (
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"net/url"
 	"os"
 	"path"
 	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+	"go.uber.org/zap"
 )
 
-// SyncUploads syncs the local filesystem with S3
-func SyncUploads(config Config) error {
+// SyncUploads syncs the local filesystem with S3 and records the result in a
+// manifest named after the backup, a copy of which is kept in the run directory
+func SyncUploads(config Config, run *Run) error {
 	err := loadAwsConfigFile()
 	if err != nil {
 		return err
 	}
 
-	local := loadLocalFiles(path.Join(GetWorkingDirectory(), config.Environments.Staging.UploadsLocation))
-
-	s3URL, err := url.Parse(config.S3.URL)
+	s3config, err := newS3Config(config, config.S3.BucketPrefix+"/")
 	if err != nil {
-		return errors.New("could not parse the s3uri")
-	}
-	if s3URL.Scheme != "s3" {
-		return errors.New("s3uri argument does not have valid protocol, should be 's3'")
+		return err
 	}
-	if s3URL.Host == "" {
-		return errors.New("s3uri is missing bucket name")
+
+	uploadsPath := path.Join(GetWorkingDirectory(), config.Environments.Staging.UploadsLocation)
+	matcher, err := NewIgnoreMatcher(config.Uploads.Exclude, path.Join(uploadsPath, IgnoreFileName), config.Uploads.Include)
+	if err != nil {
+		return err
 	}
+	s3config.Matcher = matcher
 
-	sess, err := getSession(config.S3.Region)
+	scanner, err := NewScanner(config.Uploads.Scan, path.Join(jetDirectory(), "quarantine"))
 	if err != nil {
 		return err
 	}
+	s3config.Scanner = scanner
 
-	s3config := &S3Config{
-		S3Service:    s3.New(sess),
-		Bucket:       s3URL.Host,
-		BucketPrefix: config.S3.BucketPrefix + "/",
+	processor, err := NewImageProcessor(config.Uploads.Images, path.Join(jetDirectory(), "images"))
+	if err != nil {
+		return err
 	}
+	s3config.Processor = processor
 
-	remote := loadS3Files(s3config, 50000)
+	versioned := config.Uploads.Versioning
+	if versioned && !dryRun {
+		err = ensureVersioning(s3config)
+		if err != nil {
+			return err
+		}
+	}
 
-	files := compare(local, remote)
+	local := loadLocalFiles(uploadsPath)
 
-	syncFiles(s3config, files)
+	summary, err := syncWithS3(config, s3config, local)
+	if err != nil {
+		return err
+	}
+	// Clean files were published, but a deploy with a backdoor in it must not go ahead
+	err = scanner.Err()
+	if err != nil || dryRun {
+		return err
+	}
 
-	return nil
+	return writeUploadsManifest(s3config, run, summary.Synced, versioned)
 }
 
-// SyncDatabaseBackup syncs the database backup to S3
-func SyncDatabaseBackup(config Config, backupName string) error {
+// SyncDatabaseBackup syncs the database dump of the run to S3, encrypted when the
+// config says so, along with the manifest of the backup
+func SyncDatabaseBackup(config Config, run *Run) error {
 	err := loadAwsConfigFile()
 	if err != nil {
 		return err
 	}
 
-	local := loadLocalFiles(path.Join(GetWorkingDirectory(), "staging_dump.sql"))
+	s3config, err := newS3Config(config, backupsPrefix+run.Name+"/")
+	if err != nil {
+		return err
+	}
+
+	stored, manifest, err := prepareBackup(config, run)
+	if err != nil {
+		return err
+	}
+	local := loadLocalFiles(stored)
+
+	_, err = syncWithS3(config, s3config, local)
+	if err != nil || dryRun {
+		return err
+	}
+
+	return writeBackupManifest(s3config, manifest)
+}
+
+// SyncSummary describes the outcome of a sync between the local filesystem and S3
+type SyncSummary struct {
+	Uploaded   int
+	Downloaded int
+	Skipped    int
+	Excluded   int
+	Failed     int
+	Bytes      int64
+	Duration   time.Duration
+	Errors     []error
+	// Synced lists every file that is now up to date, whether it was transferred or not
+	Synced []*FileStat
+
+	mu sync.Mutex
+}
+
+// SyncError is returned when one or more files could not be synced
+type SyncError struct {
+	Errors []error
+}
+
+func (e *SyncError) Error() string {
+	messages := make([]string, 0, len(e.Errors))
+	for i, err := range e.Errors {
+		if i == 10 {
+			messages = append(messages, fmt.Sprintf("and %d more", len(e.Errors)-i))
+			break
+		}
+		messages = append(messages, err.Error())
+	}
+
+	return fmt.Sprintf("%d file(s) failed to sync: %s", len(e.Errors), strings.Join(messages, "; "))
+}
+
+func (s *SyncSummary) skipped(file *FileStat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Skipped++
+	s.Synced = append(s.Synced, file)
+}
+
+func (s *SyncSummary) excluded(file *FileStat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Excluded++
+
+	// The exclusions are the point of a dry run, otherwise they are only noise
+	log := logger.Debug
+	if dryRun {
+		log = logger.Info
+	}
+	log("Excluded file from sync",
+		zap.String("file", file.Name),
+		zap.String("location", file.Path),
+		zap.String("rule", file.ExcludedBy),
+	)
+}
+
+func (s *SyncSummary) uploaded(file *FileStat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Uploaded++
+	s.Bytes += file.Size
+	s.Synced = append(s.Synced, file)
+}
+
+func (s *SyncSummary) downloaded(file *FileStat) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Downloaded++
+	s.Bytes += file.Size
+	s.Synced = append(s.Synced, file)
+}
+
+func (s *SyncSummary) failed(err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.Failed++
+	s.Errors = append(s.Errors, err)
+}
+
+// Err returns a SyncError describing every failure, or nil when everything synced
+func (s *SyncSummary) Err() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.Errors) == 0 {
+		return nil
+	}
+
+	return &SyncError{Errors: s.Errors}
+}
 
+func newS3Config(config Config, prefix string) (*S3Config, error) {
 	s3URL, err := url.Parse(config.S3.URL)
 	if err != nil {
-		return errors.New("could not parse the s3uri")
+		return nil, errors.New("could not parse the s3uri")
 	}
 	if s3URL.Scheme != "s3" {
-		return errors.New("s3uri argument does not have valid protocol, should be 's3'")
+		return nil, errors.New("s3uri argument does not have valid protocol, should be 's3'")
 	}
 	if s3URL.Host == "" {
-		return errors.New("s3uri is missing bucket name")
+		return nil, errors.New("s3uri is missing bucket name")
 	}
 
 	sess, err := getSession(config.S3.Region)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	s3config := &S3Config{
-		S3Service:    s3.New(sess),
-		Bucket:       s3URL.Host,
-		BucketPrefix: "database_backups/" + backupName + "/",
+	service := s3.New(sess)
+	uploads := config.Uploads
+
+	concurrency := uploads.Concurrency
+	if concurrency < 1 {
+		concurrency = 5
 	}
 
-	remote := loadS3Files(s3config, 50000)
+	// A single uploader is shared by every file so that its part buffers are reused
+	uploader := s3manager.NewUploaderWithClient(service, func(u *s3manager.Uploader) {
+		if uploads.PartSize > 0 {
+			u.PartSize = uploads.PartSize
+		}
+		if uploads.PartConcurrency > 0 {
+			u.Concurrency = uploads.PartConcurrency
+		}
+	})
+
+	threshold := uploads.ResumableThreshold
+	if threshold == 0 {
+		threshold = defaultResumableThreshold
+	}
 
-	files := compare(local, remote)
+	return &S3Config{
+		S3Service:          service,
+		Uploader:           uploader,
+		Bucket:             s3URL.Host,
+		BucketPrefix:       prefix,
+		Concurrency:        concurrency,
+		PartSize:           uploads.PartSize,
+		PartConcurrency:    uploads.PartConcurrency,
+		ResumableThreshold: threshold,
+		StateDirectory:     path.Join(jetDirectory(), "multipart"),
+		Limiter:            NewBandwidthLimiter(uploads.BandwidthLimit),
+		Progress:           NewProgress(),
+	}, nil
+}
 
-	syncFiles(s3config, files)
+// reportProgress starts reporting the progress of a sync unless this is a dry run.
+// The returned function stops reporting.
+func reportProgress(config Config, s3config *S3Config) func() {
+	if dryRun || s3config.Progress == nil {
+		return func() {}
+	}
+	interval := time.Duration(config.Uploads.ProgressInterval) * time.Second
+	live := config.Uploads.LiveProgress && isTerminal(os.Stdout)
 
-	return nil
+	return s3config.Progress.Report(interval, live)
+}
+
+// syncWithS3 uploads every local file that is missing or out of date under the
+// configured bucket prefix and logs a summary of the run
+func syncWithS3(config Config, s3config *S3Config, local chan *FileStat) (*SyncSummary, error) {
+	start := time.Now()
+	summary := &SyncSummary{}
+
+	stop := reportProgress(config, s3config)
+
+	progress := s3config.Progress
+	local = excludeFiles(progress.countScanned(local, &progress.LocalScanned), s3config.Matcher)
+	local = s3config.Scanner.scanFiles(local)
+	local = s3config.Processor.processImages(local)
+	remote := excludeFiles(progress.countScanned(loadS3Files(s3config, 50000), &progress.RemoteScanned), s3config.Matcher)
+
+	files := compare(local, remote, summary)
+
+	if dryRun {
+		planSync(files, summary)
+	} else {
+		syncFiles(s3config, files, summary)
+	}
+	stop()
+
+	summary.Duration = time.Since(start)
+	logger.Info("S3 Sync Summary",
+		zap.String("bucket", s3config.Bucket),
+		zap.String("prefix", s3config.BucketPrefix),
+		zap.Bool("dry run", dryRun),
+		zap.Int("uploaded", summary.Uploaded),
+		zap.Int("skipped", summary.Skipped),
+		zap.Int("excluded", summary.Excluded),
+		zap.Int("failed", summary.Failed),
+		zap.Int64("bytes", summary.Bytes),
+		zap.Duration("duration", summary.Duration),
+	)
+
+	return summary, summary.Err()
 }
 
 func loadAwsConfigFile() error {
@@ -146,6 +348,7 @@ func loadLocalFiles(basePath string) chan *FileStat {
 				out <- &FileStat{
 					Err: err,
 				}
+				return nil
 			}
 
 			out <- &FileStat{
@@ -191,22 +394,28 @@ func loadS3Files(conf *S3Config, buffer int) chan *FileStat {
 }
 
 func listS3Files(config *S3Config, out chan *FileStat, token *string) *string {
-	list, err := config.S3Service.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket:            aws.String(config.Bucket),
-		Prefix:            aws.String(config.BucketPrefix),
-		ContinuationToken: token,
-	})
+	var list *s3.ListObjectsV2Output
+	_, err := defaultRetryPolicy.Do(func() error {
+		var err error
+		list, err = config.S3Service.ListObjectsV2(&s3.ListObjectsV2Input{
+			Bucket:            aws.String(config.Bucket),
+			Prefix:            aws.String(config.BucketPrefix),
+			ContinuationToken: token,
+		})
+		return err
+	}, isTransientS3Error)
 	if err != nil {
-		out <- &FileStat{Err: err}
+		out <- &FileStat{Err: fmt.Errorf("listing s3://%s/%s: %v", config.Bucket, config.BucketPrefix, err)}
 		return nil
 	}
 
 	for _, object := range list.Contents {
 		out <- &FileStat{
-			Name:    strings.TrimPrefix(*object.Key, config.BucketPrefix+"/"),
+			Name:    strings.TrimPrefix(*object.Key, config.BucketPrefix),
 			Path:    *object.Key,
 			Size:    *object.Size,
 			ModTime: *object.LastModified,
+			ETag:    aws.StringValue(object.ETag),
 		}
 	}
 
@@ -228,34 +437,55 @@ func getSession(region string) (*session.Session, error) {
 	return sess, nil
 }
 
-func compare(foundLocal, foundRemote chan *FileStat) chan *FileStat {
+// compare sends every local file that is missing remotely or differs from its remote
+// copy. Errors from either listing are passed along so that they can be reported.
+// Excluded files are ignored on both sides, so an excluded object that already
+// exists in the bucket is neither overwritten nor considered for deletion.
+func compare(foundLocal, foundRemote chan *FileStat, summary *SyncSummary) chan *FileStat {
 	update := make(chan *FileStat, 8)
 
-	// first we sink the local files into a lookup map so its quick and easy to compare that to the remote
-	localFiles := make(map[string]*FileStat)
-	for r := range foundLocal {
-		if r.Err != nil {
-			log.Fatal(r.Err)
-			continue
-		}
-		localFiles[r.Name] = r
-	}
-
-	numRemoteFiles := 0
-
 	go func() {
 		defer close(update)
 
+		// first we sink the local files into a lookup map so its quick and easy to compare that to the remote
+		localFiles := make(map[string]*FileStat)
+		// An excluded file that is also in the bucket is counted once
+		excluded := make(map[string]bool)
+		for r := range foundLocal {
+			if r.Err != nil {
+				update <- r
+				continue
+			}
+			if r.ExcludedBy != "" {
+				excluded[r.Name] = true
+				summary.excluded(r)
+				continue
+			}
+			localFiles[r.Name] = r
+		}
+
 		for remote := range foundRemote {
 			if remote.Err != nil {
+				// Without a complete remote listing we cannot tell which files are up to date
+				update <- remote
+				for range foundRemote {
+				}
 				return
 			}
-			numRemoteFiles++
+			if remote.ExcludedBy != "" {
+				if !excluded[remote.Name] {
+					excluded[remote.Name] = true
+					summary.excluded(remote)
+				}
+				continue
+			}
 			if local, ok := localFiles[remote.Name]; ok {
 				if local.Size != remote.Size {
 					update <- local
 				} else if local.ModTime.After(remote.ModTime) {
 					update <- local
+				} else {
+					summary.skipped(local)
 				}
 				delete(localFiles, remote.Name)
 			}
@@ -269,33 +499,64 @@ func compare(foundLocal, foundRemote chan *FileStat) chan *FileStat {
 	return update
 }
 
-func syncFiles(config *S3Config, in chan *FileStat) {
-	concurrency := 5
+// planSync logs what a sync would upload without touching the bucket
+func planSync(in chan *FileStat, summary *SyncSummary) {
+	for file := range in {
+		if file.Err != nil {
+			summary.failed(file.Err)
+			continue
+		}
+		logger.Info("Would upload file",
+			zap.String("file", file.Name),
+			zap.Int64("size", file.Size),
+		)
+	}
+}
+
+func syncFiles(config *S3Config, in chan *FileStat, summary *SyncSummary) {
+	concurrency := config.Concurrency
+	if concurrency < 1 {
+		concurrency = 1
+	}
 	sem := make(chan bool, concurrency)
-	var numSyncedFiles int
+	var wg sync.WaitGroup
 
 	for file := range in {
+		if file.Err != nil {
+			logger.Error("Could not list files to sync", zap.Error(file.Err))
+			summary.failed(file.Err)
+			continue
+		}
+
+		config.Progress.queued(file)
+
 		// add one
 		sem <- true
+		wg.Add(1)
 		go func(config *S3Config, file *FileStat) {
-			err := upload(config, file)
+			defer wg.Done()
+			// remove one
+			defer func() { <-sem }()
+			defer config.Progress.finished()
+
+			attempts, err := defaultRetryPolicy.Do(func() error {
+				return upload(config, file)
+			}, isTransientS3Error)
 			if err != nil {
-				fmt.Println(err)
-			} else {
-				numSyncedFiles++
+				logger.Warn("Failed to upload file",
+					zap.String("file", file.Name),
+					zap.Int("attempts", attempts),
+					zap.Error(err),
+				)
+				summary.failed(fmt.Errorf("%s: %v", file.Name, err))
+				return
 			}
-			// remove one
-			<-sem
+			summary.uploaded(file)
 		}(config, file)
 	}
+	config.Progress.doneListing()
 
-	// After the last goroutine is fired, there are still concurrency amount of goroutines running. In order to make
-	// sure we wait for all of them to finish, we attempt to fill the semaphore back up to its capacity. Once that
-	// succeeds, we know that the last goroutine has read from the semaphore, as we've done len(files) + cap(sem) writes
-	// and len(files) reads off the channel.
-	for i := 0; i < cap(sem); i++ {
-		sem <- true
-	}
+	wg.Wait()
 }
 
 func upload(config *S3Config, fileStat *FileStat) error {
@@ -305,7 +566,7 @@ func upload(config *S3Config, fileStat *FileStat) error {
 	}
 	defer func() {
 		if err := file.Close(); err != nil {
-			fmt.Printf("Problem closing file %s: %v", fileStat.Path, err)
+			logger.Warn("Problem closing file", zap.String("file", fileStat.Path), zap.Error(err))
 		}
 	}()
 
@@ -323,19 +584,22 @@ func upload(config *S3Config, fileStat *FileStat) error {
 		contentType = http.DetectContentType(magicBytes)
 	}
 
-	key := filepath.Join(config.BucketPrefix, fileStat.Name)
-	key = strings.TrimPrefix(key, "/")
+	key := objectKey(config, fileStat.Name)
+
+	if config.ResumableThreshold > 0 && fileStat.Size >= config.ResumableThreshold {
+		return uploadResumable(config, file, fileStat, key, contentType)
+	}
 
-	// Create an uploader (can do multipart) with S3 client and default options
-	uploader := s3manager.NewUploaderWithClient(config.S3Service)
+	body := &progressReader{r: file, progress: config.Progress}
 	params := &s3manager.UploadInput{
 		Bucket:      aws.String(config.Bucket),
 		Key:         aws.String(key),
-		Body:        file,
+		Body:        config.Limiter.Reader(body),
 		ContentType: aws.String(contentType),
 	}
 
-	if _, err = uploader.Upload(params); err != nil {
+	if _, err = config.Uploader.Upload(params); err != nil {
+		body.rollback()
 		return err
 	}
 
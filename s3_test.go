@@ -1,7 +1,18 @@
 package main
 
 import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"sync"
 	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 func TestSyncUploads(t *testing.T) {
@@ -26,7 +37,10 @@ func TestSyncUploads(t *testing.T) {
 		},
 	}
 
-	err := SyncUploads(*config)
+	run := testRun(t, config, GenerateBackupString())
+	defer os.RemoveAll(config.Runs.Directory)
+
+	err := SyncUploads(*config, run)
 	if err != nil {
 		t.Error("there was a problem syncing uploads with s3: " + err.Error())
 	}
@@ -54,10 +68,139 @@ func TestSyncDatabaseBackup(t *testing.T) {
 		},
 	}
 
-	backupName := GenerateBackupString()
+	run := testRun(t, config, GenerateBackupString(), stagingDumpFile)
+	defer os.RemoveAll(config.Runs.Directory)
 
-	err := SyncDatabaseBackup(*config, backupName)
+	err := SyncDatabaseBackup(*config, run)
 	if err != nil {
 		t.Error("there was a problem syncing uploads with s3: " + err.Error())
 	}
 }
+
+func fileStats(files ...*FileStat) chan *FileStat {
+	out := make(chan *FileStat, len(files))
+	for _, file := range files {
+		out <- file
+	}
+	close(out)
+
+	return out
+}
+
+func TestCompare(t *testing.T) {
+	now := time.Now()
+	local := fileStats(
+		&FileStat{Name: "unchanged.jpg", Size: 10, ModTime: now.Add(-time.Hour)},
+		&FileStat{Name: "resized.jpg", Size: 20, ModTime: now.Add(-time.Hour)},
+		&FileStat{Name: "edited.jpg", Size: 30, ModTime: now},
+		&FileStat{Name: "new.jpg", Size: 40, ModTime: now},
+		&FileStat{Name: "debug.log", Size: 50, ModTime: now, ExcludedBy: "*.log (config exclude)"},
+	)
+	remote := fileStats(
+		&FileStat{Name: "unchanged.jpg", Size: 10, ModTime: now},
+		&FileStat{Name: "resized.jpg", Size: 25, ModTime: now},
+		&FileStat{Name: "edited.jpg", Size: 30, ModTime: now.Add(-time.Hour)},
+		&FileStat{Name: "debug.log", Size: 50, ModTime: now, ExcludedBy: "*.log (config exclude)"},
+	)
+
+	summary := &SyncSummary{}
+	var updated []string
+	for file := range compare(local, remote, summary) {
+		if file.Err != nil {
+			t.Error("unexpected error comparing files: ", file.Err.Error())
+			continue
+		}
+		updated = append(updated, file.Name)
+	}
+	sort.Strings(updated)
+
+	expected := []string{"edited.jpg", "new.jpg", "resized.jpg"}
+	if !reflect.DeepEqual(updated, expected) {
+		t.Errorf("expected %v to be updated, got %v", expected, updated)
+	}
+	if summary.Skipped != 1 {
+		t.Errorf("expected 1 skipped file, got %d", summary.Skipped)
+	}
+	if summary.Excluded != 1 {
+		t.Errorf("expected 1 excluded file, got %d", summary.Excluded)
+	}
+}
+
+func TestCompareRemoteError(t *testing.T) {
+	local := fileStats(&FileStat{Name: "new.jpg", Size: 40})
+	remote := fileStats(&FileStat{Err: errors.New("access denied")})
+
+	summary := &SyncSummary{}
+	syncFiles(&S3Config{}, compare(local, remote, summary), summary)
+
+	if summary.Uploaded != 0 {
+		t.Error("files should not be uploaded without a complete remote listing")
+	}
+	err := summary.Err()
+	if err == nil {
+		t.Fatal("a remote listing error should fail the sync")
+	}
+	if _, ok := err.(*SyncError); !ok {
+		t.Errorf("expected a *SyncError, got %T", err)
+	}
+}
+
+type fakeUploader struct {
+	mu       sync.Mutex
+	failures map[string]error
+	uploaded map[string]int
+}
+
+func (f *fakeUploader) Upload(input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	return f.UploadWithContext(aws.BackgroundContext(), input, options...)
+}
+
+func (f *fakeUploader) UploadWithContext(ctx aws.Context, input *s3manager.UploadInput, options ...func(*s3manager.Uploader)) (*s3manager.UploadOutput, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	key := aws.StringValue(input.Key)
+	if err, ok := f.failures[key]; ok {
+		delete(f.failures, key)
+		return nil, err
+	}
+	if _, err := ioutil.ReadAll(input.Body); err != nil {
+		return nil, err
+	}
+	f.uploaded[key]++
+
+	return &s3manager.UploadOutput{Location: key}, nil
+}
+
+func TestSyncFiles(t *testing.T) {
+	uploader := &fakeUploader{
+		failures: map[string]error{
+			"uploads/dummy.pdf": awserr.NewRequestFailure(awserr.New("SlowDown", "slow down", nil), 503, "id"),
+			"uploads/missing":   errors.New("unused"),
+		},
+		uploaded: map[string]int{},
+	}
+	config := &S3Config{
+		Uploader:     uploader,
+		Bucket:       "bucket",
+		BucketPrefix: "uploads/",
+		Concurrency:  2,
+	}
+
+	summary := &SyncSummary{}
+	syncFiles(config, fileStats(
+		&FileStat{Name: "dummy.pdf", Path: "testdata/dummy.pdf", Size: 13264},
+		&FileStat{Name: "test.html", Path: "testdata/test.html", Size: 10},
+		&FileStat{Name: "missing", Path: "testdata/missing", Size: 1},
+	), summary)
+
+	if summary.Uploaded != 2 || summary.Failed != 1 {
+		t.Errorf("expected 2 uploaded and 1 failed, got %d and %d", summary.Uploaded, summary.Failed)
+	}
+	if uploader.uploaded["uploads/dummy.pdf"] != 1 {
+		t.Error("transient failures should be retried")
+	}
+	if summary.Err() == nil {
+		t.Error("a failed upload should fail the sync")
+	}
+}
@@ -0,0 +1,251 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+
+	"go.uber.org/zap"
+)
+
+// defaultScanMaxSize is the largest file whose content is scanned when the config
+// does not say otherwise, larger files are only checked by name
+const defaultScanMaxSize = 32 * 1024 * 1024
+
+// defaultScriptExtensions are the extensions a web server may execute as PHP
+var defaultScriptExtensions = []string{
+	".php", ".php3", ".php4", ".php5", ".php7", ".phps", ".pht", ".phtml", ".phar",
+}
+
+// defaultSignatures match code commonly found in PHP backdoors and web shells
+var defaultSignatures = []string{
+	`(?i)eval\s*\(\s*(base64_decode|gzinflate|gzuncompress|str_rot13)\s*\(`,
+	`(?i)(assert|eval|system|passthru|shell_exec|exec|popen)\s*\(\s*\$_(GET|POST|REQUEST|COOKIE|SERVER)`,
+	`(?i)preg_replace\s*\(\s*['"].*/e['"]`,
+	`(?i)\bFilesMan\b`,
+}
+
+// phpOpenTag is looked for inside images, where it only belongs in a polyglot
+var phpOpenTag = []byte("<?php")
+
+// ScanConfig describes how uploads are scanned for malicious files before they
+// are published
+type ScanConfig struct {
+	// Disabled turns scanning off
+	Disabled bool `json:"disabled"`
+	// Extensions lists the script extensions that are never published, anywhere in
+	// a file name so that shell.php.jpg is caught as well
+	Extensions []string `json:"extensions"`
+	// Signatures lists regular expressions matched against file contents. The
+	// built-in signatures are used when it is left out, an empty list turns them off.
+	Signatures []string `json:"signatures"`
+	// MaxSize is the largest file in bytes whose content is scanned
+	MaxSize int64 `json:"max_size"`
+	// Quarantine moves flagged files out of the uploads directory into
+	// .jet/quarantine instead of leaving them in place
+	Quarantine bool `json:"quarantine"`
+}
+
+// ScanFinding is a file that was kept from being published
+type ScanFinding struct {
+	Name   string
+	Path   string
+	Reason string
+}
+
+// ScanError is returned when files were kept from being published
+type ScanError struct {
+	Findings []ScanFinding
+}
+
+func (e *ScanError) Error() string {
+	messages := make([]string, 0, len(e.Findings))
+	for i, finding := range e.Findings {
+		if i == 10 {
+			messages = append(messages, fmt.Sprintf("and %d more", len(e.Findings)-i))
+			break
+		}
+		messages = append(messages, fmt.Sprintf("%s: %s", finding.Name, finding.Reason))
+	}
+
+	return fmt.Sprintf("%d suspicious file(s) were not published: %s", len(e.Findings), strings.Join(messages, "; "))
+}
+
+// Scanner keeps executable scripts, images with embedded PHP and files matching a
+// malware signature out of the bucket
+type Scanner struct {
+	extensions map[string]bool
+	signatures []*regexp.Regexp
+	maxSize    int64
+	quarantine string
+
+	mu       sync.Mutex
+	findings []ScanFinding
+}
+
+// NewScanner returns nil when scanning is disabled. quarantineDirectory is only used
+// when the config asks for flagged files to be quarantined.
+func NewScanner(config ScanConfig, quarantineDirectory string) (*Scanner, error) {
+	if config.Disabled {
+		return nil, nil
+	}
+
+	s := &Scanner{
+		extensions: make(map[string]bool),
+		maxSize:    config.MaxSize,
+	}
+	if s.maxSize <= 0 {
+		s.maxSize = defaultScanMaxSize
+	}
+	if config.Quarantine {
+		s.quarantine = quarantineDirectory
+	}
+
+	extensions := config.Extensions
+	if len(extensions) == 0 {
+		extensions = defaultScriptExtensions
+	}
+	for _, extension := range extensions {
+		s.extensions["."+strings.TrimPrefix(strings.ToLower(extension), ".")] = true
+	}
+
+	signatures := config.Signatures
+	if signatures == nil {
+		signatures = defaultSignatures
+	}
+	for _, signature := range signatures {
+		re, err := regexp.Compile(signature)
+		if err != nil {
+			return nil, fmt.Errorf("invalid scan signature %q: %v", signature, err)
+		}
+		s.signatures = append(s.signatures, re)
+	}
+
+	return s, nil
+}
+
+// scanFiles passes through every file that is safe to publish. Flagged files are
+// recorded, quarantined when configured, and never reach the upload.
+func (s *Scanner) scanFiles(in chan *FileStat) chan *FileStat {
+	if s == nil {
+		return in
+	}
+	out := make(chan *FileStat, cap(in))
+
+	go func() {
+		defer close(out)
+
+		var wg sync.WaitGroup
+		for i := 0; i < runtime.NumCPU(); i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+
+				for file := range in {
+					if file.Err != nil || file.ExcludedBy != "" {
+						out <- file
+						continue
+					}
+
+					reason, err := s.scan(file)
+					if err != nil {
+						out <- &FileStat{Err: fmt.Errorf("scanning %s: %v", file.Name, err)}
+						continue
+					}
+					if reason == "" {
+						out <- file
+						continue
+					}
+					s.flag(file, reason)
+				}
+			}()
+		}
+		wg.Wait()
+	}()
+
+	return out
+}
+
+// scan returns why a file must not be published, or an empty string when it is safe
+func (s *Scanner) scan(file *FileStat) (string, error) {
+	name := strings.ToLower(filepath.Base(file.Name))
+	// Servers that map handlers by extension run shell.php.jpg as PHP, so every
+	// extension counts and not only the last one
+	parts := strings.Split(name, ".")
+	for _, part := range parts[1:] {
+		if s.extensions["."+part] {
+			return fmt.Sprintf("script extension .%s", part), nil
+		}
+	}
+
+	if file.Size > s.maxSize {
+		return "", nil
+	}
+	data, err := ioutil.ReadFile(file.Path)
+	if err != nil {
+		return "", err
+	}
+
+	if strings.HasPrefix(http.DetectContentType(data), "image/") && bytes.Contains(bytes.ToLower(data), phpOpenTag) {
+		return "image with embedded PHP", nil
+	}
+	for _, signature := range s.signatures {
+		if signature.Match(data) {
+			return fmt.Sprintf("matches signature %s", signature), nil
+		}
+	}
+
+	return "", nil
+}
+
+func (s *Scanner) flag(file *FileStat, reason string) {
+	finding := ScanFinding{Name: file.Name, Path: file.Path, Reason: reason}
+
+	if s.quarantine != "" && !dryRun {
+		quarantined := filepath.Join(s.quarantine, filepath.FromSlash(file.Name))
+		err := os.MkdirAll(filepath.Dir(quarantined), 0700)
+		if err == nil {
+			err = os.Rename(file.Path, quarantined)
+		}
+		if err != nil {
+			logger.Error("Could not quarantine file", zap.String("file", file.Name), zap.Error(err))
+		} else {
+			finding.Path = quarantined
+		}
+	}
+
+	logger.Warn("Suspicious file was not published",
+		zap.String("file", file.Name),
+		zap.String("location", finding.Path),
+		zap.String("reason", reason),
+	)
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.findings = append(s.findings, finding)
+}
+
+// Err returns a ScanError listing every flagged file, or nil when there were none
+func (s *Scanner) Err() error {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if len(s.findings) == 0 {
+		return nil
+	}
+
+	findings := append([]ScanFinding(nil), s.findings...)
+	sort.Slice(findings, func(i, j int) bool { return findings[i].Name < findings[j].Name })
+
+	return &ScanError{Findings: findings}
+}
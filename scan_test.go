@@ -0,0 +1,90 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestScanner(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetscan")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	contents := map[string]string{
+		"2018/clean.gif":     "GIF89a\x01\x00\x01\x00clean",
+		"2018/notes.txt":     "<?php is how a PHP file starts",
+		"2018/shell.php.jpg": "\xFF\xD8\xFF",
+		"2018/polyglot.gif":  "GIF89a\x01\x00\x01\x00<?PHP system($_GET['c']); ?>",
+		"2018/backdoor.txt":  "@eval( base64_decode('ZWNobyAxOw=='));",
+		"2018/upper.PHTML":   "",
+		"2018/readme.html":   "<p>plain</p>",
+	}
+	var files []*FileStat
+	for name, content := range contents {
+		filePath := filepath.Join(dir, filepath.FromSlash(name))
+		os.MkdirAll(filepath.Dir(filePath), 0755)
+		ioutil.WriteFile(filePath, []byte(content), 0644)
+		files = append(files, &FileStat{Name: name, Path: filePath, Size: int64(len(content))})
+	}
+
+	scanner, err := NewScanner(ScanConfig{Quarantine: true}, filepath.Join(dir, "quarantine"))
+	if err != nil {
+		t.Fatal("unable to create the scanner: ", err.Error())
+	}
+
+	published := map[string]bool{}
+	for file := range scanner.scanFiles(fileStats(files...)) {
+		if file.Err != nil {
+			t.Fatal("unable to scan the files: ", file.Err.Error())
+		}
+		published[file.Name] = true
+	}
+
+	for _, name := range []string{"2018/clean.gif", "2018/notes.txt", "2018/readme.html"} {
+		if !published[name] {
+			t.Errorf("expected %s to be published", name)
+		}
+	}
+
+	scanErr, ok := scanner.Err().(*ScanError)
+	if !ok || len(scanErr.Findings) != 4 {
+		t.Fatalf("expected four findings, got %v", scanner.Err())
+	}
+	for _, finding := range scanErr.Findings {
+		if published[finding.Name] {
+			t.Errorf("expected %s not to be published", finding.Name)
+		}
+		if _, err := os.Stat(filepath.Join(dir, "quarantine", filepath.FromSlash(finding.Name))); err != nil {
+			t.Errorf("expected %s to be quarantined", finding.Name)
+		}
+	}
+}
+
+func TestScannerSignaturesCanBeTurnedOff(t *testing.T) {
+	file, err := ioutil.TempFile("", "jetscan")
+	if err != nil {
+		t.Fatal("unable to create a temporary file: ", err.Error())
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("@eval(base64_decode('ZWNobyAxOw=='));")
+	file.Close()
+
+	scanner, err := NewScanner(ScanConfig{Signatures: []string{}}, "")
+	if err != nil {
+		t.Fatal("unable to create the scanner: ", err.Error())
+	}
+
+	reason, err := scanner.scan(&FileStat{Name: "backdoor.txt", Path: file.Name()})
+	if err != nil || reason != "" {
+		t.Errorf("expected an empty signature list to turn signatures off, got %q", reason)
+	}
+
+	_, err = NewScanner(ScanConfig{Signatures: []string{"("}}, "")
+	if err == nil {
+		t.Error("expected an invalid signature to be rejected")
+	}
+}
@@ -0,0 +1,380 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+const (
+	defaultSSHPort           = 22
+	defaultSSHConnectTimeout = 15 * time.Second
+	defaultSSHKeepAlive      = 30 * time.Second
+)
+
+// SSHConfig describes how jet connects to the host of an environment
+type SSHConfig struct {
+	// Port is the SSH port of the host, 22 by default
+	Port int `json:"port"`
+	// KeyFiles lists private keys to authenticate with, next to the SSH agent
+	KeyFiles []string `json:"key_files"`
+	// DisableAgent stops jet from using the keys of the running SSH agent
+	DisableAgent bool `json:"disable_agent"`
+	// KnownHosts lists the known_hosts files host keys are verified against,
+	// ~/.ssh/known_hosts by default
+	KnownHosts []string `json:"known_hosts"`
+	// JumpHosts lists the [user@]host[:port] hosts to connect through, in order
+	JumpHosts []string `json:"jump_hosts"`
+	// ConnectTimeout is how long in seconds connecting to each host may take
+	ConnectTimeout int `json:"connect_timeout"`
+	// CommandTimeout is how long in seconds a remote command may run, 0 means no limit
+	CommandTimeout int `json:"command_timeout"`
+	// Retries is how many more times a failed connection is attempted
+	Retries int `json:"retries"`
+	// KeepAlive is how often in seconds an idle connection is checked, 0 means 30
+	KeepAlive int `json:"keep_alive"`
+}
+
+// sshClients holds the open connections so that every step talking to the same host
+// reuses a single connection, along with the jump host connections each one runs over.
+// Connecting to a host only holds the lock of that host, so that a host that does not
+// answer holds up no other.
+var sshClients = struct {
+	sync.Mutex
+	clients map[string]*ssh.Client
+	jumps   map[string][]*ssh.Client
+	dialing map[string]*sync.Mutex
+}{
+	clients: make(map[string]*ssh.Client),
+	jumps:   make(map[string][]*ssh.Client),
+	dialing: make(map[string]*sync.Mutex),
+}
+
+// sshHostLock returns the lock held while connecting to a host
+func sshHostLock(key string) *sync.Mutex {
+	sshClients.Lock()
+	defer sshClients.Unlock()
+	lock, ok := sshClients.dialing[key]
+	if !ok {
+		lock = &sync.Mutex{}
+		sshClients.dialing[key] = lock
+	}
+
+	return lock
+}
+
+// sshAddress returns the host:port an environment is reached at
+func sshAddress(host string, port int) string {
+	if port == 0 {
+		port = defaultSSHPort
+	}
+
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// parseJumpHost splits a [user@]host[:port] jump host, falling back on the user of
+// the environment
+func parseJumpHost(jumpHost string, defaultUser string) (string, string) {
+	user := defaultUser
+	if i := strings.LastIndex(jumpHost, "@"); i >= 0 {
+		user, jumpHost = jumpHost[:i], jumpHost[i+1:]
+	}
+	if _, _, err := net.SplitHostPort(jumpHost); err != nil {
+		jumpHost = sshAddress(jumpHost, defaultSSHPort)
+	}
+
+	return user, jumpHost
+}
+
+// sshClientConfig builds the authentication and host key verification shared by
+// every hop of a connection. The returned function closes the connection to the SSH
+// agent, which is only needed until the handshake is done.
+func sshClientConfig(config SSHConfig, user string) (*ssh.ClientConfig, func(), error) {
+	var signers []ssh.Signer
+	for _, keyFile := range config.KeyFiles {
+		key, err := ioutil.ReadFile(expandHome(keyFile))
+		if err != nil {
+			return nil, nil, err
+		}
+		signer, err := ssh.ParsePrivateKey(key)
+		if err != nil {
+			return nil, nil, fmt.Errorf("parsing ssh key %s: %v", keyFile, err)
+		}
+		signers = append(signers, signer)
+	}
+
+	methods := []ssh.AuthMethod{}
+	closeAgent := func() {}
+	if len(signers) > 0 {
+		methods = append(methods, ssh.PublicKeys(signers...))
+	}
+	if socket := os.Getenv("SSH_AUTH_SOCK"); socket != "" && !config.DisableAgent {
+		conn, err := net.Dial("unix", socket)
+		if err == nil {
+			methods = append(methods, ssh.PublicKeysCallback(agent.NewClient(conn).Signers))
+			closeAgent = func() { conn.Close() }
+		}
+	}
+	if len(methods) == 0 {
+		return nil, nil, errors.New("no ssh key files are configured and no ssh agent is running")
+	}
+
+	knownHosts := config.KnownHosts
+	if len(knownHosts) == 0 {
+		knownHosts = []string{"~/.ssh/known_hosts"}
+	}
+	knownHostsFiles := make([]string, 0, len(knownHosts))
+	for _, file := range knownHosts {
+		knownHostsFiles = append(knownHostsFiles, expandHome(file))
+	}
+	hostKeyCallback, err := knownhosts.New(knownHostsFiles...)
+	if err != nil {
+		closeAgent()
+		return nil, nil, fmt.Errorf("loading known hosts: %v", err)
+	}
+
+	timeout := time.Duration(config.ConnectTimeout) * time.Second
+	if timeout <= 0 {
+		timeout = defaultSSHConnectTimeout
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            methods,
+		HostKeyCallback: hostKeyCallback,
+		Timeout:         timeout,
+	}, closeAgent, nil
+}
+
+// expandHome replaces a leading ~ with the home directory of the current user
+func expandHome(file string) string {
+	if file == "~" || strings.HasPrefix(file, "~/") {
+		return filepath.Join(os.Getenv("HOME"), file[1:])
+	}
+
+	return file
+}
+
+// dialEnvironment returns a connection to the host of an environment, opening it
+// through the jump hosts when there is no open connection to reuse
+func dialEnvironment(environment Environment) (*ssh.Client, error) {
+	address := sshAddress(environment.Host, environment.SSH.Port)
+	key := environment.User + "@" + address
+
+	hostLock := sshHostLock(key)
+	hostLock.Lock()
+	defer hostLock.Unlock()
+
+	sshClients.Lock()
+	client, ok := sshClients.clients[key]
+	sshClients.Unlock()
+	if ok {
+		// A connection that stopped answering is replaced by a new one
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		if err == nil {
+			return client, nil
+		}
+		sshClients.Lock()
+		if sshClients.clients[key] == client {
+			closeSSHClient(key)
+		}
+		sshClients.Unlock()
+	}
+
+	policy := defaultRetryPolicy
+	policy.Attempts = environment.SSH.Retries + 1
+	var jumps []*ssh.Client
+	attempts, err := policy.Do(func() error {
+		var err error
+		client, jumps, err = dialThroughJumpHosts(environment, address)
+		return err
+	}, isTransientSSHError)
+	if err != nil {
+		return nil, fmt.Errorf("connecting to %s after %d attempt(s): %w", key, attempts, err)
+	}
+
+	sshClients.Lock()
+	sshClients.clients[key] = client
+	sshClients.jumps[key] = jumps
+	sshClients.Unlock()
+	go keepAlive(client, environment.SSH.KeepAlive)
+
+	logger.Debug("Connected over SSH",
+		zap.String("host", address),
+		zap.Strings("jump hosts", environment.SSH.JumpHosts),
+	)
+
+	return client, nil
+}
+
+// dialThroughJumpHosts connects to an address through every jump host in turn. It
+// returns the jump host connections too, which must stay open as long as the
+// connection to the address.
+func dialThroughJumpHosts(environment Environment, address string) (*ssh.Client, []*ssh.Client, error) {
+	type hop struct{ user, address string }
+	hops := []hop{}
+	for _, jumpHost := range environment.SSH.JumpHosts {
+		user, jumpAddress := parseJumpHost(jumpHost, environment.User)
+		hops = append(hops, hop{user, jumpAddress})
+	}
+	hops = append(hops, hop{environment.User, address})
+
+	var clients []*ssh.Client
+	closeClients := func() {
+		for i := len(clients) - 1; i >= 0; i-- {
+			clients[i].Close()
+		}
+	}
+	for _, h := range hops {
+		clientConfig, closeAgent, err := sshClientConfig(environment.SSH, h.user)
+		if err != nil {
+			closeClients()
+			return nil, nil, err
+		}
+
+		var conn net.Conn
+		if len(clients) == 0 {
+			conn, err = net.DialTimeout("tcp", h.address, clientConfig.Timeout)
+		} else {
+			conn, err = clients[len(clients)-1].Dial("tcp", h.address)
+		}
+		if err != nil {
+			closeAgent()
+			closeClients()
+			return nil, nil, err
+		}
+
+		// The handshake is bounded by the same timeout as the dial
+		conn.SetDeadline(time.Now().Add(clientConfig.Timeout))
+		c, channels, requests, err := ssh.NewClientConn(conn, h.address, clientConfig)
+		closeAgent()
+		if err != nil {
+			conn.Close()
+			closeClients()
+			return nil, nil, fmt.Errorf("%s: %w", h.address, err)
+		}
+		conn.SetDeadline(time.Time{})
+
+		clients = append(clients, ssh.NewClient(c, channels, requests))
+	}
+
+	return clients[len(clients)-1], clients[:len(clients)-1], nil
+}
+
+// keepAlive pings a connection until it closes so that idle connections between
+// steps are not dropped by firewalls
+func keepAlive(client *ssh.Client, seconds int) {
+	interval := time.Duration(seconds) * time.Second
+	if interval <= 0 {
+		interval = defaultSSHKeepAlive
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for range ticker.C {
+		_, _, err := client.SendRequest("keepalive@openssh.com", true, nil)
+		if err != nil {
+			return
+		}
+	}
+}
+
+// isTransientSSHError reports whether connecting is worth trying again. Rejected
+// credentials and unknown or changed host keys are never transient.
+func isTransientSSHError(err error) bool {
+	var keyErr *knownhosts.KeyError
+	if errors.As(err, &keyErr) {
+		return false
+	}
+	message := err.Error()
+	if strings.Contains(message, "unable to authenticate") || strings.Contains(message, "no ssh key files") ||
+		strings.Contains(message, "known hosts") || strings.Contains(message, "parsing ssh key") {
+		return false
+	}
+
+	return true
+}
+
+// closeSSHClients closes every open connection
+func closeSSHClients() {
+	sshClients.Lock()
+	defer sshClients.Unlock()
+	for key := range sshClients.clients {
+		closeSSHClient(key)
+	}
+}
+
+// closeSSHClient closes a connection and then the jump host connections it runs
+// over, last hop first. sshClients must be locked.
+func closeSSHClient(key string) {
+	sshClients.clients[key].Close()
+	jumps := sshClients.jumps[key]
+	for i := len(jumps) - 1; i >= 0; i-- {
+		jumps[i].Close()
+	}
+	delete(sshClients.clients, key)
+	delete(sshClients.jumps, key)
+}
+
+// RunRemoteCommand runs a command on the host of an environment, streaming its
+// output, and kills it when it runs past the configured command timeout
+func RunRemoteCommand(environment Environment, command string, stdout io.Writer, stderr io.Writer) error {
+	client, err := dialEnvironment(environment)
+	if err != nil {
+		return err
+	}
+
+	session, err := client.NewSession()
+	if err != nil {
+		return err
+	}
+	defer session.Close()
+	session.Stdout = stdout
+	session.Stderr = stderr
+
+	ctx := context.Background()
+	if environment.SSH.CommandTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, time.Duration(environment.SSH.CommandTimeout)*time.Second)
+		defer cancel()
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		done <- session.Run(command)
+	}()
+
+	select {
+	case err = <-done:
+		return err
+	case <-ctx.Done():
+		session.Signal(ssh.SIGKILL)
+		session.Close()
+		return fmt.Errorf("remote command timed out after %ds: %s", environment.SSH.CommandTimeout, command)
+	}
+}
+
+// newSFTPClient opens an SFTP session on the connection to an environment
+func newSFTPClient(environment Environment) (*sftp.Client, error) {
+	client, err := dialEnvironment(environment)
+	if err != nil {
+		return nil, err
+	}
+
+	return sftp.NewClient(client)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// testSSHServer is an in-process SSH server that runs exec requests with sh,
+// serves SFTP and forwards direct-tcpip channels so that it can be a jump host
+type testSSHServer struct {
+	address  string
+	hostKey  ssh.PublicKey
+	listener net.Listener
+}
+
+func startTestSSHServer(t *testing.T, authorized ssh.PublicKey) *testSSHServer {
+	_, hostPrivate, _ := ed25519.GenerateKey(rand.Reader)
+	hostSigner, err := ssh.NewSignerFromKey(hostPrivate)
+	if err != nil {
+		t.Fatal("unable to create the host key: ", err.Error())
+	}
+
+	config := &ssh.ServerConfig{
+		PublicKeyCallback: func(meta ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if string(key.Marshal()) == string(authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", meta.User())
+		},
+	}
+	config.AddHostKey(hostSigner)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("unable to listen: ", err.Error())
+	}
+
+	server := &testSSHServer{address: listener.Addr().String(), hostKey: hostSigner.PublicKey(), listener: listener}
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go server.serve(conn, config)
+		}
+	}()
+
+	return server
+}
+
+func (s *testSSHServer) serve(conn net.Conn, config *ssh.ServerConfig) {
+	_, channels, requests, err := ssh.NewServerConn(conn, config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		switch newChannel.ChannelType() {
+		case "session":
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				continue
+			}
+			go serveSession(channel, requests)
+		case "direct-tcpip":
+			var target struct {
+				Host     string
+				Port     uint32
+				OrigHost string
+				OrigPort uint32
+			}
+			ssh.Unmarshal(newChannel.ExtraData(), &target)
+			upstream, err := net.Dial("tcp", net.JoinHostPort(target.Host, fmt.Sprint(target.Port)))
+			if err != nil {
+				newChannel.Reject(ssh.ConnectionFailed, err.Error())
+				continue
+			}
+			channel, requests, err := newChannel.Accept()
+			if err != nil {
+				upstream.Close()
+				continue
+			}
+			go ssh.DiscardRequests(requests)
+			go func() {
+				io.Copy(channel, upstream)
+				channel.Close()
+			}()
+			go func() {
+				io.Copy(upstream, channel)
+				upstream.Close()
+			}()
+		default:
+			newChannel.Reject(ssh.UnknownChannelType, "unsupported")
+		}
+	}
+}
+
+func serveSession(channel ssh.Channel, requests <-chan *ssh.Request) {
+	defer channel.Close()
+
+	var cmd *exec.Cmd
+	for request := range requests {
+		switch request.Type {
+		case "exec":
+			var payload struct{ Command string }
+			ssh.Unmarshal(request.Payload, &payload)
+			request.Reply(true, nil)
+
+			cmd = exec.Command("sh", "-c", payload.Command)
+			cmd.Stdin = channel
+			cmd.Stdout = channel
+			cmd.Stderr = channel.Stderr()
+			go func(cmd *exec.Cmd) {
+				status := uint32(0)
+				if err := cmd.Run(); err != nil {
+					status = 1
+				}
+				channel.SendRequest("exit-status", false, ssh.Marshal(struct{ Status uint32 }{status}))
+				channel.Close()
+			}(cmd)
+		case "subsystem":
+			request.Reply(true, nil)
+			server, err := sftp.NewServer(channel)
+			if err != nil {
+				return
+			}
+			go func() {
+				server.Serve()
+				channel.Close()
+			}()
+		case "signal":
+			if cmd != nil && cmd.Process != nil {
+				cmd.Process.Kill()
+			}
+		default:
+			request.Reply(false, nil)
+		}
+	}
+}
+
+// testSSHEnvironment writes a client key and a known_hosts file trusting the servers
+// and returns an environment connecting to the last of them through the others
+func testSSHEnvironment(t *testing.T, dir string, servers ...*testSSHServer) Environment {
+	var lines []string
+	for _, server := range servers {
+		lines = append(lines, knownhosts.Line([]string{knownhosts.Normalize(server.address)}, server.hostKey))
+	}
+	knownHostsFile := filepath.Join(dir, "known_hosts")
+	ioutil.WriteFile(knownHostsFile, []byte(strings.Join(lines, "\n")+"\n"), 0600)
+
+	target := servers[len(servers)-1]
+	host, port, _ := net.SplitHostPort(target.address)
+	var jumpHosts []string
+	for _, server := range servers[:len(servers)-1] {
+		jumpHosts = append(jumpHosts, "jump@"+server.address)
+	}
+
+	var portNumber int
+	fmt.Sscan(port, &portNumber)
+
+	return Environment{
+		User: "deploy",
+		Host: host,
+		SSH: SSHConfig{
+			Port:         portNumber,
+			KeyFiles:     []string{filepath.Join(dir, "id_ed25519")},
+			DisableAgent: true,
+			KnownHosts:   []string{knownHostsFile},
+			JumpHosts:    jumpHosts,
+		},
+	}
+}
+
+func testSSHKey(t *testing.T, dir string) ssh.PublicKey {
+	public, private, _ := ed25519.GenerateKey(rand.Reader)
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		t.Fatal("unable to encode the client key: ", err.Error())
+	}
+	ioutil.WriteFile(filepath.Join(dir, "id_ed25519"), pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600)
+
+	key, _ := ssh.NewPublicKey(public)
+	return key
+}
+
+func TestSSHTransport(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetssh")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer closeSSHClients()
+
+	key := testSSHKey(t, dir)
+	jump := startTestSSHServer(t, key)
+	defer jump.listener.Close()
+	target := startTestSSHServer(t, key)
+	defer target.listener.Close()
+
+	environment := testSSHEnvironment(t, dir, jump, target)
+
+	var stdout strings.Builder
+	err = RunRemoteCommand(environment, "echo hello", &stdout, ioutil.Discard)
+	if err != nil || stdout.String() != "hello\n" {
+		t.Fatalf("expected the remote command to print hello, got %q: %v", stdout.String(), err)
+	}
+
+	first, _ := dialEnvironment(environment)
+	second, _ := dialEnvironment(environment)
+	if first == nil || first != second {
+		t.Error("expected the connection to be reused")
+	}
+
+	remoteFile := filepath.Join(dir, "remote.pdf")
+	err = transferFile(environment, "testdata/dummy.pdf", remoteFile)
+	if err != nil {
+		t.Fatal("unable to upload the file: ", err.Error())
+	}
+	local, _ := os.Stat("testdata/dummy.pdf")
+	remote, err := os.Stat(remoteFile)
+	if err != nil || remote.Size() != local.Size() || !remote.ModTime().Equal(local.ModTime().Truncate(time.Second)) {
+		t.Error("expected the uploaded file to match the local file")
+	}
+
+	environment.SSH.CommandTimeout = 1
+	start := time.Now()
+	err = RunRemoteCommand(environment, "sleep 10", ioutil.Discard, ioutil.Discard)
+	if err == nil || time.Since(start) > 5*time.Second {
+		t.Error("expected the remote command to time out")
+	}
+
+	jumps := sshClients.jumps[environment.User+"@"+target.address]
+	if len(jumps) != 1 {
+		t.Fatalf("expected the jump host connection to be tracked, got %d", len(jumps))
+	}
+	closeSSHClients()
+	if _, _, err := jumps[0].SendRequest("keepalive@openssh.com", true, nil); err == nil {
+		t.Error("expected the jump host connection to be closed along with the connection through it")
+	}
+}
+
+func TestSSHRejectsUnknownHostKey(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetssh")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer closeSSHClients()
+
+	key := testSSHKey(t, dir)
+	server := startTestSSHServer(t, key)
+	defer server.listener.Close()
+	impostor := startTestSSHServer(t, key)
+	defer impostor.listener.Close()
+
+	// The known_hosts file trusts the key of another server for this address
+	environment := testSSHEnvironment(t, dir, server)
+	ioutil.WriteFile(environment.SSH.KnownHosts[0],
+		[]byte(knownhosts.Line([]string{knownhosts.Normalize(server.address)}, impostor.hostKey)+"\n"), 0600)
+	environment.SSH.Retries = 3
+
+	start := time.Now()
+	_, err = dialEnvironment(environment)
+	if err == nil {
+		t.Fatal("expected a changed host key to be rejected")
+	}
+	if !strings.Contains(err.Error(), "1 attempt") || time.Since(start) > time.Second {
+		t.Error("expected a changed host key not to be retried: ", err.Error())
+	}
+}
+
+func TestDialDoesNotWaitForOtherHosts(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetssh")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer closeSSHClients()
+
+	key := testSSHKey(t, dir)
+	target := startTestSSHServer(t, key)
+	defer target.listener.Close()
+	environment := testSSHEnvironment(t, dir, target)
+
+	// Another node is still being connected to
+	unreachable := sshHostLock("deploy@192.0.2.1:22")
+	unreachable.Lock()
+	defer unreachable.Unlock()
+
+	connected := make(chan error, 1)
+	go func() {
+		_, err := dialEnvironment(environment)
+		connected <- err
+	}()
+	select {
+	case err := <-connected:
+		if err != nil {
+			t.Error("unable to connect: ", err.Error())
+		}
+	case <-time.After(5 * time.Second):
+		t.Error("expected the connection not to wait for another host")
+	}
+}
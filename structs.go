@@ -4,44 +4,103 @@ import (
 	"time"
 
 	"github.com/aws/aws-sdk-go/service/s3/s3iface"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager/s3manageriface"
 )
 
 // FileStat describes a local and remote file
 type FileStat struct {
-	Err     error
-	Name    string
-	Path    string
-	Size    int64
-	ModTime time.Time
+	Err        error
+	Name       string
+	Path       string
+	Size       int64
+	ModTime    time.Time
+	ETag       string
+	ExcludedBy string
 }
 
 // S3Config contains common paths and configuration
 type S3Config struct {
-	S3Service    s3iface.S3API
-	Bucket       string
-	BucketPrefix string
+	S3Service          s3iface.S3API
+	Uploader           s3manageriface.UploaderAPI
+	Bucket             string
+	BucketPrefix       string
+	Concurrency        int
+	PartSize           int64
+	PartConcurrency    int
+	ResumableThreshold int64
+	StateDirectory     string
+	Limiter            *BandwidthLimiter
+	Matcher            *IgnoreMatcher
+	Scanner            *Scanner
+	Processor          *ImageProcessor
+	Progress           *Progress
+}
+
+// UploadsConfig describes how files are pushed to S3
+type UploadsConfig struct {
+	// Concurrency is the number of files uploaded at once
+	Concurrency int `json:"concurrency"`
+	// PartSize is the size in bytes of each part of a multipart upload
+	PartSize int64 `json:"part_size"`
+	// PartConcurrency is the number of parts of a single file uploaded at once
+	PartConcurrency int `json:"part_concurrency"`
+	// BandwidthLimit caps the combined upload rate in bytes per second, 0 means unlimited
+	BandwidthLimit int64 `json:"bandwidth_limit"`
+	// Exclude lists gitignore-style patterns of files that are never synced
+	Exclude []string `json:"exclude"`
+	// Include lists patterns that re-include files matched by an exclude pattern
+	Include []string `json:"include"`
+	// ProgressInterval is how often in seconds progress is logged during a sync
+	ProgressInterval int `json:"progress_interval"`
+	// LiveProgress draws a progress line on the terminal when stdout is a TTY
+	LiveProgress bool `json:"live_progress"`
+	// Versioning turns on S3 object versioning so that uploads can be rolled back
+	Versioning bool `json:"versioning"`
+	// ResumableThreshold is the file size in bytes from which a failed upload is
+	// resumed on the next run instead of started over, a negative value turns it off
+	ResumableThreshold int64 `json:"resumable_threshold"`
+	// Images optionally processes images before they are uploaded
+	Images ImagesConfig `json:"images"`
+	// Scan describes how files are scanned for malware before they are published
+	Scan ScanConfig `json:"scan"`
+	// URLPaths lists the URL paths the uploads directory is served from, which are
+	// looked for when finding orphaned uploads, /wp-content/uploads/ by default
+	URLPaths []string `json:"url_paths"`
 }
 
 // Database describes what a database config looks like
 type Database struct {
-	Name             string   `json:"name"`
-	Host             string   `json:"host"`
-	Port             int16    `json:"port"`
-	Username         string   `json:"username"`
-	Password         string   `json:"password"`
-	PersistentTables []string `json:"persistent_tables"`
-	TablePrefix      string   `json:"table_prefix"`
+	Name     string       `json:"name"`
+	Host     string       `json:"host"`
+	Port     DatabasePort `json:"port"`
+	Username string       `json:"username"`
+	Password string       `json:"password"`
+	// PasswordEnv, PasswordFile and PasswordCommand keep the password out of the config
+	PasswordEnv      string        `json:"password_env"`
+	PasswordFile     string        `json:"password_file"`
+	PasswordCommand  string        `json:"password_command"`
+	PersistentTables []string      `json:"persistent_tables"`
+	TablePrefix      string        `json:"table_prefix"`
+	Grants           GrantsConfig  `json:"grants"`
+	Admin            DatabaseAdmin `json:"admin"`
+	Socket           string        `json:"socket"`
+	TLS              TLSConfig     `json:"tls"`
+	// DefaultsFile is an option file whose options override the generated ones
+	DefaultsFile string `json:"defaults_file"`
 }
 
 // Environment describes the structure of an environment
 type Environment struct {
-	User              string   `json:"user"`
-	Host              string   `json:"host"`
-	RootDirectory     string   `json:"root_directory"`
-	UploadsLocation   string   `json:"uploads_location"`
-	Database          Database `json:"database"`
-	TargetURLPatterns []string `json:"target_url_patterns"`
-	ReplacementURL    string   `json:"replacement_url"`
+	User              string       `json:"user"`
+	Host              string       `json:"host"`
+	SSH               SSHConfig    `json:"ssh"`
+	RootDirectory     string       `json:"root_directory"`
+	UploadsLocation   string       `json:"uploads_location"`
+	Database          Database     `json:"database"`
+	TargetURLPatterns []string     `json:"target_url_patterns"`
+	ReplacementURL    string       `json:"replacement_url"`
+	Nodes             []Node       `json:"nodes"`
+	Switch            SwitchConfig `json:"switch"`
 }
 
 // Config contains the jet config file
@@ -65,4 +124,9 @@ type Config struct {
 		Production   Environment `json:"production"`
 		LoadBalancer Environment `json:"load_balancer"`
 	} `json:"environments"`
+	Uploads  UploadsConfig  `json:"uploads"`
+	Transfer TransferConfig `json:"transfer"`
+	Lock     LockConfig     `json:"lock"`
+	Runs     RunsConfig     `json:"runs"`
+	Backups  BackupsConfig  `json:"backups"`
 }
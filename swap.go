@@ -0,0 +1,145 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+
+	"go.uber.org/zap"
+)
+
+// Switch strategies
+const (
+	// SwitchStrategyConfig points the site at the restored database by rewriting its config
+	SwitchStrategyConfig = "config"
+	// SwitchStrategyRenameTables keeps the site on the same database and swaps the
+	// restored tables into it
+	SwitchStrategyRenameTables = "rename-tables"
+)
+
+// swapTablePrefix names the tables of the live database while they are being swapped
+const swapTablePrefix = "jet_swap_"
+
+// usesRenameTables reports whether production is switched by swapping tables
+func usesRenameTables(config Config) (bool, error) {
+	switch config.Environments.Production.Switch.Strategy {
+	case "", SwitchStrategyConfig:
+		return false, nil
+	case SwitchStrategyRenameTables:
+		return true, nil
+	}
+
+	return false, fmt.Errorf("unknown switch strategy %q, expected config or rename-tables", config.Environments.Production.Switch.Strategy)
+}
+
+// listTables returns the tables of a database, and refuses databases with views,
+// which cannot be renamed into another database
+func listTables(config Config, database Database) ([]string, error) {
+	var tables, views []string
+	err := queryRows(config, database, "SHOW FULL TABLES", func(row string) {
+		columns := strings.SplitN(row, "\t", 2)
+		if len(columns) == 2 && columns[1] == "VIEW" {
+			views = append(views, columns[0])
+		} else {
+			tables = append(tables, columns[0])
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(views) > 0 {
+		return nil, fmt.Errorf("%s has views, which cannot be swapped: %s", database.Name, strings.Join(views, ", "))
+	}
+
+	return tables, nil
+}
+
+func quoteIdentifier(name string) string {
+	return "`" + strings.Replace(name, "`", "``", -1) + "`"
+}
+
+// swapTablesStatement returns a single RENAME TABLE statement exchanging the tables of
+// two databases. MySQL runs the renames of one statement in order and atomically, so
+// no query ever sees a mix of both databases. Tables that exist in both are moved
+// aside under a temporary name in the backup database first.
+func swapTablesStatement(live string, liveTables []string, backup string, backupTables []string) string {
+	inBackup := make(map[string]bool, len(backupTables))
+	for _, table := range backupTables {
+		inBackup[table] = true
+	}
+	inLive := make(map[string]bool, len(liveTables))
+	for _, table := range liveTables {
+		inLive[table] = true
+	}
+
+	table := func(database, name string) string {
+		return quoteIdentifier(database) + "." + quoteIdentifier(name)
+	}
+	var renames, swapped []string
+	next := 0
+	for _, name := range liveTables {
+		if !inBackup[name] {
+			renames = append(renames, table(live, name)+" TO "+table(backup, name))
+			continue
+		}
+		temporary := fmt.Sprintf("%s%d", swapTablePrefix, next)
+		for inBackup[temporary] || inLive[temporary] {
+			next++
+			temporary = fmt.Sprintf("%s%d", swapTablePrefix, next)
+		}
+		next++
+		renames = append(renames,
+			table(live, name)+" TO "+table(backup, temporary),
+			table(backup, name)+" TO "+table(live, name),
+		)
+		swapped = append(swapped, table(backup, temporary)+" TO "+table(backup, name))
+	}
+	for _, name := range backupTables {
+		if !inLive[name] {
+			renames = append(renames, table(backup, name)+" TO "+table(live, name))
+		}
+	}
+
+	return "RENAME TABLE " + strings.Join(append(renames, swapped...), ", ")
+}
+
+// SwapDatabase exchanges the tables of the live production database with those of
+// the database a backup was restored to. The site keeps using the same database and
+// sees the backup all at once, and the backup database is left holding what was live,
+// so swapping again rolls the deploy back.
+func SwapDatabase(config Config, backupName string) error {
+	if backupName == "" {
+		return errors.New("backupName string cannot be blank")
+	}
+	live := config.Environments.Production.Database
+	backup := live
+	backup.Name = backupDatabaseName(config, backupName)
+
+	liveTables, err := listTables(config, live)
+	if err != nil {
+		return err
+	}
+	backupTables, err := listTables(config, backup)
+	if err != nil {
+		return err
+	}
+	// An empty backup would take the site down with it
+	if len(backupTables) == 0 {
+		return fmt.Errorf("%s has no tables to swap in", backup.Name)
+	}
+
+	err = queryRows(config, live, swapTablesStatement(live.Name, liveTables, backup.Name, backupTables), func(string) {})
+	if err != nil {
+		return err
+	}
+	logger.Info("Swapped Backup into the Live Database",
+		zap.String("database", live.Name),
+		zap.String("previous", backup.Name),
+		zap.Int("tables", len(backupTables)),
+	)
+	// The backup database now holds the tables that were rolled away, which swapping
+	// again rolls back to, so only the grants on older backups are revoked
+	revokeExpired(config, live.Name)
+
+	return nil
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"testing"
+)
+
+func TestSwapTablesStatement(t *testing.T) {
+	statement := swapTablesStatement("site", []string{"wp_posts", "wp_old"}, "site_backup", []string{"wp_posts", "wp_new", "jet_swap_0"})
+
+	expected := "RENAME TABLE " +
+		"`site`.`wp_posts` TO `site_backup`.`jet_swap_1`, " +
+		"`site_backup`.`wp_posts` TO `site`.`wp_posts`, " +
+		"`site`.`wp_old` TO `site_backup`.`wp_old`, " +
+		"`site_backup`.`wp_new` TO `site`.`wp_new`, " +
+		"`site_backup`.`jet_swap_0` TO `site`.`jet_swap_0`, " +
+		"`site_backup`.`jet_swap_1` TO `site_backup`.`wp_posts`"
+	if statement != expected {
+		t.Errorf("expected every table to be exchanged in one statement, got\n%s", statement)
+	}
+
+	if quoteIdentifier("we`ird") != "`we``ird`" {
+		t.Error("expected backticks in names to be escaped")
+	}
+}
+
+func TestUsesRenameTables(t *testing.T) {
+	var config Config
+	renameTables, err := usesRenameTables(config)
+	if err != nil || renameTables {
+		t.Error("expected the config to be rewritten by default")
+	}
+
+	config.Environments.Production.Switch.Strategy = SwitchStrategyRenameTables
+	renameTables, err = usesRenameTables(config)
+	if err != nil || !renameTables {
+		t.Error("expected tables to be renamed")
+	}
+
+	config.Environments.Production.Switch.Strategy = "views"
+	_, err = usesRenameTables(config)
+	if err == nil {
+		t.Error("expected an unknown strategy to be rejected")
+	}
+}
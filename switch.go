@@ -0,0 +1,645 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+)
+
+// Switch targets, the kinds of config file that point a site at its database
+const (
+	SwitchTargetEnv      = "env"
+	SwitchTargetWPConfig = "wp-config"
+	SwitchTargetPHPArray = "php-array"
+	SwitchTargetSymlink  = "symlink"
+)
+
+// defaultSwitchKey is the name the database is set under when the config does not say
+const defaultSwitchKey = "DB_NAME"
+
+// previousCopyPattern matches the timestamp of a copy a file switch keeps of the file
+var previousCopyPattern = regexp.MustCompile(`^\d{8}T\d{6}Z$`)
+
+// backupNamePattern matches the backup names GenerateBackupString returns
+var backupNamePattern = regexp.MustCompile(`^\d{4}-\d{2}-\d{1,2}_\d{1,2}-\d{1,2}-\d{1,2}$`)
+
+// defaultSwitchFiles are the files switched when the config does not say
+var defaultSwitchFiles = map[string]string{
+	SwitchTargetEnv:      ".env",
+	SwitchTargetWPConfig: "wp-config.php",
+}
+
+// SwitchConfig describes how an environment is pointed at the database of a backup
+type SwitchConfig struct {
+	// Target is env (the default), wp-config, php-array or symlink
+	Target string `json:"target"`
+	// File is the file that is switched, relative to the root of the environment
+	// unless it is absolute
+	File string `json:"file"`
+	// Key is the name the database is set under, DB_NAME by default
+	Key string `json:"key"`
+	// Format is the target of the file a symlink points at: env, wp-config or php-array
+	Format string `json:"format"`
+	// Strategy is config (the default) to point the site at the restored database by
+	// rewriting the file, or rename-tables to swap the restored tables into the live database
+	Strategy string `json:"strategy"`
+}
+
+// switchFormat reads and sets the database a config file points at
+type switchFormat struct {
+	read    func(contents string, key string) (string, error)
+	rewrite func(contents string, key string, database string) (string, error)
+}
+
+var switchFormats = map[string]switchFormat{
+	SwitchTargetEnv:      {read: readEnv, rewrite: rewriteEnv},
+	SwitchTargetWPConfig: {read: readDefine, rewrite: rewriteDefine},
+	SwitchTargetPHPArray: {read: readPHPArray, rewrite: rewritePHPArray},
+}
+
+func switchFormatFor(target string) (switchFormat, error) {
+	format, ok := switchFormats[target]
+	if !ok {
+		return switchFormat{}, fmt.Errorf("unknown switch target %q, expected env, wp-config, php-array or symlink", target)
+	}
+
+	return format, nil
+}
+
+// readEnv returns a key of a .env file
+func readEnv(contents string, key string) (string, error) {
+	value, ok := ParseDotenv(contents).Get(key)
+	if !ok {
+		return "", fmt.Errorf("%s is not set in the .env file", key)
+	}
+
+	return value, nil
+}
+
+// rewriteEnv sets a key of a .env file
+func rewriteEnv(contents string, key string, database string) (string, error) {
+	env := ParseDotenv(contents)
+	err := env.Set(key, database)
+	if err != nil {
+		return "", err
+	}
+
+	return env.String(), nil
+}
+
+// phpStringPattern matches a single or double quoted PHP string literal
+const phpStringPattern = `'(?:[^'\\]|\\.)*'|"(?:[^"\\]|\\.)*"`
+
+func definePrefix(key string) string {
+	return `define\s*\(\s*['"]` + regexp.QuoteMeta(key) + `['"]\s*,\s*`
+}
+
+func arrayPrefix(key string) string {
+	return `['"]` + regexp.QuoteMeta(key) + `['"]\s*=>\s*`
+}
+
+// readDefine returns a constant defined with define('KEY', '...'), as wp-config.php does
+func readDefine(contents string, key string) (string, error) {
+	return readPHPString(contents, definePrefix(key), key)
+}
+
+// rewriteDefine sets a constant defined with define('KEY', '...')
+func rewriteDefine(contents string, key string, database string) (string, error) {
+	return rewritePHPString(contents, definePrefix(key), key, database)
+}
+
+// readPHPArray returns an element of a PHP array, 'KEY' => '...'
+func readPHPArray(contents string, key string) (string, error) {
+	return readPHPString(contents, arrayPrefix(key), key)
+}
+
+// rewritePHPArray sets an element of a PHP array
+func rewritePHPArray(contents string, key string, database string) (string, error) {
+	return rewritePHPString(contents, arrayPrefix(key), key, database)
+}
+
+// findPHPString returns where the string literal following prefix starts and ends.
+// Matches in comments and strings are ignored, and anything but exactly one match is
+// an error, since guessing which one PHP uses could point the site at the wrong database.
+func findPHPString(contents string, prefix string, key string) (int, int, error) {
+	pattern := regexp.MustCompile(`(` + prefix + `)(` + phpStringPattern + `)`)
+
+	var matches [][]int
+	for _, match := range pattern.FindAllStringSubmatchIndex(contents, -1) {
+		if phpCodeAt(contents, match[0]) {
+			matches = append(matches, match)
+		}
+	}
+	if len(matches) != 1 {
+		return 0, 0, fmt.Errorf("expected %s to be set to a string exactly once, found %d", key, len(matches))
+	}
+
+	return matches[0][4], matches[0][5], nil
+}
+
+func readPHPString(contents string, prefix string, key string) (string, error) {
+	start, end, err := findPHPString(contents, prefix, key)
+	if err != nil {
+		return "", err
+	}
+
+	return unquotePHP(contents[start:end]), nil
+}
+
+func rewritePHPString(contents string, prefix string, key string, database string) (string, error) {
+	start, end, err := findPHPString(contents, prefix, key)
+	if err != nil {
+		return "", err
+	}
+
+	return contents[:start] + quotePHP(database, contents[start]) + contents[end:], nil
+}
+
+// phpCodeAt reports whether the offset of PHP source is code, rather than a comment or a string
+func phpCodeAt(contents string, offset int) bool {
+	const (
+		code = iota
+		lineComment
+		blockComment
+		singleQuoted
+		doubleQuoted
+	)
+
+	state := code
+	for i := 0; i < offset; i++ {
+		c := contents[i]
+		switch state {
+		case code:
+			switch {
+			case c == '#' || strings.HasPrefix(contents[i:], "//"):
+				state = lineComment
+			case strings.HasPrefix(contents[i:], "/*"):
+				state = blockComment
+				i++
+			case c == '\'':
+				state = singleQuoted
+			case c == '"':
+				state = doubleQuoted
+			}
+		case lineComment:
+			if c == '\n' {
+				state = code
+			}
+		case blockComment:
+			if strings.HasPrefix(contents[i:], "*/") {
+				state = code
+				i++
+			}
+		case singleQuoted, doubleQuoted:
+			if c == '\\' {
+				i++
+			} else if (state == singleQuoted && c == '\'') || (state == doubleQuoted && c == '"') {
+				state = code
+			}
+		}
+	}
+
+	return state == code
+}
+
+func unquotePHP(literal string) string {
+	value := literal[1 : len(literal)-1]
+	if literal[0] == '"' {
+		return strings.NewReplacer(`\\`, `\`, `\"`, `"`, `\$`, `$`).Replace(value)
+	}
+
+	return strings.NewReplacer(`\\`, `\`, `\'`, `'`).Replace(value)
+}
+
+func quotePHP(value string, quote byte) string {
+	if quote == '"' {
+		return `"` + strings.NewReplacer(`\`, `\\`, `"`, `\"`, `$`, `\$`).Replace(value) + `"`
+	}
+
+	return `'` + strings.NewReplacer(`\`, `\\`, `'`, `\'`).Replace(value) + `'`
+}
+
+// siblingName returns the name of a file kept next to another. PHP files keep their
+// extension, so that a web server runs a copy of wp-config.php rather than serving
+// the database password as text.
+func siblingName(file string, suffix string) string {
+	if path.Ext(file) == ".php" {
+		return strings.TrimSuffix(file, ".php") + suffix + ".php"
+	}
+
+	return file + suffix
+}
+
+// databaseSwitch points a node at a database in two steps, so that every node can be
+// prepared before any of them is switched
+type databaseSwitch interface {
+	// current returns the database the node uses
+	current() (string, error)
+	// prepare stages the switch without changing what the node uses
+	prepare(database string) error
+	// commit switches the node atomically
+	commit() error
+	// rollback puts back what the node used before the switch
+	rollback() error
+	// prune removes all but the keep most recent config files earlier switches left
+	// behind, never the one in use or the one a rollback goes back to
+	prune(keep int) error
+	// close removes whatever was staged but not switched to
+	close()
+}
+
+// pruneSiblings removes all but the keep most recent files next to file that are
+// named siblingName(file, prefix+<name>), where name matches pattern. Files in use
+// are never removed.
+func pruneSiblings(files nodeFiles, file string, prefix string, pattern *regexp.Regexp, keep int, inUse ...string) error {
+	directory := path.Dir(file)
+	entries, err := files.ReadDir(directory)
+	if err != nil {
+		return err
+	}
+
+	template := path.Base(siblingName(file, prefix))
+	extension := ""
+	if path.Ext(file) == ".php" {
+		extension = ".php"
+	}
+	head := strings.TrimSuffix(template, extension)
+
+	var siblings []os.FileInfo
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || len(name) < len(template) || !strings.HasPrefix(name, head) || !strings.HasSuffix(name, extension) {
+			continue
+		}
+		if !pattern.MatchString(name[len(head) : len(name)-len(extension)]) {
+			continue
+		}
+		used := false
+		for _, f := range inUse {
+			used = used || path.Join(directory, name) == path.Clean(f)
+		}
+		if !used {
+			siblings = append(siblings, entry)
+		}
+	}
+	sort.Slice(siblings, func(i, j int) bool {
+		return siblings[i].ModTime().After(siblings[j].ModTime())
+	})
+
+	for i, sibling := range siblings {
+		if i < keep {
+			continue
+		}
+		err = files.Remove(path.Join(directory, sibling.Name()))
+		if err != nil {
+			return err
+		}
+		logger.Debug("Removed old database switch file", zap.String("file", path.Join(directory, sibling.Name())))
+	}
+
+	return nil
+}
+
+// newDatabaseSwitch returns the switch of a node with the files and root directory
+func newDatabaseSwitch(config SwitchConfig, files nodeFiles, rootDirectory string, backupName string) (databaseSwitch, error) {
+	target := config.Target
+	if target == "" {
+		target = SwitchTargetEnv
+	}
+	formatName := target
+	if target == SwitchTargetSymlink {
+		formatName = config.Format
+		if formatName == "" || formatName == SwitchTargetSymlink {
+			return nil, errors.New("the symlink switch target needs the format of the file it points at")
+		}
+	}
+	format, err := switchFormatFor(formatName)
+	if err != nil {
+		return nil, err
+	}
+
+	key := config.Key
+	if key == "" {
+		key = defaultSwitchKey
+	}
+	file := config.File
+	if file == "" {
+		file = defaultSwitchFiles[target]
+	}
+	if file == "" {
+		return nil, fmt.Errorf("the %s switch target needs a file", target)
+	}
+	if !path.IsAbs(file) {
+		file = path.Join(rootDirectory, file)
+	}
+
+	if target == SwitchTargetSymlink {
+		return &symlinkSwitch{
+			files:      files,
+			link:       file,
+			staged:     siblingName(file, ".jet-"+backupName),
+			backupName: backupName,
+			key:        key,
+			format:     format,
+		}, nil
+	}
+
+	return &fileSwitch{
+		files:    files,
+		file:     file,
+		staged:   siblingName(file, ".jet-"+backupName),
+		previous: siblingName(file, ".jet-previous-"+time.Now().UTC().Format("20060102T150405Z")),
+		key:      key,
+		format:   format,
+	}, nil
+}
+
+// fileSwitch rewrites a config file and renames it over the live one
+type fileSwitch struct {
+	files  nodeFiles
+	file   string
+	staged string
+	// previous is the timestamped copy of the file the node had before the switch
+	previous string
+	key      string
+	format   switchFormat
+	info     os.FileInfo
+}
+
+// prepare keeps a copy of the live file and stages the switched one next to it,
+// without touching it. Both are synced to disk with the mode and owner of the live one.
+func (s *fileSwitch) prepare(database string) error {
+	var err error
+	s.info, err = s.files.Stat(s.file)
+	if err != nil {
+		return err
+	}
+
+	contents, err := s.files.ReadFile(s.file)
+	if err != nil {
+		return err
+	}
+
+	err = s.files.WriteFile(s.previous, contents, s.info)
+	if err != nil {
+		return err
+	}
+
+	switched, err := s.format.rewrite(string(contents), s.key, database)
+	if err != nil {
+		return err
+	}
+
+	return s.files.WriteFile(s.staged, []byte(switched), s.info)
+}
+
+func (s *fileSwitch) current() (string, error) {
+	contents, err := s.files.ReadFile(s.file)
+	if err != nil {
+		return "", err
+	}
+
+	return s.format.read(string(contents), s.key)
+}
+
+func (s *fileSwitch) commit() error {
+	return s.files.Rename(s.staged, s.file)
+}
+
+// rollback puts the copy of the file the node had before the switch back in place
+func (s *fileSwitch) rollback() error {
+	contents, err := s.files.ReadFile(s.previous)
+	if err != nil {
+		return err
+	}
+
+	err = s.files.WriteFile(s.staged, contents, s.info)
+	if err != nil {
+		return err
+	}
+
+	return s.files.Rename(s.staged, s.file)
+}
+
+// prune removes the oldest copies of the file. They hold the database password, so
+// they are not left to pile up.
+func (s *fileSwitch) prune(keep int) error {
+	return pruneSiblings(s.files, s.file, ".jet-previous-", previousCopyPattern, keep)
+}
+
+func (s *fileSwitch) close() {
+	s.files.Remove(s.staged)
+	s.files.Close()
+}
+
+// symlinkSwitch writes a config file for the backup next to the one a symlink points
+// at, and points the symlink at it. The file it pointed at before is left as it is.
+type symlinkSwitch struct {
+	files      nodeFiles
+	link       string
+	staged     string
+	backupName string
+	key        string
+	format     switchFormat
+	// previous is what the link pointed at before the switch, created the file written for the backup
+	previous  string
+	created   string
+	committed bool
+}
+
+// resolve returns the file a link target refers to
+func (s *symlinkSwitch) resolve(target string) string {
+	if path.IsAbs(target) {
+		return target
+	}
+
+	return path.Join(path.Dir(s.link), target)
+}
+
+// prepare writes the config file of the backup and stages a link to it
+func (s *symlinkSwitch) prepare(database string) error {
+	var err error
+	s.previous, err = s.files.Readlink(s.link)
+	if err != nil {
+		return err
+	}
+
+	current := s.resolve(s.previous)
+	info, err := s.files.Stat(current)
+	if err != nil {
+		return err
+	}
+	contents, err := s.files.ReadFile(current)
+	if err != nil {
+		return err
+	}
+	switched, err := s.format.rewrite(string(contents), s.key, database)
+	if err != nil {
+		return err
+	}
+
+	// The link keeps pointing the way it did, relative or absolute
+	target := path.Join(path.Dir(s.previous), siblingName(path.Base(s.link), "-"+s.backupName))
+	s.created = s.resolve(target)
+	err = s.files.WriteFile(s.created, []byte(switched), info)
+	if err != nil {
+		return err
+	}
+
+	return s.stageLink(target)
+}
+
+func (s *symlinkSwitch) stageLink(target string) error {
+	s.files.Remove(s.staged)
+
+	return s.files.Symlink(target, s.staged)
+}
+
+func (s *symlinkSwitch) current() (string, error) {
+	contents, err := s.files.ReadFile(s.link)
+	if err != nil {
+		return "", err
+	}
+
+	return s.format.read(string(contents), s.key)
+}
+
+func (s *symlinkSwitch) commit() error {
+	err := s.files.Rename(s.staged, s.link)
+	s.committed = err == nil
+
+	return err
+}
+
+// rollback points the link back at the file it pointed at before the switch
+func (s *symlinkSwitch) rollback() error {
+	err := s.stageLink(s.previous)
+	if err != nil {
+		return err
+	}
+
+	err = s.files.Rename(s.staged, s.link)
+	if err != nil {
+		return err
+	}
+	s.committed = false
+
+	return nil
+}
+
+// prune removes the oldest files written for earlier backups
+func (s *symlinkSwitch) prune(keep int) error {
+	if s.previous == "" {
+		return nil
+	}
+
+	return pruneSiblings(s.files, path.Join(path.Dir(s.created), path.Base(s.link)), "-", backupNamePattern, keep,
+		s.created, s.resolve(s.previous))
+}
+
+func (s *symlinkSwitch) close() {
+	s.files.Remove(s.staged)
+	if !s.committed && s.created != "" {
+		s.files.Remove(s.created)
+	}
+	s.files.Close()
+}
+
+// SwitchDatabase points production at the database of a backup. The switched config
+// is synced to disk next to the live one and renamed over it, so a crash leaves either
+// of them in place and never a truncated file.
+func SwitchDatabase(config Config, backupName string) error {
+	if backupName == "" {
+		return errors.New("backupName string cannot be blank")
+	}
+	production := config.Environments.Production
+
+	s, err := newDatabaseSwitch(production.Switch, localFiles{}, GetWorkingDirectory(), backupName)
+	if err != nil {
+		return err
+	}
+	defer s.close()
+
+	previous, err := s.current()
+	if err != nil {
+		return err
+	}
+
+	database := backupDatabaseName(config, backupName)
+	err = s.prepare(database)
+	if err != nil {
+		return err
+	}
+
+	err = s.commit()
+	if err != nil {
+		return err
+	}
+	logger.Info("Switched Production to Backup",
+		zap.String("backup", backupName),
+		zap.String("target", production.Switch.Target),
+		zap.String("previous", previous),
+	)
+	revokeExpired(config, database)
+
+	err = s.prune(config.Runs.keep())
+	if err != nil {
+		logger.Warn("Could not remove old database switch files", zap.Error(err))
+	}
+
+	return nil
+}
+
+// liveDatabases returns the databases production uses, as seen from every web node
+func liveDatabases(config Config) ([]string, error) {
+	production := config.Environments.Production
+	renameTables, err := usesRenameTables(config)
+	if err != nil {
+		return nil, err
+	}
+	if renameTables {
+		return []string{production.Database.Name}, nil
+	}
+
+	if len(production.Nodes) == 0 {
+		s, err := newDatabaseSwitch(production.Switch, localFiles{}, GetWorkingDirectory(), "")
+		if err != nil {
+			return nil, err
+		}
+		defer s.close()
+
+		database, err := s.current()
+		if err != nil {
+			return nil, err
+		}
+		return []string{database}, nil
+	}
+
+	nodes := nodesWithRole(production, RoleWeb)
+	databases := make([]string, len(nodes))
+	err = eachNode(nodes, func(i int, node Node) error {
+		environment := nodeEnvironment(production, node)
+		files, err := openNodeFiles(environment)
+		if err != nil {
+			return err
+		}
+		s, err := newDatabaseSwitch(production.Switch, files, environment.RootDirectory, "")
+		if err != nil {
+			files.Close()
+			return err
+		}
+		defer s.close()
+
+		databases[i], err = s.current()
+		return err
+	})
+
+	return databases, err
+}
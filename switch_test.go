@@ -0,0 +1,216 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestFileSwitchKeepsPrevious(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetswitch")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	original := "# live\nDB_NAME=example_com\n"
+	ioutil.WriteFile(filepath.Join(dir, ".env"), []byte(original), 0640)
+
+	s, err := newDatabaseSwitch(SwitchConfig{}, localFiles{}, dir, "backup")
+	if err != nil {
+		t.Fatal("unable to create the switch: ", err.Error())
+	}
+	defer s.close()
+	err = s.prepare("example_com_backup")
+	if err != nil {
+		t.Fatal("unable to prepare the switch: ", err.Error())
+	}
+	env, _ := ioutil.ReadFile(filepath.Join(dir, ".env"))
+	if string(env) != original {
+		t.Error("expected the live .env not to change before the commit")
+	}
+
+	err = s.commit()
+	if err != nil {
+		t.Fatal("unable to commit the switch: ", err.Error())
+	}
+	env, _ = ioutil.ReadFile(filepath.Join(dir, ".env"))
+	if string(env) != "# live\nDB_NAME=example_com_backup\n" {
+		t.Errorf("expected the .env to be switched, got %q", env)
+	}
+
+	previousFile := s.(*fileSwitch).previous
+	previous, err := ioutil.ReadFile(previousFile)
+	if err != nil || string(previous) != original {
+		t.Error("expected a copy of the previous .env to be kept")
+	}
+	stat, _ := os.Stat(previousFile)
+	if stat == nil || stat.Mode().Perm() != 0640 {
+		t.Error("expected the copy to keep the permissions of the .env")
+	}
+
+	err = s.rollback()
+	if err != nil {
+		t.Fatal("unable to roll back the switch: ", err.Error())
+	}
+	env, _ = ioutil.ReadFile(filepath.Join(dir, ".env"))
+	if string(env) != original {
+		t.Errorf("expected the previous .env to be put back, got %q", env)
+	}
+}
+
+func TestRewriteDefine(t *testing.T) {
+	config := `<?php
+// define('DB_NAME', 'commented');
+/* define( "DB_NAME", "commented" ); */
+$note = "define('DB_NAME', 'quoted')";
+define( 'DB_NAME', 'example_com' );
+define( 'DB_USER', 'example' );
+`
+	switched, err := rewriteDefine(config, "DB_NAME", "example_com_it's")
+	if err != nil {
+		t.Fatal("unable to rewrite the define: ", err.Error())
+	}
+	expected := strings.Replace(config, "'DB_NAME', 'example_com' );", `'DB_NAME', 'example_com_it\'s' );`, 1)
+	if switched != expected {
+		t.Errorf("expected only the live define to change, got\n%s", switched)
+	}
+
+	_, err = rewriteDefine(config+"define('DB_NAME', \"again\");\n", "DB_NAME", "example_com_backup")
+	if err == nil {
+		t.Error("expected a constant defined twice to be rejected")
+	}
+	_, err = rewriteDefine("<?php\ndefine('DB_NAME', getenv('DB_NAME'));\n", "DB_NAME", "example_com_backup")
+	if err == nil {
+		t.Error("expected a constant that is not a string to be rejected")
+	}
+}
+
+func TestRewritePHPArray(t *testing.T) {
+	config := `<?php
+return [
+    # 'database' => 'old',
+    "database" => "example_com",
+    'username' => 'example',
+];
+`
+	switched, err := rewritePHPArray(config, "database", "example_com_$backup")
+	if err != nil {
+		t.Fatal("unable to rewrite the array: ", err.Error())
+	}
+	if !strings.Contains(switched, `"database" => "example_com_\$backup",`) || !strings.Contains(switched, "# 'database' => 'old',") {
+		t.Errorf("expected only the live element to change, got\n%s", switched)
+	}
+}
+
+func TestSymlinkSwitch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetswitch")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	os.Mkdir(filepath.Join(dir, "config"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "config", "database.php"), []byte("<?php\ndefine('DB_NAME', 'example_com');\n"), 0640)
+	os.Symlink("config/database.php", filepath.Join(dir, "db-config.php"))
+
+	config := SwitchConfig{Target: SwitchTargetSymlink, File: "db-config.php", Format: SwitchTargetWPConfig}
+	s, err := newDatabaseSwitch(config, localFiles{}, dir, "backup")
+	if err != nil {
+		t.Fatal("unable to create the switch: ", err.Error())
+	}
+	defer s.close()
+
+	err = s.prepare("example_com_backup")
+	if err == nil {
+		err = s.commit()
+	}
+	if err != nil {
+		t.Fatal("unable to switch the symlink: ", err.Error())
+	}
+
+	link, _ := os.Readlink(filepath.Join(dir, "db-config.php"))
+	if link != "config/db-config-backup.php" {
+		t.Error("expected the link to point at the config of the backup, got ", link)
+	}
+	switched, _ := ioutil.ReadFile(filepath.Join(dir, "db-config.php"))
+	if string(switched) != "<?php\ndefine('DB_NAME', 'example_com_backup');\n" {
+		t.Errorf("expected the config of the backup to be switched, got %q", switched)
+	}
+
+	err = s.rollback()
+	if err != nil {
+		t.Fatal("unable to roll back the symlink: ", err.Error())
+	}
+	link, _ = os.Readlink(filepath.Join(dir, "db-config.php"))
+	if link != "config/database.php" {
+		t.Error("expected the link to point at the previous config, got ", link)
+	}
+
+	_, err = newDatabaseSwitch(SwitchConfig{Target: SwitchTargetSymlink, File: "db-config.php"}, localFiles{}, dir, "backup")
+	if err == nil {
+		t.Error("expected a symlink target without a format to be rejected")
+	}
+}
+
+func TestPruneSwitchFiles(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jetswitch")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	old := time.Now().Add(-time.Hour)
+	for i, name := range []string{
+		"wp-config.jet-previous-20180501T120000Z.php",
+		"wp-config.jet-previous-20180502T120000Z.php",
+		"wp-config.jet-previous-20180503T120000Z.php",
+		"wp-config-2018-05-1_12-0-0.php",
+		"wp-config-2018-05-2_12-0-0.php",
+		"wp-config-2018-05-3_12-0-0.php",
+		"wp-config-sample.php",
+		"wp-config.php",
+		".env.jet-previous-20180501T120000Z",
+		".env.jet-previous-notes",
+	} {
+		ioutil.WriteFile(filepath.Join(dir, name), nil, 0600)
+		modified := old.Add(time.Duration(i) * time.Minute)
+		os.Chtimes(filepath.Join(dir, name), modified, modified)
+	}
+
+	file := filepath.Join(dir, "wp-config.php")
+	err = pruneSiblings(localFiles{}, file, ".jet-previous-", previousCopyPattern, 1)
+	if err == nil {
+		// The oldest backup config is the one a rollback would go back to
+		err = pruneSiblings(localFiles{}, file, "-", backupNamePattern, 1, filepath.Join(dir, "wp-config-2018-05-1_12-0-0.php"))
+	}
+	if err == nil {
+		err = pruneSiblings(localFiles{}, filepath.Join(dir, ".env"), ".jet-previous-", previousCopyPattern, 0)
+	}
+	if err != nil {
+		t.Fatal("unable to prune: ", err.Error())
+	}
+
+	entries, _ := ioutil.ReadDir(dir)
+	var kept []string
+	for _, entry := range entries {
+		kept = append(kept, entry.Name())
+	}
+	sort.Strings(kept)
+	expected := []string{
+		".env.jet-previous-notes",
+		"wp-config-2018-05-1_12-0-0.php",
+		"wp-config-2018-05-3_12-0-0.php",
+		"wp-config-sample.php",
+		"wp-config.jet-previous-20180503T120000Z.php",
+		"wp-config.php",
+	}
+	if !reflect.DeepEqual(kept, expected) {
+		t.Errorf("expected only the most recent copies and files in use to be kept, got %v", kept)
+	}
+}
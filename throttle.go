@@ -0,0 +1,76 @@
+package main
+
+import (
+	"io"
+	"sync"
+	"time"
+)
+
+// throttleChunkSize bounds how many bytes are requested from the limiter at once so
+// that large reads are spread out instead of arriving in bursts
+const throttleChunkSize = 32 * 1024
+
+// BandwidthLimiter caps the combined throughput of every reader sharing it
+type BandwidthLimiter struct {
+	mu   sync.Mutex
+	rate int64
+	next time.Time
+}
+
+// NewBandwidthLimiter returns a limiter allowing rate bytes per second. A rate of
+// zero or less returns nil, which never throttles.
+func NewBandwidthLimiter(rate int64) *BandwidthLimiter {
+	if rate <= 0 {
+		return nil
+	}
+
+	return &BandwidthLimiter{rate: rate}
+}
+
+// Wait blocks until n more bytes may be transferred
+func (l *BandwidthLimiter) Wait(n int) {
+	if l == nil || n <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	l.next = l.next.Add(time.Duration(int64(n) * int64(time.Second) / l.rate))
+	delay := l.next.Sub(now)
+	l.mu.Unlock()
+
+	time.Sleep(delay)
+}
+
+// Reader wraps a file so that reads through it are throttled. The wrapper is not an
+// io.ReaderAt, so the S3 uploader reads it once, in order, into its part buffers
+// rather than reading sections of it again when signing and retrying requests.
+func (l *BandwidthLimiter) Reader(r io.ReadSeeker) io.ReadSeeker {
+	if l == nil {
+		return r
+	}
+
+	return &throttledReader{r: r, limiter: l}
+}
+
+type throttledReader struct {
+	r       io.ReadSeeker
+	limiter *BandwidthLimiter
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	if len(p) > throttleChunkSize {
+		p = p[:throttleChunkSize]
+	}
+	n, err := t.r.Read(p)
+	t.limiter.Wait(n)
+
+	return n, err
+}
+
+func (t *throttledReader) Seek(offset int64, whence int) (int64, error) {
+	return t.r.Seek(offset, whence)
+}
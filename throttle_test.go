@@ -0,0 +1,45 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestBandwidthLimiter(t *testing.T) {
+	if NewBandwidthLimiter(0) != nil {
+		t.Error("a zero rate should not create a limiter")
+	}
+
+	data := bytes.Repeat([]byte("a"), 64*1024)
+	limiter := NewBandwidthLimiter(256 * 1024)
+
+	start := time.Now()
+	read, err := ioutil.ReadAll(limiter.Reader(bytes.NewReader(data)))
+	if err != nil {
+		t.Fatal("unable to read through the limiter: ", err.Error())
+	}
+	if !bytes.Equal(read, data) {
+		t.Error("throttled reads should not alter the data")
+	}
+	// 64 KiB at 256 KiB/s should take roughly a quarter of a second
+	if elapsed := time.Since(start); elapsed < 200*time.Millisecond {
+		t.Errorf("expected reads to be throttled, took %v", elapsed)
+	}
+}
+
+func TestThrottledReaderSeek(t *testing.T) {
+	data := []byte("0123456789")
+	reader := NewBandwidthLimiter(1 << 30).Reader(bytes.NewReader(data))
+
+	_, err := reader.Seek(5, io.SeekStart)
+	if err != nil {
+		t.Fatal("unable to seek: ", err.Error())
+	}
+	rest, _ := ioutil.ReadAll(reader)
+	if string(rest) != "56789" {
+		t.Errorf("expected to read from the seek offset, got %q", rest)
+	}
+}
@@ -0,0 +1,463 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/pkg/sftp"
+	"go.uber.org/zap"
+)
+
+// transferPartialSuffix marks remote files that are still being transferred. The
+// start of the checksum of the local file is appended so that a partial transfer is
+// only resumed from the same file.
+const transferPartialSuffix = ".jetpart-"
+
+// transferFile copies a local file to the host of an environment. The file is
+// written under a temporary name, resumed from whatever an earlier attempt already
+// sent, verified against the local checksum and only then renamed into place.
+func transferFile(environment Environment, localFile string, remoteFile string) error {
+	checksum, err := hashFile(localFile)
+	if err != nil {
+		return err
+	}
+
+	policy := defaultRetryPolicy
+	policy.Attempts = environment.SSH.Retries + 1
+	attempts, err := policy.Do(func() error {
+		return sendFile(environment, localFile, remoteFile, checksum)
+	}, isTransientSSHError)
+	if err != nil {
+		return fmt.Errorf("transferring %s after %d attempt(s): %v", localFile, attempts, err)
+	}
+
+	return nil
+}
+
+func sendFile(environment Environment, localFile string, remoteFile string, checksum string) error {
+	client, err := newSFTPClient(environment)
+	if err != nil {
+		return err
+	}
+	defer client.Close()
+
+	source, err := os.Open(localFile)
+	if err != nil {
+		return err
+	}
+	defer source.Close()
+	stat, err := source.Stat()
+	if err != nil {
+		return err
+	}
+
+	err = client.MkdirAll(path.Dir(remoteFile))
+	if err != nil {
+		return err
+	}
+
+	partial := remoteFile + transferPartialSuffix + checksum[:16]
+	err = removeStaleTransfers(client, remoteFile, partial)
+	if err != nil {
+		return err
+	}
+
+	var offset int64
+	if remote, err := client.Stat(partial); err == nil && remote.Size() <= stat.Size() {
+		offset = remote.Size()
+	}
+
+	destination, err := client.OpenFile(partial, os.O_WRONLY|os.O_CREATE)
+	if err != nil {
+		return err
+	}
+	err = destination.Truncate(offset)
+	if err == nil {
+		_, err = destination.Seek(offset, io.SeekStart)
+	}
+	if err == nil {
+		_, err = source.Seek(offset, io.SeekStart)
+	}
+	if err != nil {
+		destination.Close()
+		return err
+	}
+
+	start := time.Now()
+	sent, err := io.Copy(destination, source)
+	if err != nil {
+		destination.Close()
+		return err
+	}
+	err = destination.Close()
+	if err != nil {
+		return err
+	}
+
+	remoteChecksum, err := remoteSHA256(environment, partial)
+	if err != nil {
+		return err
+	}
+	if remoteChecksum != checksum {
+		// Whatever arrived is corrupt, so the next attempt starts over
+		client.Remove(partial)
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", remoteFile, checksum, remoteChecksum)
+	}
+
+	err = client.Chmod(partial, stat.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	err = client.Chtimes(partial, stat.ModTime(), stat.ModTime())
+	if err != nil {
+		return err
+	}
+	err = client.PosixRename(partial, remoteFile)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Transferred file",
+		zap.String("file", localFile),
+		zap.String("destination", remoteFile),
+		zap.Int64("resumed from", offset),
+		zap.Int64("bytes sent", sent),
+		zap.String("sha256", checksum),
+		zap.Duration("duration", time.Since(start)),
+	)
+
+	return nil
+}
+
+// removeStaleTransfers removes partial transfers of an older version of the file
+func removeStaleTransfers(client *sftp.Client, remoteFile string, keep string) error {
+	entries, err := client.ReadDir(path.Dir(remoteFile))
+	if err != nil {
+		return err
+	}
+
+	prefix := path.Base(remoteFile) + transferPartialSuffix
+	for _, entry := range entries {
+		name := path.Join(path.Dir(remoteFile), entry.Name())
+		if !strings.HasPrefix(entry.Name(), prefix) || name == keep {
+			continue
+		}
+		err = client.Remove(name)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// remoteSHA256 checksums a file on the host of an environment
+func remoteSHA256(environment Environment, remoteFile string) (string, error) {
+	var stdout, stderr strings.Builder
+	quoted := shellQuote(remoteFile)
+	err := RunRemoteCommand(environment,
+		fmt.Sprintf("sha256sum %s 2>/dev/null || shasum -a 256 %s", quoted, quoted),
+		&stdout, &stderr,
+	)
+	if err != nil {
+		return "", fmt.Errorf("checksumming %s: %v: %s", remoteFile, err, strings.TrimSpace(stderr.String()))
+	}
+
+	fields := strings.Fields(stdout.String())
+	if len(fields) == 0 {
+		return "", fmt.Errorf("checksumming %s: no output", remoteFile)
+	}
+
+	return fields[0], nil
+}
+
+// shellQuote quotes a string for a POSIX shell
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// transferPrefix is where dumps are handed from staging to production through S3
+const transferPrefix = "transfers/"
+
+// TransferConfig describes how the database dump gets from staging to production
+type TransferConfig struct {
+	// Transport is "ssh" to copy the dump over SFTP, or "s3" to hand it over through
+	// the bucket when the servers cannot reach each other
+	Transport string `json:"transport"`
+}
+
+// transferObjectKey returns the key the dump of a backup is handed over at
+func transferObjectKey(backupName string, localFile string) string {
+	return transferPrefix + backupName + "/" + path.Base(localFile)
+}
+
+// defaultTransferKey is where staging hands the dump of a backup over, and so where
+// production looks for it
+func defaultTransferKey(backupName string) string {
+	return transferObjectKey(backupName, stagingDumpFile)
+}
+
+// TransferDump gets the dump of a run into the same run's directory on production
+// using the configured transport and returns the S3 key it was handed over at, if any
+func TransferDump(config Config, run *Run) (string, error) {
+	localFile := run.Path(stagingDumpFile)
+
+	switch config.Transfer.Transport {
+	case "", "ssh":
+		production, err := databaseNode(config.Environments.Production)
+		if err != nil {
+			return "", err
+		}
+		return "", sendToNode(production, localFile, run.remotePath(config, production, stagingDumpFile))
+	case "s3":
+		key := transferObjectKey(run.Name, localFile)
+		return key, PushTransfer(config, localFile, key)
+	}
+
+	return "", fmt.Errorf("unknown transfer transport %q, expected ssh or s3", config.Transfer.Transport)
+}
+
+// transferManifestKey returns the key of the manifest describing the file handed
+// over at key
+func transferManifestKey(key string) string {
+	return key + ".json"
+}
+
+// PushTransfer uploads a file to the bucket, encrypted the way backups are, along
+// with a manifest production verifies and decrypts the download with
+func PushTransfer(config Config, localFile string, key string) error {
+	err := loadAwsConfigFile()
+	if err != nil {
+		return err
+	}
+
+	s3config, err := newS3Config(config, path.Dir(key)+"/")
+	if err != nil {
+		return err
+	}
+
+	format, err := config.Backups.Encryption.format()
+	if err != nil {
+		return err
+	}
+	dumpChecksum, err := hashFile(localFile)
+	if err != nil {
+		return err
+	}
+	stored, keys, err := encryptBackup(config.Backups.Encryption, localFile)
+	if err != nil {
+		return err
+	}
+	if stored != localFile {
+		defer os.Remove(stored)
+	}
+	checksum, err := hashFile(stored)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(stored)
+	if err != nil {
+		return err
+	}
+
+	name := encryptedName(path.Base(key), format)
+	file := &FileStat{Name: name, Path: stored, Size: stat.Size(), ModTime: stat.ModTime()}
+	attempts, err := defaultRetryPolicy.Do(func() error {
+		return upload(s3config, file)
+	}, isTransientS3Error)
+	if err != nil {
+		return fmt.Errorf("uploading %s after %d attempt(s): %v", key, attempts, err)
+	}
+
+	manifest := &BackupManifest{
+		BackupName: path.Base(path.Dir(key)),
+		Created:    time.Now().UTC(),
+		File:       name,
+		Size:       stat.Size(),
+		SHA256:     checksum,
+		DumpSHA256: dumpChecksum,
+		Encryption: format,
+		Keys:       keys,
+	}
+	body, err := json.MarshalIndent(manifest, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = s3config.S3Service.PutObject(&s3.PutObjectInput{
+		Bucket:      aws.String(s3config.Bucket),
+		Key:         aws.String(transferManifestKey(key)),
+		Body:        bytes.NewReader(body),
+		ContentType: aws.String("application/json"),
+	})
+	if err != nil {
+		return err
+	}
+
+	logger.Info("Pushed file to S3 for transfer",
+		zap.String("file", localFile),
+		zap.String("bucket", s3config.Bucket),
+		zap.String("key", path.Dir(key)+"/"+name),
+		zap.String("encryption", format),
+		zap.String("sha256", checksum),
+	)
+
+	return nil
+}
+
+// FetchTransfer downloads a file staging handed over through the bucket into the
+// directory of the run, resuming an interrupted download, verifies and decrypts it,
+// and then removes it from the bucket
+func FetchTransfer(config Config, run *Run, key string) error {
+	err := loadAwsConfigFile()
+	if err != nil {
+		return err
+	}
+
+	s3config, err := newS3Config(config, path.Dir(key)+"/")
+	if err != nil {
+		return err
+	}
+
+	return fetchTransfer(s3config, config.Backups.Encryption, key, run.Directory)
+}
+
+func fetchTransfer(config *S3Config, encryption EncryptionConfig, key string, directory string) error {
+	localFile := path.Join(directory, path.Base(key))
+
+	// A rerun finds the transfer already fetched and removed from the bucket
+	if manifest, err := readTransferManifest(directory); err == nil {
+		checksum, err := hashFile(localFile)
+		if err == nil && checksum == manifest.DumpSHA256 {
+			logger.Info("Reusing file fetched from S3 transfer",
+				zap.String("key", key),
+				zap.String("file", localFile),
+				zap.String("sha256", checksum),
+			)
+			return nil
+		}
+	}
+
+	object, err := config.S3Service.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(transferManifestKey(key)),
+	})
+	if err != nil {
+		return fmt.Errorf("fetching the manifest of %s: %v", key, err)
+	}
+	body, err := ioutil.ReadAll(object.Body)
+	object.Body.Close()
+	if err != nil {
+		return err
+	}
+	manifest := &BackupManifest{}
+	err = json.Unmarshal(body, manifest)
+	if err != nil {
+		return fmt.Errorf("could not parse the manifest of %s: %v", key, err)
+	}
+	if manifest.File == "" || path.Base(manifest.File) != manifest.File {
+		return fmt.Errorf("the manifest of %s names an invalid file %q", key, manifest.File)
+	}
+
+	storedKey := path.Dir(key) + "/" + manifest.File
+	head, err := config.S3Service.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(config.Bucket),
+		Key:    aws.String(storedKey),
+	})
+	if err != nil {
+		return fmt.Errorf("fetching %s: %v", storedKey, err)
+	}
+	remote := &FileStat{
+		Name:    manifest.File,
+		Path:    storedKey,
+		Size:    aws.Int64Value(head.ContentLength),
+		ModTime: aws.TimeValue(head.LastModified),
+		ETag:    aws.StringValue(head.ETag),
+	}
+
+	attempts, err := defaultRetryPolicy.Do(func() error {
+		return download(config, directory, remote)
+	}, isTransientS3Error)
+	if err != nil {
+		return fmt.Errorf("downloading %s after %d attempt(s): %v", storedKey, attempts, err)
+	}
+
+	stored := path.Join(directory, remote.Name)
+	checksum, err := hashFile(stored)
+	if err != nil {
+		return err
+	}
+	if checksum != manifest.SHA256 {
+		os.Remove(stored)
+		return fmt.Errorf("checksum mismatch for %s: expected %s, got %s", storedKey, manifest.SHA256, checksum)
+	}
+
+	if stored != localFile {
+		err = decryptBackup(encryption, manifest.Encryption, stored, localFile)
+		os.Remove(stored)
+		if err != nil {
+			return err
+		}
+	}
+	checksum, err = hashFile(localFile)
+	if err != nil {
+		return err
+	}
+	if checksum != manifest.DumpSHA256 {
+		os.Remove(localFile)
+		return fmt.Errorf("checksum mismatch for the decrypted dump of %s: expected %s, got %s", key, manifest.DumpSHA256, checksum)
+	}
+
+	err = ioutil.WriteFile(path.Join(directory, transferManifestFile), body, 0600)
+	if err != nil {
+		return err
+	}
+
+	// The dump is only needed until production has it
+	for _, object := range []string{storedKey, transferManifestKey(key)} {
+		_, err = config.S3Service.DeleteObject(&s3.DeleteObjectInput{
+			Bucket: aws.String(config.Bucket),
+			Key:    aws.String(object),
+		})
+		if err != nil {
+			logger.Warn("Could not remove the transfer from S3",
+				zap.String("key", object),
+				zap.Error(err),
+			)
+		}
+	}
+
+	logger.Info("Fetched file from S3 transfer",
+		zap.String("key", storedKey),
+		zap.String("file", localFile),
+		zap.String("encryption", manifest.Encryption),
+		zap.String("sha256", checksum),
+	)
+
+	return nil
+}
+
+// readTransferManifest reads the manifest of a transfer that was already fetched
+// into the directory of a run
+func readTransferManifest(directory string) (*BackupManifest, error) {
+	body, err := ioutil.ReadFile(path.Join(directory, transferManifestFile))
+	if err != nil {
+		return nil, err
+	}
+
+	manifest := &BackupManifest{}
+	err = json.Unmarshal(body, manifest)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestTransferFileResumes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jettransfer")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+	defer closeSSHClients()
+
+	key := testSSHKey(t, dir)
+	server := startTestSSHServer(t, key)
+	defer server.listener.Close()
+	environment := testSSHEnvironment(t, dir, server)
+	environment.SSH.Retries = 1
+
+	local, _ := ioutil.ReadFile("testdata/dummy.pdf")
+	checksum, _ := hashFile("testdata/dummy.pdf")
+	remoteFile := filepath.Join(dir, "dump.sql")
+	partial := remoteFile + transferPartialSuffix + checksum[:16]
+	stale := remoteFile + transferPartialSuffix + "0000000000000000"
+
+	// Half of the file arrived during an earlier attempt
+	ioutil.WriteFile(partial, local[:len(local)/2], 0644)
+	ioutil.WriteFile(stale, []byte("an older dump"), 0644)
+
+	err = transferFile(environment, "testdata/dummy.pdf", remoteFile)
+	if err != nil {
+		t.Fatal("unable to transfer the file: ", err.Error())
+	}
+	remote, _ := ioutil.ReadFile(remoteFile)
+	if !bytes.Equal(remote, local) {
+		t.Error("expected the resumed transfer to match the local file")
+	}
+	for _, leftover := range []string{partial, stale} {
+		if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+			t.Errorf("expected %s to be removed", leftover)
+		}
+	}
+
+	// A corrupt partial file fails verification and the retry starts over
+	os.Remove(remoteFile)
+	ioutil.WriteFile(partial, bytes.Repeat([]byte("x"), len(local)/2), 0644)
+	err = transferFile(environment, "testdata/dummy.pdf", remoteFile)
+	if err != nil {
+		t.Fatal("expected the transfer to recover from a corrupt partial file: ", err.Error())
+	}
+	remote, _ = ioutil.ReadFile(remoteFile)
+	if !bytes.Equal(remote, local) {
+		t.Error("expected the retried transfer to match the local file")
+	}
+}
+
+func TestFetchTransfer(t *testing.T) {
+	dir, err := ioutil.TempDir("", "jettransfer")
+	if err != nil {
+		t.Fatal("unable to create a temporary directory: ", err.Error())
+	}
+	defer os.RemoveAll(dir)
+
+	contents := []byte("CREATE TABLE wp_posts (ID bigint);")
+	key := transferObjectKey("2018-05-1_12-0-0", "staging_dump.sql")
+	if key != defaultTransferKey("2018-05-1_12-0-0") {
+		t.Errorf("expected the dump to be handed over at the default key, got %s", key)
+	}
+
+	encryption := EncryptionConfig{Key: "correct horse battery staple"}
+	dump := filepath.Join(dir, "dump")
+	ioutil.WriteFile(dump, contents, 0600)
+	stored, keys, err := encryptBackup(encryption, dump)
+	if err != nil {
+		t.Fatal("unable to encrypt the dump: ", err.Error())
+	}
+	encrypted, _ := ioutil.ReadFile(stored)
+	checksum, _ := hashFile(stored)
+	dumpChecksum, _ := hashFile(dump)
+	manifest, _ := json.Marshal(&BackupManifest{
+		BackupName: "2018-05-1_12-0-0",
+		File:       "staging_dump.sql.gpg",
+		SHA256:     checksum,
+		DumpSHA256: dumpChecksum,
+		Encryption: EncryptionKey,
+		Keys:       keys,
+	})
+	objects := func() map[string][]byte {
+		return map[string][]byte{
+			key + ".gpg":             encrypted,
+			transferManifestKey(key): manifest,
+		}
+	}
+	service := &fakeS3{objects: objects()}
+	config := &S3Config{S3Service: service, Bucket: "bucket", BucketPrefix: "transfers/2018-05-1_12-0-0/"}
+
+	run := filepath.Join(dir, "run")
+	os.Mkdir(run, 0700)
+	err = fetchTransfer(config, encryption, key, run)
+	if err != nil {
+		t.Fatal("unable to fetch the transfer: ", err.Error())
+	}
+	fetched, _ := ioutil.ReadFile(filepath.Join(run, "staging_dump.sql"))
+	if !bytes.Equal(fetched, contents) {
+		t.Error("expected the fetched dump to match the uploaded dump")
+	}
+	if _, err := os.Stat(filepath.Join(run, "staging_dump.sql.gpg")); !os.IsNotExist(err) {
+		t.Error("expected the encrypted dump to be removed once decrypted")
+	}
+	if len(service.objects) != 0 {
+		t.Errorf("expected the transfer to be removed from the bucket, found %d objects", len(service.objects))
+	}
+
+	// A rerun finds the transfer gone and keeps the dump it already fetched
+	err = fetchTransfer(config, encryption, key, run)
+	if err != nil {
+		t.Error("expected a rerun to reuse the fetched dump: ", err.Error())
+	}
+
+	tampered := filepath.Join(dir, "tampered")
+	os.Mkdir(tampered, 0700)
+	service.objects = objects()
+	service.objects[key+".gpg"] = append(encrypted, 0)
+	err = fetchTransfer(config, encryption, key, tampered)
+	if err == nil || !strings.Contains(err.Error(), "checksum mismatch") {
+		t.Errorf("expected a checksum mismatch, got %v", err)
+	}
+	if _, err := os.Stat(filepath.Join(tampered, "staging_dump.sql.gpg")); !os.IsNotExist(err) {
+		t.Error("expected a dump that failed verification to be removed")
+	}
+	if len(service.objects) != 2 {
+		t.Error("expected a transfer that failed verification to be left in the bucket")
+	}
+}